@@ -6,13 +6,24 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"log"
 )
 
 // Chunk is the unit of data storage.
 // Contains a header(meta) and data.
 type Chunk struct {
 	Header  ChunkHeader
-	DataRaw []byte
+	DataRaw []byte // the value, decoded
+
+	// Compress encodes DataRaw when the chunk is marshaled, nil stores it as is.
+	Compress *CompressOptions
+	// Keys encrypts key and data when the chunk is marshaled, and decrypts them when it is read.
+	// nil means the chunk is in the clear.
+	Keys *Keyring
+
+	key     []byte // the key in the clear
+	stored  []byte // DataRaw encoded, in the clear
+	encoded bool   // Compress is tried
 }
 
 // Set sets the key and data of the chunk.
@@ -20,30 +31,83 @@ func (c *Chunk) Set(key, data []byte) error {
 	if len(data) > ChunkDataSize {
 		return ErrChunkDataTooLarge
 	}
-	if len(key) > ChunkKeyMaxSize {
+	if len(key) > ChunkKeyMaxSize || c.Keys != nil && len(key)+chunkSealOverhead > ChunkKeyMaxSize {
 		return ErrChunkKeyTooLarge
 	}
+	c.key = key
 	c.DataRaw = data
+	c.encoded = false
 	copy(c.Header.Key[:], key)
 
 	c.Header.Magic = MagicChunk
-	c.Header.DataLength = uint32(len(data))
+	c.Header.Version = ChunkHeaderVersion
 	c.Header.HeaderSize = ChunkHeaderSizeFixed
-	c.Header.Checksum = crc32.ChecksumIEEE(data)
+	c.Header.RawLength = uint32(len(data))
+	c.setStored(CodecNone, data)
+	return nil
+}
+
+// setStored sets the data as on disk and its codec.
+func (c *Chunk) setStored(codec uint8, stored []byte) {
+	c.stored = stored
+	c.Header.Codec = codec
+	c.Header.DataLength = uint32(len(stored))
+	c.Header.Checksum = crc32.ChecksumIEEE(stored)
+	c.Header.HeaderChecksum = c.Header.GenerateHeaderChecksum()
+}
+
+// encode compresses DataRaw with Compress once, and keeps it only if it saves Compress.MinSaving.
+// A codec error is not fatal, the value is stored as is then.
+func (c *Chunk) encode() {
+	if c.Compress == nil || c.encoded || len(c.DataRaw) == 0 {
+		return
+	}
+	c.encoded = true
+	enc, err := c.Compress.Codec.Encode(c.DataRaw)
+	if err != nil {
+		log.Printf("warn: compress chunk failed, stored as is, err: %v", err)
+		return
+	}
+	if len(enc) >= len(c.DataRaw) || float64(len(enc)) > float64(len(c.DataRaw))*(1-c.Compress.MinSaving) {
+		return
+	}
+	c.setStored(c.Compress.Codec.ID(), enc)
+}
+
+// SetMeta sets the raw metadata of the chunk, stored in header.
+func (c *Chunk) SetMeta(meta []byte) error {
+	if len(meta) > ChunkMetaMaxSize {
+		return ErrChunkMetaTooLarge
+	}
+	c.Header.Meta = [ChunkMetaMaxSize]byte{}
+	copy(c.Header.Meta[:], meta)
+	c.Header.MetaLength = uint32(len(meta))
 	c.Header.HeaderChecksum = c.Header.GenerateHeaderChecksum()
 	return nil
 }
 
+// SetSerial sets the write serial of the chunk, newer chunks have bigger serials.
+func (c *Chunk) SetSerial(serial uint64) {
+	c.Header.Serial = serial
+	c.Header.HeaderChecksum = c.Header.GenerateHeaderChecksum()
+}
+
 // GetKeyData returns the key and data of the chunk.
-// Note: The key is trimmed by the null character.
+// Note: The key in the clear is trimmed by the null character.
 func (c *Chunk) GetKeyData() ([]byte, []byte) {
-	keyTrim := bytes.TrimRight(c.Header.Key[:], "\x00")
-	return keyTrim, c.DataRaw
+	if c.Header.KeyID != 0 {
+		return c.key, c.DataRaw
+	}
+	return c.Header.GetKey(), c.DataRaw
 }
 
-// GetBinaryLength returns the binary length of the chunk.
+// GetBinaryLength returns the binary length of the chunk, with data compressed if Compress is set, and encrypted if Keys is set.
 func (c *Chunk) GetBinaryLength() Offset {
-	return Offset(ChunkHeaderSizeFixed + len(c.DataRaw))
+	c.encode()
+	if c.Keys != nil {
+		return Offset(ChunkHeaderSizeFixed + len(c.stored) + chunkSealOverhead)
+	}
+	return Offset(ChunkHeaderSizeFixed + len(c.stored))
 }
 
 // WriteAt writes the chunk to the writer at the offset.
@@ -59,37 +123,78 @@ func (c *Chunk) WriteAt(w io.WriterAt, off int64) error {
 // ReadAt reads the chunk from the reader at the offset.
 func (c *Chunk) ReadAt(r io.ReaderAt, off, size int64) error {
 	data := make([]byte, size+ChunkHeaderSizeFixed)
-	_, err := r.ReadAt(data, off)
+	n, err := r.ReadAt(data, off)
+	// size is approx, chunk at the tail of vol may be shorter than it.
+	if err == io.EOF && n > 0 {
+		data, err = data[:n], nil
+	}
 	if err != nil {
 		return err
 	}
 	return c.UnmarshalBinary(data)
 }
 
-// Verify verifies the chunk. It returns nil if the chunk is valid.
+// Verify verifies the chunk, and decrypts and decodes DataRaw from the data on disk. It returns nil if the chunk is valid.
 func (c *Chunk) Verify() error {
-	// magic check
-	if c.Header.Magic != MagicChunk {
-		return ErrChunkVerifyFailed
+	if err := c.Header.Verify(); err != nil {
+		return err
 	}
-	// header checksum check
-	if c.Header.HeaderChecksum != c.Header.GenerateHeaderChecksum() {
-		return ErrChunkVerifyFailed
+	if c.stored == nil {
+		c.stored = c.DataRaw
 	}
 	// data length check
-	if len(c.DataRaw) != int(c.Header.DataLength) {
+	if len(c.stored) != int(c.Header.DataLength) {
 		return ErrChunkVerifyFailed
 	}
 	// checksum check data
-	if crc := crc32.ChecksumIEEE(c.DataRaw); crc != c.Header.Checksum {
+	if crc := crc32.ChecksumIEEE(c.stored); crc != c.Header.Checksum {
+		return ErrChunkVerifyFailed
+	}
+	key, err := c.Header.Decrypt(c.Keys)
+	if err != nil {
+		return err
+	}
+	c.key = key
+	if c.Header.KeyID != 0 {
+		stored, err := c.Keys.openData(&c.Header, c.stored)
+		if err != nil {
+			return err
+		}
+		c.stored, c.DataRaw = stored, nil
+	}
+	if c.Header.Codec == CodecNone {
+		c.DataRaw = c.stored
+	} else if c.DataRaw == nil {
+		codec := codecByID(c.Header.Codec)
+		if codec == nil {
+			return fmt.Errorf("%w: unknown codec %d", ErrChunkVerifyFailed, c.Header.Codec)
+		}
+		data, err := codec.Decode(c.stored, int(c.Header.RawLength))
+		if err != nil {
+			return ErrChunkVerifyFailed
+		}
+		c.DataRaw = data
+	}
+	if len(c.DataRaw) != int(c.Header.RawLength) {
 		return ErrChunkVerifyFailed
 	}
 	return nil
 }
 
-// MarshalBinary returns the binary of the chunk.
+// MarshalBinary returns the binary of the chunk, with data compressed if Compress is set, and encrypted if Keys is set.
 func (c *Chunk) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0, ChunkHeaderSizeFixed+len(c.DataRaw)))
+	c.encode()
+	data := c.stored
+	if c.Keys != nil {
+		var err error
+		data, err = c.Keys.seal(&c.Header, c.key, c.stored)
+		if err != nil {
+			return nil, err
+		}
+		c.Header.Checksum = crc32.ChecksumIEEE(data)
+		c.Header.HeaderChecksum = c.Header.GenerateHeaderChecksum()
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, ChunkHeaderSizeFixed+len(data)))
 	b, err := c.Header.MarshalBinary()
 	if err != nil {
 		return nil, err
@@ -97,22 +202,30 @@ func (c *Chunk) MarshalBinary() ([]byte, error) {
 	buf.Write(b)
 	// padding to ChunkHeaderSizeFixed
 	buf.Write(make([]byte, ChunkHeaderSizeFixed-len(b)))
-	buf.Write(c.DataRaw)
+	buf.Write(data)
 	return buf.Bytes(), nil
 }
 
-// UnmarshalBinary unmarshal the binary of the chunk, and verify it.
+// UnmarshalBinary unmarshal the binary of the chunk, verify and decode it.
 // Note: the data must be the whole chunk.
 func (c *Chunk) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	if err := c.Header.UnmarshalBinary(buf.Next(ChunkHeaderSizeFixed)); err != nil {
+	if len(data) < ChunkHeaderSizeFixed {
+		return ErrChunkVerifyFailed
+	}
+	if err := c.Header.UnmarshalBinary(data[:ChunkHeaderSizeFixed]); err != nil {
 		return err
 	}
-	c.DataRaw = buf.Next(int(c.Header.DataLength))
+	// DataLength is read from disk, not trusted before checked
+	if c.Header.DataLength > ChunkDataSize || len(data)-ChunkHeaderSizeFixed < int(c.Header.DataLength) {
+		return ErrChunkVerifyFailed
+	}
+	c.stored = data[ChunkHeaderSizeFixed : ChunkHeaderSizeFixed+int(c.Header.DataLength)]
+	c.DataRaw = nil
 	return c.Verify()
 }
 
 // ChunkHeader is the meta of a chunk.
+// Fields after HeaderChecksum are in the padding of a header of version 0, where they are all 0.
 type ChunkHeader struct {
 	Magic          uint32
 	Checksum       uint32
@@ -120,6 +233,17 @@ type ChunkHeader struct {
 	DataLength     uint32
 	HeaderSize     uint32
 	HeaderChecksum uint32
+
+	Version    uint8 // ChunkHeaderVersion of the header, fields below are 0 in version 0
+	Serial     uint64
+	Codec      uint8  // codec of the data on disk, CodecNone if stored as is
+	RawLength  uint32 // length of the value, DataLength is the length on disk, same in version 0
+	KeyID      uint32 // id of the key encrypting Key and data, 0 if in the clear
+	KeyLength  uint16 // length of the encrypted Key
+	KeyNonce   [ChunkNonceSize]byte
+	DataNonce  [ChunkNonceSize]byte
+	MetaLength uint32
+	Meta       [ChunkMetaMaxSize]byte // raw metadata, see ObjectMeta
 }
 
 // MarshalBinary returns the binary representation of the chunk header.
@@ -134,9 +258,79 @@ func (c *ChunkHeader) MarshalBinary() ([]byte, error) {
 
 // UnmarshalBinary unmarshal the binary representation of the chunk header.
 func (c *ChunkHeader) UnmarshalBinary(data []byte) error {
-	return binary.Read(bytes.NewBuffer(data), binary.BigEndian, c)
+	err := binary.Read(bytes.NewBuffer(data), binary.BigEndian, c)
+	if err != nil {
+		return err
+	}
+	if c.Version == 0 {
+		// padding of a header of 0.1, not covered by its checksum
+		*c = ChunkHeader{
+			Magic:          c.Magic,
+			Checksum:       c.Checksum,
+			Key:            c.Key,
+			DataLength:     c.DataLength,
+			HeaderSize:     c.HeaderSize,
+			HeaderChecksum: c.HeaderChecksum,
+			RawLength:      c.DataLength,
+		}
+	}
+	return nil
+}
+
+// ReadAt reads the chunk header only from the reader at the offset, and verify it.
+// Note: a header cut by the end of reader is reported as ErrChunkVerifyFailed.
+func (c *ChunkHeader) ReadAt(r io.ReaderAt, off int64) error {
+	data := make([]byte, ChunkHeaderSizeFixed)
+	_, err := r.ReadAt(data, off)
+	if err == io.EOF {
+		return ErrChunkVerifyFailed
+	}
+	if err != nil {
+		return err
+	}
+	if err = c.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	return c.Verify()
 }
 
+// Verify verifies magic and checksum of the chunk header.
+func (c *ChunkHeader) Verify() error {
+	if c.Magic != MagicChunk || c.Version > ChunkHeaderVersion {
+		return ErrChunkVerifyFailed
+	}
+	if c.HeaderChecksum != c.GenerateHeaderChecksum() {
+		return ErrChunkVerifyFailed
+	}
+	if c.DataLength > ChunkDataSize || c.RawLength > ChunkDataSize {
+		return ErrChunkVerifyFailed
+	}
+	if c.MetaLength > ChunkMetaMaxSize {
+		return ErrChunkVerifyFailed
+	}
+	return nil
+}
+
+// GetMeta returns the raw metadata.
+func (c *ChunkHeader) GetMeta() []byte {
+	if c.MetaLength > ChunkMetaMaxSize {
+		return nil
+	}
+	return c.Meta[:c.MetaLength]
+}
+
+// GetKey returns the key trimmed by the null character, nil if the key is encrypted, see Decrypt.
+func (c *ChunkHeader) GetKey() []byte {
+	if c.KeyID != 0 {
+		return nil
+	}
+	return bytes.TrimRight(c.Key[:], "\x00")
+}
+
+// GenerateHeaderChecksum returns the checksum of the header, of the fields of its version.
 func (c *ChunkHeader) GenerateHeaderChecksum() uint32 {
-	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v", c.Magic, c.Checksum, c.Key, c.DataLength)))
+	if c.Version == 0 {
+		return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v", c.Magic, c.Checksum, c.Key, c.DataLength)))
+	}
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v", c.Magic, c.Checksum, c.Key, c.DataLength, c.Version, c.Serial, c.Codec, c.RawLength, c.KeyID, c.KeyLength, c.KeyNonce, c.DataNonce, c.MetaLength, crc32.ChecksumIEEE(c.Meta[:]))))
 }
@@ -1,6 +1,10 @@
 package bakemono
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"reflect"
 	"testing"
@@ -180,3 +184,142 @@ func TestMaxChunkHeaderSize(t *testing.T) {
 		t.Fatal("ChunkHeaderSizeFixed is not equal to the calculated sizeInternal")
 	}
 }
+
+// chunkHeaderV0 is the header of chunks written by 0.1.
+type chunkHeaderV0 struct {
+	Magic          uint32
+	Checksum       uint32
+	Key            [ChunkKeyMaxSize]byte
+	DataLength     uint32
+	HeaderSize     uint32
+	HeaderChecksum uint32
+}
+
+func TestChunk_HeaderVersion0(t *testing.T) {
+	data := []byte("value of 0.1")
+	h := chunkHeaderV0{Magic: MagicChunk, Checksum: crc32.ChecksumIEEE(data), DataLength: uint32(len(data)), HeaderSize: ChunkHeaderSizeFixed}
+	copy(h.Key[:], "key")
+	h.HeaderChecksum = crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v", h.Magic, h.Checksum, h.Key, h.DataLength)))
+	buf := bytes.NewBuffer(nil)
+	err := binary.Write(buf, binary.BigEndian, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, ChunkHeaderSizeFixed-buf.Len()))
+	buf.Write(data)
+	raw := buf.Bytes()
+
+	ck := &Chunk{}
+	err = ck.UnmarshalBinary(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, value := ck.GetKeyData()
+	if string(key) != "key" || !bytes.Equal(value, data) || ck.Header.Version != 0 || ck.Header.Serial != 0 {
+		t.Fatalf("chunk of 0.1 decoded as key: %q, value: %q, header: %d/%d", key, value, ck.Header.Version, ck.Header.Serial)
+	}
+
+	// the padding of 0.1 is not covered by its checksum, and ignored
+	raw[ChunkHeaderSizeFixed-1] = 0xff
+	err = (&Chunk{}).UnmarshalBinary(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a header of a newer version is refused
+	raw[binary.Size(&h)] = ChunkHeaderVersion + 1
+	err = (&Chunk{}).UnmarshalBinary(raw)
+	if err != ErrChunkVerifyFailed {
+		t.Fatalf("expect ErrChunkVerifyFailed for an unknown version, got %v", err)
+	}
+}
+
+// fuzzChunkSeeds are chunks in the clear, compressed, and encrypted by fuzzKeyring.
+func fuzzChunkSeeds(f *testing.F, keys *Keyring) [][]byte {
+	var seeds [][]byte
+	for _, ck := range []*Chunk{
+		{},
+		{Compress: &CompressOptions{Codec: FlateCodec{}}},
+		{Compress: &CompressOptions{Codec: GzipCodec{}}, Keys: keys},
+	} {
+		err := ck.Set([]byte("key"), bytes.Repeat([]byte("value,"), 100))
+		if err != nil {
+			f.Fatal(err)
+		}
+		err = ck.SetMeta([]byte{1, 0, 2, 'o', 'k'})
+		if err != nil {
+			f.Fatal(err)
+		}
+		b, err := ck.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+func fuzzKeyring(f *testing.F) *Keyring {
+	keys, err := NewKeyring(&EncryptionOptions{Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, KeyID: 1})
+	if err != nil {
+		f.Fatal(err)
+	}
+	return keys
+}
+
+func FuzzChunkUnmarshalBinary(f *testing.F) {
+	keys := fuzzKeyring(f)
+	for _, b := range fuzzChunkSeeds(f, keys) {
+		f.Add(b, false)
+		f.Add(b, true)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, fix bool) {
+		if fix && len(data) >= ChunkHeaderSizeFixed {
+			// fix up checksums, so the fuzzer gets past them
+			h := &ChunkHeader{}
+			if h.UnmarshalBinary(data[:ChunkHeaderSizeFixed]) == nil {
+				end := ChunkHeaderSizeFixed + int(h.DataLength)
+				if end > len(data) {
+					end = len(data)
+				}
+				h.Checksum = crc32.ChecksumIEEE(data[ChunkHeaderSizeFixed:end])
+				h.HeaderChecksum = h.GenerateHeaderChecksum()
+				raw, err := h.MarshalBinary()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data = append(raw, data[len(raw):]...)
+			}
+		}
+		for _, k := range []*Keyring{nil, keys} {
+			ck := &Chunk{Keys: k}
+			if ck.UnmarshalBinary(data) != nil {
+				continue
+			}
+			if len(ck.DataRaw) != int(ck.Header.RawLength) {
+				t.Fatalf("chunk decoded %d bytes, RawLength %d", len(ck.DataRaw), ck.Header.RawLength)
+			}
+			key, _ := ck.GetKeyData()
+			if len(key) > ChunkKeyMaxSize {
+				t.Fatalf("chunk decoded a key of %d bytes", len(key))
+			}
+		}
+	})
+}
+
+func FuzzChunkHeaderUnmarshalBinary(f *testing.F) {
+	for _, b := range fuzzChunkSeeds(f, fuzzKeyring(f)) {
+		f.Add(b[:ChunkHeaderSizeFixed])
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := &ChunkHeader{}
+		if h.UnmarshalBinary(data) != nil {
+			return
+		}
+		// accessors must not trust lengths from disk
+		_ = h.Verify()
+		_ = h.GetKey()
+		_ = h.GetMeta()
+		_, _ = h.Decrypt(nil)
+		_ = (&ObjectMeta{}).UnmarshalBinary(h.GetMeta())
+	})
+}
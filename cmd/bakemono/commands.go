@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bocchi-the-cache/bakemono"
+)
+
+func runInfo(v *bakemono.Vol, args []string) error {
+	h := v.Header
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "header:\n")
+	fmt.Fprintf(w, "  Magic:\t%#08x\n", h.Magic)
+	fmt.Fprintf(w, "  Version:\t%d.%d\n", h.MajorVersion, h.MinorVersion)
+	fmt.Fprintf(w, "  CreateUnixTime:\t%d (%s)\n", h.CreateUnixTime, time.Unix(h.CreateUnixTime, 0).Format(time.RFC3339))
+	fmt.Fprintf(w, "  WritePos:\t%d\n", h.WritePos)
+	fmt.Fprintf(w, "  SyncSerial:\t%d\n", h.SyncSerial)
+	fmt.Fprintf(w, "  WriteSerial:\t%d\n", h.WriteSerial)
+	fmt.Fprintf(w, "  DirsChecksum:\t%#08x\n", h.DirsChecksum)
+	fmt.Fprintf(w, "  FileSize:\t%d\n", h.FileSize)
+	fmt.Fprintf(w, "  ChunkAvgSize:\t%d\n", h.ChunkAvgSize)
+	fmt.Fprintf(w, "  JournalSize:\t%d\n", h.JournalSize)
+	fmt.Fprintf(w, "  CleanShutdown:\t%v\n", v.CleanShutdown())
+	fmt.Fprintf(w, "  JournalSeq:\t%d\n", h.JournalSeq)
+	fmt.Fprintf(w, "  JournalPos:\t%d\n", h.JournalPos)
+	fmt.Fprintf(w, "  TagIndexSize:\t%d\n", h.TagIndexSize)
+	fmt.Fprintf(w, "  TagIndexPos:\t%d\n", h.TagIndexPos)
+	fmt.Fprintf(w, "  TagIndexLength:\t%d\n", h.TagIndexLength)
+	namespaces := 0
+	for _, g := range h.Namespaces {
+		if g.NameHash != 0 {
+			namespaces++
+		}
+	}
+	fmt.Fprintf(w, "  Namespaces:\t%d\n", namespaces)
+	fmt.Fprintf(w, "offsets:\n")
+	fmt.Fprintf(w, "  Length:\t%d\n", v.Length)
+	fmt.Fprintf(w, "  HeaderAOffset:\t%d\n", v.HeaderAOffset)
+	fmt.Fprintf(w, "  DirChecksumsAOffset:\t%d\n", v.DirChecksumsAOffset)
+	fmt.Fprintf(w, "  DirAOffset:\t%d\n", v.DirAOffset)
+	fmt.Fprintf(w, "  FooterAOffset:\t%d\n", v.FooterAOffset)
+	fmt.Fprintf(w, "  HeaderBOffset:\t%d\n", v.HeaderBOffset)
+	fmt.Fprintf(w, "  DirChecksumsBOffset:\t%d\n", v.DirChecksumsBOffset)
+	fmt.Fprintf(w, "  DirBOffset:\t%d\n", v.DirBOffset)
+	fmt.Fprintf(w, "  FooterBOffset:\t%d\n", v.FooterBOffset)
+	fmt.Fprintf(w, "  JournalOffset:\t%d\n", v.JournalOffset)
+	fmt.Fprintf(w, "  TagIndexOffset:\t%d\n", v.TagIndexOffset)
+	fmt.Fprintf(w, "  DataOffset:\t%d\n", v.DataOffset)
+	fmt.Fprintf(w, "dirs:\n")
+	fmt.Fprintf(w, "  ChunkAvgSize:\t%d\n", v.ChunkAvgSize)
+	fmt.Fprintf(w, "  ChunksMaxNum:\t%d\n", v.ChunksMaxNum)
+	fmt.Fprintf(w, "  SegmentsNum:\t%d\n", v.Dm.SegmentsNum)
+	fmt.Fprintf(w, "  BucketsNumPerSegment:\t%d\n", v.Dm.BucketsNumPerSegment)
+	return w.Flush()
+}
+
+func runGet(v *bakemono.Vol, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expect exactly one key")
+	}
+	hit, data, err := v.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if !hit {
+		return bakemono.ErrCacheMiss
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runPut(v *bakemono.Vol, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("expect a key and an optional value")
+	}
+	var value []byte
+	if len(args) == 2 {
+		value = []byte(args[1])
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		value = data
+	}
+	return v.Set([]byte(args[0]), value)
+}
+
+func runDel(v *bakemono.Vol, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expect exactly one key")
+	}
+	return v.Delete([]byte(args[0]))
+}
+
+func runLs(v *bakemono.Vol, args []string) error {
+	w := bufio.NewWriter(os.Stdout)
+	n, total := 0, 0
+	err := v.Range(context.Background(), func(key []byte, size int, meta *bakemono.ObjectMeta) bool {
+		fmt.Fprintf(w, "%d\t%q\n", size, key)
+		n++
+		total += size
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "keys: %d, bytes: %d\n", n, total)
+	return w.Flush()
+}
+
+func runExport(v *bakemono.Vol, args []string) error {
+	if len(args) > 1 {
+		return errors.New("expect an optional file")
+	}
+	w := os.Stdout
+	if len(args) == 1 {
+		fp, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+	n, err := v.Export(w)
+	if err != nil {
+		return err
+	}
+	if w != os.Stdout {
+		err = w.Sync()
+	}
+	fmt.Fprintf(os.Stderr, "exported: %d\n", n)
+	return err
+}
+
+func runImport(v *bakemono.Vol, args []string) error {
+	if len(args) > 1 {
+		return errors.New("expect an optional file")
+	}
+	r := os.Stdin
+	if len(args) == 1 {
+		fp, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	n, err := v.Import(r)
+	fmt.Fprintf(os.Stderr, "imported: %d\n", n)
+	return err
+}
+
+func runStats(v *bakemono.Vol, args []string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "segment\tdirs\tused\tfree\tbuckets used\tusage\t\n")
+	var total bakemono.SegmentStat
+	for _, st := range v.Dm.Stats() {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\t%.2f%%\t\n", st.Id, st.Dirs, st.UsedDirs, st.FreeDirs, st.UsedBuckets, percent(st.UsedDirs, st.Dirs))
+		total.Dirs += st.Dirs
+		total.UsedDirs += st.UsedDirs
+		total.FreeDirs += st.FreeDirs
+		total.UsedBuckets += st.UsedBuckets
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t%d\t%d\t%.2f%%\t\n", total.Dirs, total.UsedDirs, total.FreeDirs, total.UsedBuckets, percent(total.UsedDirs, total.Dirs))
+	return w.Flush()
+}
+
+func runDumpDirs(v *bakemono.Vol, args []string) error {
+	_, err := io.WriteString(os.Stdout, v.Dm.DiagDumpAllDirsToString())
+	return err
+}
+
+func percent(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) * 100 / float64(b)
+}
+
+var fsckRepair bool
+
+func fsckFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&fsckRepair, "repair", false, "drop bad dirs, relink broken segments and flush meta")
+}
+
+func runFsck(v *bakemono.Vol, args []string) error {
+	r, err := v.Check(context.Background(), fsckRepair)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Problems {
+		fmt.Println(p)
+	}
+	if r.ProblemsNum > len(r.Problems) {
+		fmt.Printf("... %d more problems\n", r.ProblemsNum-len(r.Problems))
+	}
+	fmt.Printf("used dirs: %d, bad dirs: %d, bad segments: %d, problems: %d, repaired: %v\n",
+		r.UsedDirs, r.BadDirs, r.BadSegments, r.ProblemsNum, r.Repaired)
+	if !r.OK() && !r.Repaired {
+		return fmt.Errorf("%d problems found", r.ProblemsNum)
+	}
+	return nil
+}
+
+var recoverBudget time.Duration
+
+func recoverFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&recoverBudget, "budget", 0, "stop scanning after this duration, 0 means no limit")
+}
+
+func runRecover(v *bakemono.Vol, args []string) error {
+	p, err := v.RecoverFromData(context.Background(), &bakemono.RecoverOptions{
+		Budget:    recoverBudget,
+		ResetDirs: true,
+		Progress: func(p bakemono.RecoverProgress) {
+			fmt.Fprintf(os.Stderr, "scanned %d/%d bytes (%.2f%%), chunks: %d, elapsed: %s\n",
+				p.ScannedBytes, p.TotalBytes, percent(int(p.ScannedBytes), int(p.TotalBytes)), p.Chunks, p.Elapsed.Round(time.Millisecond))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("chunks: %d, linked: %d, done: %v, write pos: %d\n", p.Chunks, p.Linked, p.Done, v.WritePos)
+	return nil
+}
+
+var resizeSize, resizeChunkSize, resizeJournalSize, resizeTagIndexSize uint64
+
+func resizeFlags(fs *flag.FlagSet) {
+	fs.Uint64Var(&resizeSize, "new-size", 0, "new file size, 0 keeps it")
+	fs.Uint64Var(&resizeChunkSize, "new-chunk-size", 0, "new average chunk size, 0 keeps it")
+	fs.Uint64Var(&resizeJournalSize, "new-journal-size", 0, "new journal size, 0 keeps it")
+	fs.Uint64Var(&resizeTagIndexSize, "new-tag-index-size", 0, "new tag index size, 0 keeps it")
+}
+
+func runResize(v *bakemono.Vol, args []string) error {
+	cfg := &bakemono.VolOptions{
+		FileSize:     v.Length,
+		ChunkAvgSize: v.ChunkAvgSize,
+		JournalSize:  v.JournalSize,
+		TagIndexSize: v.TagIndexSize,
+	}
+	if resizeSize != 0 {
+		cfg.FileSize = bakemono.Offset(resizeSize)
+	}
+	if resizeChunkSize != 0 {
+		cfg.ChunkAvgSize = bakemono.Offset(resizeChunkSize)
+	}
+	if resizeJournalSize != 0 {
+		cfg.JournalSize = bakemono.Offset(resizeJournalSize)
+	}
+	if resizeTagIndexSize != 0 {
+		cfg.TagIndexSize = bakemono.Offset(resizeTagIndexSize)
+	}
+	st, err := v.Resize(cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("kept: %d, moved: %d, dropped: %d, size: %d\n", st.Kept, st.Moved, st.Dropped, v.Length)
+	return nil
+}
@@ -0,0 +1,200 @@
+// Command bakemono inspects and edits a bakemono volume file.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/bocchi-the-cache/bakemono"
+)
+
+// set by -ldflags, see Makefile
+var (
+	Version  = "dev"
+	Revision = "unknown"
+	Time     = "unknown"
+)
+
+// command is a sub command of bakemono.
+type command struct {
+	args  string
+	desc  string
+	write bool // open vol read-write
+	run   func(v *bakemono.Vol, args []string) error
+
+	// flags registers command specific flags. writeFlag opens vol read-write when set.
+	flags     func(fs *flag.FlagSet)
+	writeFlag *bool
+
+	// rebuild commands are allowed to write a corrupted vol without -force
+	rebuild bool
+}
+
+var commands = map[string]*command{
+	"info":      {args: "<vol>", desc: "print header, offsets and dirs layout", run: runInfo},
+	"get":       {args: "<vol> <key>", desc: "write the value of a key to stdout", run: runGet},
+	"put":       {args: "<vol> <key> [value]", desc: "set a key, read value from stdin if omitted", write: true, run: runPut},
+	"del":       {args: "<vol> <key>", desc: "delete a key", write: true, run: runDel},
+	"ls":        {args: "<vol>", desc: "list live keys with their sizes", run: runLs},
+	"stats":     {args: "<vol>", desc: "print dirs occupancy per segment", run: runStats},
+	"dump-dirs": {args: "<vol>", desc: "dump all dirs", run: runDumpDirs},
+	"export":    {args: "<vol> [file]", desc: "export live keys to file, stdout if omitted", run: runExport},
+	"import":    {args: "<vol> [file]", desc: "import keys exported by export, stdin if omitted", write: true, run: runImport},
+	"fsck":      {args: "<vol>", desc: "verify meta, dirs and chunks, -repair drops bad dirs", run: runFsck, flags: fsckFlags, writeFlag: &fsckRepair},
+	"resize":    {args: "<vol>", desc: "change size or layout of the vol, keeping live chunks", write: true, run: runResize, flags: resizeFlags},
+	"recover":   {args: "<vol>", desc: "rebuild dirs by scanning chunks in data region", write: true, rebuild: true, run: runRecover, flags: recoverFlags},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: bakemono <command> [flags] <vol> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %-22s %s\n", name, commands[name].args, commands[name].desc)
+	}
+	fmt.Fprintf(w, "  %-10s %-22s %s\n", "version", "", "print version")
+	fmt.Fprintf(w, "\nrun 'bakemono <command> -h' for flags.\n")
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	if name == "version" {
+		fmt.Printf("bakemono %s, revision: %s, built at: %s\n", Version, Revision, Time)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	err := runCommand(name, cmd, flag.Args()[1:])
+	if errors.Is(err, bakemono.ErrCacheMiss) {
+		fmt.Fprintln(os.Stderr, "miss")
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bakemono %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func runCommand(name string, cmd *command, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	chunkSize := fs.Uint64("chunk-size", 0, "average chunk size the vol was created with, read from header if 0, 1MB if not found")
+	journalSize := fs.Uint64("journal-size", 0, "journal size the vol was created with, read from header if 0")
+	tagIndexSize := fs.Uint64("tag-index-size", 0, "tag index size the vol was created with, read from header if 0")
+	verbose := fs.Bool("v", false, "print engine logs to stderr")
+	force := fs.Bool("force", false, "write even if vol metadata is corrupted, this resets the index")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bakemono %s [flags] %s\n", name, cmd.args)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	write := cmd.write || (cmd.writeFlag != nil && *cmd.writeFlag)
+	// open read-only first, a vol opened read-write is flushed on close
+	v, corrupted, err := openVol(fs.Arg(0), *chunkSize, *journalSize, *tagIndexSize, true)
+	if err != nil {
+		return err
+	}
+	if corrupted && write && !*force && !cmd.rebuild {
+		_ = v.Close()
+		return errors.New("vol metadata is corrupted, use -force to reset it")
+	}
+	if write {
+		_ = v.Close()
+		v, corrupted, err = openVol(fs.Arg(0), *chunkSize, *journalSize, *tagIndexSize, false)
+		if err != nil {
+			return err
+		}
+	}
+	if corrupted {
+		fmt.Fprintln(os.Stderr, "warning: vol metadata is corrupted, index is empty")
+	}
+
+	// metadata is flushed by Close
+	err = cmd.run(v, fs.Args()[1:])
+	if closeErr := v.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// openVol opens an existing vol file. Size of the vol is the size of the file.
+func openVol(path string, chunkSize, journalSize, tagIndexSize uint64, readOnly bool) (*bakemono.Vol, bool, error) {
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(path, mode, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return nil, false, err
+	}
+
+	// layout flags left 0 are read from the header
+	if h, err := bakemono.ReadVolHeader(fp); err == nil && h.FileSize != 0 {
+		if chunkSize == 0 {
+			chunkSize = uint64(h.ChunkAvgSize)
+		}
+		if journalSize == 0 {
+			journalSize = uint64(h.JournalSize)
+		}
+		if tagIndexSize == 0 {
+			tagIndexSize = uint64(h.TagIndexSize)
+		}
+	}
+	if chunkSize == 0 {
+		chunkSize = 1024 * 1024
+	}
+
+	v := &bakemono.Vol{Path: path}
+	corrupted, err := v.Init(&bakemono.VolOptions{
+		Fp:                fp,
+		FileSize:          bakemono.Offset(st.Size()),
+		ChunkAvgSize:      bakemono.Offset(chunkSize),
+		JournalSize:       bakemono.Offset(journalSize),
+		TagIndexSize:      bakemono.Offset(tagIndexSize),
+		FlushMetaInterval: 60 * time.Second,
+		ReadOnly:          readOnly,
+	})
+	if err != nil {
+		_ = fp.Close()
+		return nil, false, err
+	}
+	return v, corrupted, nil
+}
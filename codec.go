@@ -0,0 +1,170 @@
+package bakemono
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec compresses chunk data. Its ID is recorded in the chunk header,
+// so a chunk is decoded by the codec registered with that ID, whatever the vol is writing with now.
+type Codec interface {
+	// ID is stored in chunk headers, CodecNone is reserved.
+	ID() uint8
+	Encode(src []byte) ([]byte, error)
+	// Decode returns exactly rawLength bytes, or an error.
+	Decode(src []byte, rawLength int) ([]byte, error)
+}
+
+const (
+	CodecNone  = 0
+	CodecFlate = 1
+	CodecGzip  = 2
+)
+
+// CompressOptions enables compression of chunk data.
+type CompressOptions struct {
+	Codec Codec
+
+	// MinSaving is the fraction of the value compression must save, or the value is stored as is.
+	// 0.1 keeps compressed data at most 90% of the value, 0 keeps it if smaller at all.
+	MinSaving float64
+}
+
+// Check checks if the CompressOptions is valid.
+func (o *CompressOptions) Check() error {
+	if o.Codec == nil {
+		return errors.New("compress: no codec")
+	}
+	if o.Codec.ID() == CodecNone {
+		return fmt.Errorf("compress: codec id %d is reserved", CodecNone)
+	}
+	if codecByID(o.Codec.ID()) == nil {
+		return fmt.Errorf("compress: codec %d not registered, see RegisterCodec", o.Codec.ID())
+	}
+	if o.MinSaving < 0 || o.MinSaving >= 1 {
+		return fmt.Errorf("compress: MinSaving %v out of [0, 1)", o.MinSaving)
+	}
+	return nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[uint8]Codec{}
+)
+
+// RegisterCodec makes chunks of c.ID() readable. It panics if the id is reserved or taken.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c.ID() == CodecNone {
+		panic(fmt.Sprintf("codec id %d is reserved", CodecNone))
+	}
+	if _, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("codec id %d registered twice", c.ID()))
+	}
+	codecs[c.ID()] = c
+}
+
+func codecByID(id uint8) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[id]
+}
+
+func init() {
+	RegisterCodec(FlateCodec{})
+	RegisterCodec(GzipCodec{})
+}
+
+// FlateCodec compresses with compress/flate. Level 0 means flate.DefaultCompression.
+type FlateCodec struct {
+	Level int
+}
+
+func (FlateCodec) ID() uint8 {
+	return CodecFlate
+}
+
+func (c FlateCodec) Encode(src []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := flate.NewWriter(buf, compressLevel(c.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finishEncode(buf, w, src)
+}
+
+func (FlateCodec) Decode(src []byte, rawLength int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readDecoded(r, rawLength)
+}
+
+// GzipCodec compresses with compress/gzip. Level 0 means gzip.DefaultCompression.
+type GzipCodec struct {
+	Level int
+}
+
+func (GzipCodec) ID() uint8 {
+	return CodecGzip
+}
+
+func (c GzipCodec) Encode(src []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, compressLevel(c.Level))
+	if err != nil {
+		return nil, err
+	}
+	return finishEncode(buf, w, src)
+}
+
+func (GzipCodec) Decode(src []byte, rawLength int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecoded(r, rawLength)
+}
+
+func compressLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+func finishEncode(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	_, err := w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readDecoded reads exactly rawLength bytes from r, never more, so a crafted chunk can not inflate without bound.
+func readDecoded(r io.Reader, rawLength int) ([]byte, error) {
+	if rawLength < 0 || rawLength > ChunkDataSize {
+		return nil, ErrChunkVerifyFailed
+	}
+	data := make([]byte, rawLength)
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, ErrChunkVerifyFailed
+	}
+	// the stream must end here
+	n, _ := r.Read(make([]byte, 1))
+	if n != 0 {
+		return nil, ErrChunkVerifyFailed
+	}
+	return data, nil
+}
@@ -0,0 +1,119 @@
+package bakemono
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bocchi","band":"kessoku"},`), 1000)
+	for _, c := range []Codec{FlateCodec{}, GzipCodec{Level: 9}} {
+		enc, err := c.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(enc) >= len(value) {
+			t.Fatalf("codec %d should compress json", c.ID())
+		}
+		dec, err := c.Decode(enc, len(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec, value) {
+			t.Fatalf("codec %d round trip mismatch", c.ID())
+		}
+		// a wrong length is refused, never decoded past it
+		_, err = c.Decode(enc, len(value)-1)
+		if err == nil {
+			t.Fatalf("codec %d should refuse a shorter raw length", c.ID())
+		}
+		_, err = c.Decode(enc, len(value)+1)
+		if err == nil {
+			t.Fatalf("codec %d should refuse a longer raw length", c.ID())
+		}
+	}
+}
+
+func TestChunkCompress(t *testing.T) {
+	value := bytes.Repeat([]byte("<html><body>bakemono</body></html>"), 1000)
+	ck := &Chunk{Compress: &CompressOptions{Codec: FlateCodec{}, MinSaving: 0.5}}
+	err := ck.Set([]byte("key"), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ck.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ck.Header.Codec != CodecFlate || Offset(len(b)) != ck.GetBinaryLength() || len(b) >= ChunkHeaderSizeFixed+len(value) {
+		t.Fatalf("chunk should be compressed, codec: %d, len: %d", ck.Header.Codec, len(b))
+	}
+	ck2 := &Chunk{}
+	err = ck2.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ck2.DataRaw, value) || ck2.Header.RawLength != uint32(len(value)) {
+		t.Fatal("decoded value mismatch")
+	}
+
+	// random bytes do not save MinSaving, stored as is
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	ck = &Chunk{Compress: &CompressOptions{Codec: GzipCodec{}, MinSaving: 0.1}}
+	err = ck.Set([]byte("key"), random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ck.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ck.Header.Codec != CodecNone || len(b) != ChunkHeaderSizeFixed+len(random) {
+		t.Fatalf("incompressible chunk should be stored as is, codec: %d", ck.Header.Codec)
+	}
+}
+
+func TestVolCompress(t *testing.T) {
+	path := "/tmp/bakemono-test-compress.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*16, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Compress = &CompressOptions{Codec: GzipCodec{}, MinSaving: 0.2}
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"ok":true},`, i)), 2000)
+	}
+	for i := 0; i < 20; i++ {
+		err := v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), value(i), &ObjectMeta{ContentType: "application/json"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		hit, data, err := v.Get(key)
+		if err != nil || !hit || !bytes.Equal(data, value(i)) {
+			t.Fatalf("key-%d should hit with the value, hit: %v, err: %v", i, hit, err)
+		}
+		hit, info, err := v.Stat(key)
+		if err != nil || !hit || info.Size != len(value(i)) {
+			t.Fatalf("stat of key-%d should report the value size, size: %d, err: %v", i, info.Size, err)
+		}
+		_, _, d := v.Dm.Get(key)
+		if d.approxSize() >= uint64(ChunkHeaderSizeFixed+len(value(i))) {
+			t.Fatalf("dir of key-%d should be sized by the compressed chunk, got %d", i, d.approxSize())
+		}
+	}
+}
@@ -4,4 +4,7 @@ type EngineConfig struct {
 	Path        string
 	SizeMb      uint32
 	SliceSizeKb uint32
+
+	// TagIndexSizeKb reserves a region for surrogate tags, 0 disables PurgeTag.
+	TagIndexSizeKb uint32
 }
@@ -2,7 +2,7 @@ package bakemono
 
 const (
 	MajorVersion = 0
-	MinorVersion = 1
+	MinorVersion = 2
 )
 
 const (
@@ -21,11 +21,18 @@ const (
 const (
 	ChunkHeaderSizeFixed = 8 * 1 << 10 // 8KB
 	ChunkKeyMaxSize      = 3000
+	ChunkMetaMaxSize     = 4096
 	ChunkDataSize        = 1 * 1 << 20 // 1MB
+
+	// ChunkHeaderVersion is the version of chunk headers written, 0 is the header of 0.1.
+	ChunkHeaderVersion = 1
 )
 
 const BlockSize = 1 << 12
 
+// VolHeaderSizeFixed is the space reserved for every header/footer copy of a vol.
+const VolHeaderSizeFixed = BlockSize // 4KB
+
 // Vol constants
 const (
 	MagicBocchi = 0x000b0cc1
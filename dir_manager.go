@@ -1,7 +1,7 @@
 package bakemono
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"errors"
@@ -18,26 +18,33 @@ type DirManager struct {
 	BucketsNum           Offset
 	BucketsNumPerSegment Offset
 
-	// map segment id to dirs
-	Dirs         map[segId][]*Dir
-	DirFreeStart map[segId]uint16
+	// indexed by segment id. note: slices, segments are modified concurrently.
+	Dirs         [][]*Dir
+	DirFreeStart []uint16
 
 	// rw mutex for each segment
-	SegMutexes map[segId]*sync.RWMutex
+	SegMutexes []*sync.RWMutex
+
+	// segDirty marks segments modified since last flush, guarded by segment mutex.
+	segDirty []bool
+
+	// journal records mutations under segment mutex, nil means disabled.
+	journal *journal
 }
 
 // Init initializes the dir manager. Dirs will Initialized as empty by default.
 func (dm *DirManager) Init(dirNum Offset) Offset {
-	dm.Dirs = make(map[segId][]*Dir)
-	dm.DirFreeStart = make(map[segId]uint16)
-	dm.SegMutexes = make(map[segId]*sync.RWMutex)
-
 	dm.BucketsNum = dirNum / DirDepth
 	dm.SegmentsNum = (dm.BucketsNum + MaxBucketsPerSegment - 1) / MaxBucketsPerSegment
 	dm.BucketsNumPerSegment = (dm.BucketsNum + dm.SegmentsNum - 1) / dm.SegmentsNum
 
 	dm.ChunksNum = dm.BucketsNumPerSegment * DirDepth * dm.SegmentsNum
 
+	dm.Dirs = make([][]*Dir, dm.SegmentsNum)
+	dm.DirFreeStart = make([]uint16, dm.SegmentsNum)
+	dm.SegMutexes = make([]*sync.RWMutex, dm.SegmentsNum)
+	dm.segDirty = make([]bool, dm.SegmentsNum)
+
 	for i := 0; i < int(dm.SegmentsNum); i++ {
 		dm.SegMutexes[segId(i)] = &sync.RWMutex{}
 	}
@@ -52,26 +59,31 @@ func (dm *DirManager) Init(dirNum Offset) Offset {
 // InitEmptyDirs initializes all dirs as empty, make chain.
 func (dm *DirManager) InitEmptyDirs() {
 	for seg := 0; seg < int(dm.SegmentsNum); seg++ {
-		ChunkNumPerSegment := dm.BucketsNumPerSegment * DirDepth
-		dirs := make([]*Dir, ChunkNumPerSegment)
+		dm.initEmptySegment(segId(seg))
+	}
+}
 
-		// first free chunk for conclusion
-		dm.DirFreeStart[segId(seg)] = 1
+// initEmptySegment initializes all dirs in a segment as empty, make chain.
+func (dm *DirManager) initEmptySegment(segmentId segId) {
+	ChunkNumPerSegment := dm.BucketsNumPerSegment * DirDepth
+	dirs := make([]*Dir, ChunkNumPerSegment)
 
-		// init all dirs as empty
-		for i := 0; i < len(dirs); i++ {
-			dirs[i] = &Dir{}
-		}
+	// first free chunk for conclusion
+	dm.DirFreeStart[segmentId] = 1
 
-		// link dirs with next chain
-		err := linkEmptyDirs(dirs)
-		if err != nil {
-			// should not happen
-			log.Fatal(err)
-		}
+	// init all dirs as empty
+	for i := 0; i < len(dirs); i++ {
+		dirs[i] = &Dir{}
+	}
 
-		dm.Dirs[segId(seg)] = dirs
+	// link dirs with next chain
+	err := linkEmptyDirs(dirs)
+	if err != nil {
+		// should not happen
+		log.Fatal(err)
 	}
+
+	dm.Dirs[segmentId] = dirs
 }
 
 func linkEmptyDirs(dirs []*Dir) error {
@@ -144,10 +156,20 @@ func freeChainDelete(dirs []*Dir, dirOffset Offset) (isFirst bool, freeListHead
 // HIT: the offset of the dir entry with the given key,
 // MISS: the offset of last dir entry in the bucket
 func (dm *DirManager) Get(key []byte) (hit bool, dirOffset Offset, d Dir) {
+	hit, dirOffset, d, _ = dm.GetContext(context.Background(), key)
+	return hit, dirOffset, d
+}
+
+// GetContext is Get, but gives up waiting for the segment lock once ctx is done.
+func (dm *DirManager) GetContext(ctx context.Context, key []byte) (hit bool, dirOffset Offset, d Dir, err error) {
 	keyInt12, segmentId, bucketId := calcDirHashPosition(key, dm.SegmentsNum, dm.BucketsNumPerSegment)
 
-	dm.SegMutexes[segmentId].RLock()
-	defer dm.SegMutexes[segmentId].RUnlock()
+	mu := dm.SegMutexes[segmentId]
+	err = lockContext(ctx, mu.TryRLock, mu.RLock)
+	if err != nil {
+		return false, 0, d, err
+	}
+	defer mu.RUnlock()
 
 	return dirProbe(keyInt12, bucketId, dm.Dirs[segmentId])
 }
@@ -164,51 +186,63 @@ func calcDirHashPosition(key []byte, SegmentsNum, BucketsNumPerSegment Offset) (
 	return keyInt12, segmentId, bucketId
 }
 
-func dirProbe(key uint16, bucketId Offset, dirs []*Dir) (hit bool, dirOffset Offset, d Dir) {
+// dirProbe walks the chain of a bucket for key. A chain linking out of dirs, or longer than dirs, is broken,
+// ErrDirChainBroken is returned instead of looping on it.
+func dirProbe(key uint16, bucketId Offset, dirs []*Dir) (hit bool, dirOffset Offset, d Dir, err error) {
 	index := bucketId * DirDepth
-	counter := 0
 
 	// do...while
-	for index != 0 || counter == 0 {
-		counter++
-		if counter > 10000 {
-			log.Printf("dirProbe: counter: %d, index: %d", counter, index)
-			panic("dirProbe: counter>10000")
+	for counter := 0; index != 0 || counter == 0; counter++ {
+		if index >= Offset(len(dirs)) || counter >= len(dirs) {
+			log.Printf("error: dirProbe: broken chain of bucket %d, index: %d, counter: %d", bucketId, index, counter)
+			return false, 0, d, ErrDirChainBroken
 		}
 		if dirs[index].offset() == 0 {
-			return false, index, d
+			return false, index, d, nil
 		}
 		dirKey := dirs[index].tag()
 		if dirKey == key {
-			return true, index, *dirs[index]
+			return true, index, *dirs[index], nil
 		}
 		index = Offset(dirs[index].next())
 	}
 
-	return false, index, d
+	return false, index, d, nil
 }
 
 func (dm *DirManager) Set(key []byte, off Offset, size int) (dirOffset Offset, err error) {
+	return dm.SetContext(context.Background(), key, off, size)
+}
+
+// SetContext is Set, but gives up waiting for the segment lock once ctx is done.
+func (dm *DirManager) SetContext(ctx context.Context, key []byte, off Offset, size int) (dirOffset Offset, err error) {
 	keyInt12, segmentId, bucketId := calcDirHashPosition(key, dm.SegmentsNum, dm.BucketsNumPerSegment)
 
-	dir := Dir{}
-	dir.setOffset(uint64(off))
-	dir.setApproxSize(uint64(size))
-	dir.setHead(true)
-	dir.setTag(keyInt12)
+	dir := newDir(keyInt12, off, size)
 
-	dm.SegMutexes[segmentId].Lock()
-	defer dm.SegMutexes[segmentId].Unlock()
+	mu := dm.SegMutexes[segmentId]
+	err = lockContext(ctx, mu.TryLock, mu.Lock)
+	if err != nil {
+		return 0, err
+	}
+	defer mu.Unlock()
 
 	offset, err := dm.dirInsert(keyInt12, segmentId, bucketId, dir)
 	if err != nil {
 		return offset, err
 	}
+	if dm.journal != nil {
+		dm.journal.append(journalRecord{Type: journalSet, Tag: keyInt12, Segment: uint32(segmentId), Bucket: uint32(bucketId), Offset: uint64(off), Size: uint32(size)})
+	}
 	return dm.BucketsNumPerSegment*DirDepth*Offset(segmentId) + offset, nil
 }
 
 func (dm *DirManager) dirInsert(key uint16, segmentId segId, bucketId Offset, dir Dir) (dirOffset Offset, err error) {
-	hit, dirOffset, dOld := dirProbe(key, bucketId, dm.Dirs[segmentId])
+	hit, dirOffset, dOld, err := dirProbe(key, bucketId, dm.Dirs[segmentId])
+	if err != nil {
+		return 0, err
+	}
+	dm.segDirty[segmentId] = true
 	if hit {
 		// Note: set manually is dangerous, need to keep the next chain
 		dOld.setOffset(dir.offset())
@@ -251,6 +285,125 @@ func (dm *DirManager) dirInsert(key uint16, segmentId segId, bucketId Offset, di
 	return freeDirOffset, nil
 }
 
+// MultiGet gets dirs of keys in a batch, each segment lock is taken once.
+func (dm *DirManager) MultiGet(keys [][]byte) (hits []bool, dirs []Dir) {
+	hits = make([]bool, len(keys))
+	dirs = make([]Dir, len(keys))
+	tags := make([]uint16, len(keys))
+	buckets := make([]Offset, len(keys))
+	bySegment := make(map[segId][]int)
+	for i, key := range keys {
+		var seg segId
+		tags[i], seg, buckets[i] = calcDirHashPosition(key, dm.SegmentsNum, dm.BucketsNumPerSegment)
+		bySegment[seg] = append(bySegment[seg], i)
+	}
+	for seg, indexes := range bySegment {
+		dm.SegMutexes[seg].RLock()
+		for _, i := range indexes {
+			// a broken chain is a miss
+			hits[i], _, dirs[i], _ = dirProbe(tags[i], buckets[i], dm.Dirs[seg])
+		}
+		dm.SegMutexes[seg].RUnlock()
+	}
+	return hits, dirs
+}
+
+// MultiSet sets dirs of keys in a batch, each segment lock is taken once.
+// Keys of a segment are set in the given order, so the last one wins for duplicated keys.
+func (dm *DirManager) MultiSet(keys [][]byte, offs []Offset, sizes []int) error {
+	tags := make([]uint16, len(keys))
+	buckets := make([]Offset, len(keys))
+	bySegment := make(map[segId][]int)
+	var segs []segId
+	for i, key := range keys {
+		var seg segId
+		tags[i], seg, buckets[i] = calcDirHashPosition(key, dm.SegmentsNum, dm.BucketsNumPerSegment)
+		if _, ok := bySegment[seg]; !ok {
+			segs = append(segs, seg)
+		}
+		bySegment[seg] = append(bySegment[seg], i)
+	}
+	for _, seg := range segs {
+		dm.SegMutexes[seg].Lock()
+		for _, i := range bySegment[seg] {
+			_, err := dm.dirInsert(tags[i], seg, buckets[i], newDir(tags[i], offs[i], sizes[i]))
+			if err != nil {
+				dm.SegMutexes[seg].Unlock()
+				return err
+			}
+			if dm.journal != nil {
+				dm.journal.append(journalRecord{Type: journalSet, Tag: tags[i], Segment: uint32(seg), Bucket: uint32(buckets[i]), Offset: uint64(offs[i]), Size: uint32(sizes[i])})
+			}
+		}
+		dm.SegMutexes[seg].Unlock()
+	}
+	return nil
+}
+
+// Delete removes the dir entry with the given key, and returns it to the free chain.
+// Returns false if the key is not found.
+func (dm *DirManager) Delete(key []byte) bool {
+	keyInt12, segmentId, bucketId := calcDirHashPosition(key, dm.SegmentsNum, dm.BucketsNumPerSegment)
+
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
+
+	hit, dirOffset, _, err := dirProbe(keyInt12, bucketId, dm.Dirs[segmentId])
+	if err != nil || !hit {
+		return false
+	}
+	return dm.dirDelete(segmentId, bucketId, dirOffset) == nil
+}
+
+// dirDelete unlinks a used dir from the chain of its bucket.
+// The bucket head is never put in free chain, so its successor is moved into the head instead.
+// A dir not linked in the chain, or a chain linking out of dirs, is left as is, ErrDirChainBroken is returned.
+func (dm *DirManager) dirDelete(segmentId segId, bucketId Offset, dirOffset Offset) error {
+	dirs := dm.Dirs[segmentId]
+	head := bucketId * DirDepth
+	prev := head
+	if dirOffset != head {
+		for counter := 0; Offset(dirs[prev].next()) != dirOffset; counter++ {
+			prev = Offset(dirs[prev].next())
+			if prev == 0 || prev >= Offset(len(dirs)) || counter >= len(dirs) {
+				log.Printf("error: dirDelete: dir %d is not linked in bucket %d", dirOffset, bucketId)
+				return ErrDirChainBroken
+			}
+		}
+	}
+
+	dm.segDirty[segmentId] = true
+	if dm.journal != nil {
+		d := dirs[dirOffset]
+		dm.journal.append(journalRecord{Type: journalDelete, Tag: d.tag(), Segment: uint32(segmentId), Bucket: uint32(bucketId), Offset: d.offset()})
+	}
+	if dirOffset == head {
+		next := Offset(dirs[head].next())
+		if next == 0 {
+			dirs[head].clear()
+			return nil
+		}
+		*dirs[head] = *dirs[next]
+		dm.freeChainPush(segmentId, next)
+		return nil
+	}
+	dirs[prev].setNext(dirs[dirOffset].next())
+	dm.freeChainPush(segmentId, dirOffset)
+	return nil
+}
+
+// freeChainPush clears a dir and puts it at the head of the free chain.
+func (dm *DirManager) freeChainPush(segmentId segId, dirOffset Offset) {
+	dirs := dm.Dirs[segmentId]
+	first := dm.DirFreeStart[segmentId]
+	dirs[dirOffset].clear()
+	dirs[dirOffset].setNext(first)
+	if first != 0 {
+		dirs[first].setPrev(uint16(dirOffset))
+	}
+	dm.DirFreeStart[segmentId] = uint16(dirOffset)
+}
+
 func (dm *DirManager) getFreeDir(segmentId segId, bucketId Offset) (isSameBucket bool, freeDirOffset Offset) {
 	index := bucketId * DirDepth
 	// head of bucket
@@ -337,10 +490,37 @@ func (dm *DirManager) freeChainRebuild(segmentId segId) Offset {
 // purgeRandom10 purges 10% dirs in the segment randomly.
 // if bucketsNumPerSegment < 10, purge all dirs
 func (dm *DirManager) purgeRandom10(segmentId segId, whileListBucketId Offset) Offset {
-	randomIndex := rand.Intn(10)
+	return dm.purgeBucketsJournaled(segmentId, whileListBucketId, 10, Offset(rand.Intn(10)))
+}
+
+// purgeRandom33 purges 33% dirs in the segment randomly.
+// if bucketsNumPerSegment < 3, purge all dirs
+func (dm *DirManager) purgeRandom33(segmentId segId, whileListBucketId Offset) Offset {
+	return dm.purgeBucketsJournaled(segmentId, whileListBucketId, 3, Offset(rand.Intn(3)))
+}
+
+// purgeRandom100 purges 100% dirs in the segment randomly.
+// if bucketsNumPerSegment < 3, purge all dirs
+func (dm *DirManager) purgeRandom100(segmentId segId, whileListBucketId Offset) Offset {
+	return dm.purgeBucketsJournaled(segmentId, whileListBucketId, 1, 0)
+}
+
+// purgeBucketsJournaled purges buckets, and records the purge in journal.
+// Random index is recorded, so replay purges the same buckets.
+func (dm *DirManager) purgeBucketsJournaled(segmentId segId, whileListBucketId, mod, index Offset) Offset {
+	if dm.journal != nil {
+		dm.journal.append(journalRecord{Type: journalEvict, Tag: uint16(index), Segment: uint32(segmentId), Bucket: uint32(whileListBucketId), Size: uint32(mod)})
+	}
+	return dm.purgeBuckets(segmentId, whileListBucketId, mod, index)
+}
+
+// purgeBuckets purges the whole buckets whose id%mod == index, except the white list bucket.
+// if bucketsNumPerSegment <= mod, purge all buckets
+func (dm *DirManager) purgeBuckets(segmentId segId, whileListBucketId, mod, index Offset) Offset {
+	dm.segDirty[segmentId] = true
 	counter := 0
 	for i := Offset(0); i < dm.BucketsNumPerSegment; i++ {
-		if (dm.BucketsNumPerSegment > 10) && (i%10 != Offset(randomIndex)) {
+		if (dm.BucketsNumPerSegment > mod) && (i%mod != index) {
 			continue
 		}
 		if i == whileListBucketId {
@@ -364,105 +544,236 @@ func (dm *DirManager) purgeRandom10(segmentId segId, whileListBucketId Offset) O
 	return Offset(counter)
 }
 
-// purgeRandom33 purges 33% dirs in the segment randomly.
-// if bucketsNumPerSegment < 3, purge all dirs
-func (dm *DirManager) purgeRandom33(segmentId segId, whileListBucketId Offset) Offset {
-	randomIndex := rand.Intn(3)
-	counter := 0
-	for i := Offset(0); i < dm.BucketsNumPerSegment; i++ {
-		if (dm.BucketsNumPerSegment > 3) && (i%3 != Offset(randomIndex)) {
-			continue
-		}
-		if i == whileListBucketId {
-			continue
-		}
-		// purge whole bucket
-		index := Offset(i) * DirDepth
-		c := 0 // do while
-		for index != 0 || c == 0 {
-			counter++
-			c++
+// dirEntry is a copy of a dir and its offset in segment.
+type dirEntry struct {
+	offset Offset
+	d      Dir
+}
 
-			next := Offset(dm.Dirs[segmentId][index].next())
-			dm.Dirs[segmentId][index].clear()
-			index = next
+// usedDirs returns copies of all used dirs in a segment.
+func (dm *DirManager) usedDirs(segmentId segId) []dirEntry {
+	dm.SegMutexes[segmentId].RLock()
+	defer dm.SegMutexes[segmentId].RUnlock()
+
+	var entries []dirEntry
+	for i, d := range dm.Dirs[segmentId] {
+		if d.offset() != 0 {
+			entries = append(entries, dirEntry{offset: Offset(i), d: *d})
 		}
 	}
+	return entries
+}
 
-	dm.freeChainRebuild(segmentId)
+// invalidateDir deletes a used dir, only if it still points to the same chunk as when it was copied.
+// Chain links may change in between by inserts into the same bucket.
+func (dm *DirManager) invalidateDir(segmentId segId, e dirEntry) bool {
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
 
-	return Offset(counter)
+	d := dm.Dirs[segmentId][e.offset]
+	if d.offset() != e.d.offset() || d.tag() != e.d.tag() || d.approxSize() != e.d.approxSize() {
+		return false
+	}
+	bucketId, ok := dm.findBucket(segmentId, e.offset)
+	if !ok {
+		return false
+	}
+	return dm.dirDelete(segmentId, bucketId, e.offset) == nil
 }
 
-// purgeRandom100 purges 100% dirs in the segment randomly.
-// if bucketsNumPerSegment < 3, purge all dirs
-func (dm *DirManager) purgeRandom100(segmentId segId, whileListBucketId Offset) Offset {
-	counter := 0
-	for i := Offset(0); i < dm.BucketsNumPerSegment; i++ {
-		if i == whileListBucketId {
-			continue
+// findDir returns the dir in bucket pointing to chunk off with tag.
+// Must be called with the segment lock held.
+func (dm *DirManager) findDir(segmentId segId, bucketId Offset, tag uint16, off uint64) (dirOffset Offset, ok bool) {
+	dirs := dm.Dirs[segmentId]
+	index := bucketId * DirDepth
+	for counter := 0; counter == 0 || index != 0; counter++ {
+		if counter > DirDepth*int(dm.BucketsNumPerSegment) || dirs[index].offset() == 0 {
+			return 0, false
 		}
-		// purge whole bucket
-		index := Offset(i) * DirDepth
-		c := 0 // do while
-		for index != 0 || c == 0 {
-			counter++
-			c++
+		if dirs[index].tag() == tag && dirs[index].offset() == off {
+			return index, true
+		}
+		index = Offset(dirs[index].next())
+	}
+	return 0, false
+}
 
-			next := Offset(dm.Dirs[segmentId][index].next())
-			dm.Dirs[segmentId][index].clear()
-			index = next
+// hasDir reports whether a dir of tag still points to chunk off.
+func (dm *DirManager) hasDir(segmentId segId, bucketId Offset, tag uint16, off uint64) bool {
+	dm.SegMutexes[segmentId].RLock()
+	defer dm.SegMutexes[segmentId].RUnlock()
+	_, ok := dm.findDir(segmentId, bucketId, tag, off)
+	return ok
+}
+
+// deleteDir deletes the dir of tag pointing to chunk off, if it is still there.
+func (dm *DirManager) deleteDir(segmentId segId, bucketId Offset, tag uint16, off uint64) bool {
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
+	dirOffset, ok := dm.findDir(segmentId, bucketId, tag, off)
+	if !ok {
+		return false
+	}
+	return dm.dirDelete(segmentId, bucketId, dirOffset) == nil
+}
+
+// findBucket finds the bucket whose chain links the used dir.
+func (dm *DirManager) findBucket(segmentId segId, dirOffset Offset) (bucketId Offset, ok bool) {
+	if dirOffset%DirDepth == 0 {
+		return dirOffset / DirDepth, true
+	}
+	dirs := dm.Dirs[segmentId]
+	for b := Offset(0); b < dm.BucketsNumPerSegment; b++ {
+		index := b * DirDepth
+		for c := 0; dirs[index].offset() != 0 && c < len(dirs); c++ {
+			if index == dirOffset {
+				return b, true
+			}
+			index = Offset(dirs[index].next())
+			if index == 0 {
+				break
+			}
 		}
 	}
+	return 0, false
+}
 
-	dm.freeChainRebuild(segmentId)
+// SegmentStat is the dirs occupancy of a segment.
+type SegmentStat struct {
+	Id          int
+	Dirs        int
+	UsedDirs    int
+	FreeDirs    int // dirs linked in free chain
+	UsedBuckets int
+}
 
-	return Offset(counter)
+// Stats returns the dirs occupancy of every segment.
+func (dm *DirManager) Stats() []SegmentStat {
+	stats := make([]SegmentStat, 0, dm.SegmentsNum)
+	for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
+		stats = append(stats, dm.segmentStat(i))
+	}
+	return stats
+}
+
+func (dm *DirManager) segmentStat(segmentId segId) SegmentStat {
+	dm.SegMutexes[segmentId].RLock()
+	defer dm.SegMutexes[segmentId].RUnlock()
+
+	dirs := dm.Dirs[segmentId]
+	st := SegmentStat{Id: int(segmentId), Dirs: len(dirs)}
+	for i, d := range dirs {
+		if d.offset() == 0 {
+			continue
+		}
+		st.UsedDirs++
+		if i%DirDepth == 0 {
+			st.UsedBuckets++
+		}
+	}
+	for index := dm.DirFreeStart[segmentId]; index != 0; index = dirs[index].next() {
+		st.FreeDirs++
+		if st.FreeDirs > len(dirs) {
+			// looped free chain, stop counting
+			break
+		}
+	}
+	return st
 }
 
 // MarshalBinary converts the Dirs to binary format
 func (dm *DirManager) MarshalBinary() (data []byte, err error) {
-	buf := new(bytes.Buffer)
+	data = make([]byte, 0, dm.SegmentsNum*dm.segmentBinarySize())
 	for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
-		err := func() error {
-			dm.SegMutexes[i].Lock()
-			defer dm.SegMutexes[i].Unlock()
-			for j := 0; j < int(dm.BucketsNumPerSegment*DirDepth); j++ {
-				err = binary.Write(buf, binary.BigEndian, &dm.Dirs[i][j].raw)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		}()
-		if err != nil {
-			return nil, err
-		}
+		raw, _ := dm.snapshotSegment(i, false)
+		data = append(data, raw...)
 	}
-	data = buf.Bytes()
-	return
+	return data, nil
 }
 
 func (dm *DirManager) UnmarshalBinary(data []byte) (err error) {
-	if len(data) != int(dm.SegmentsNum*dm.BucketsNumPerSegment*DirDepth*Offset(binary.Size(&Dir{}))) {
+	segSize := dm.segmentBinarySize()
+	if len(data) != int(dm.SegmentsNum*segSize) {
 		return fmt.Errorf("invalid data size")
 	}
-	buf := bytes.NewBuffer(data)
 	for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
-		err := func() error {
-			dm.SegMutexes[i].Lock()
-			defer dm.SegMutexes[i].Unlock()
-			for j := 0; j < int(dm.BucketsNumPerSegment*DirDepth); j++ {
-				err = binary.Read(buf, binary.BigEndian, &dm.Dirs[i][j].raw)
-				if err != nil {
-					return err
-				}
-			}
-			return nil
-		}()
+		err = dm.unmarshalSegment(i, data[Offset(i)*segSize:Offset(i+1)*segSize])
 		if err != nil {
 			return err
 		}
 	}
-	return
+	return nil
+}
+
+// segmentBinarySize returns the binary size of dirs in a segment.
+func (dm *DirManager) segmentBinarySize() Offset {
+	return dm.BucketsNumPerSegment * DirDepth * Offset(DirSize)
+}
+
+// snapshotSegment copies dirs of a segment in binary format.
+// The segment lock is held only for the copy. With onlyDirty, clean segment is skipped,
+// and the dirty mark is cleared once copied.
+func (dm *DirManager) snapshotSegment(segmentId segId, onlyDirty bool) (data []byte, copied bool) {
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
+
+	if onlyDirty && !dm.segDirty[segmentId] {
+		return nil, false
+	}
+	dirs := dm.Dirs[segmentId]
+	data = make([]byte, len(dirs)*DirSize)
+	for j, d := range dirs {
+		b := data[j*DirSize:]
+		for k, r := range d.raw {
+			binary.BigEndian.PutUint16(b[k*2:], r)
+		}
+	}
+	if onlyDirty {
+		dm.segDirty[segmentId] = false
+	}
+	return data, true
+}
+
+// unmarshalSegment loads dirs of a segment from binary format. The segment is clean after loaded.
+// The free chain is rebuilt, and chains are verified, as they are followed without bound checks.
+// A segment with broken chains is left as it was, and ErrDirChainBroken is returned.
+func (dm *DirManager) unmarshalSegment(segmentId segId, data []byte) error {
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
+
+	old, oldFreeStart := dm.Dirs[segmentId], dm.DirFreeStart[segmentId]
+	if len(data) != len(old)*DirSize {
+		return fmt.Errorf("invalid segment data size")
+	}
+	dirs := make([]*Dir, len(old))
+	for j := range dirs {
+		d := &Dir{}
+		b := data[j*DirSize:]
+		for k := range d.raw {
+			d.raw[k] = binary.BigEndian.Uint16(b[k*2:])
+		}
+		dirs[j] = d
+	}
+	dm.Dirs[segmentId] = dirs
+	dm.freeChainRebuild(segmentId)
+	if _, problems := dm.checkSegmentChains(segmentId); len(problems) > 0 {
+		dm.Dirs[segmentId], dm.DirFreeStart[segmentId] = old, oldFreeStart
+		return fmt.Errorf("%w: %s", ErrDirChainBroken, problems[0])
+	}
+	dm.segDirty[segmentId] = false
+	return nil
+}
+
+// markDirty marks segments to be flushed. All segments are marked if none is given.
+func (dm *DirManager) markDirty(segmentIds ...segId) {
+	if len(segmentIds) == 0 {
+		for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
+			segmentIds = append(segmentIds, i)
+		}
+	}
+	for _, i := range segmentIds {
+		dm.SegMutexes[i].Lock()
+		dm.segDirty[i] = true
+		dm.SegMutexes[i].Unlock()
+	}
 }
@@ -124,3 +124,87 @@ func (dm *DirManager) DiagPanicHangUpDirs() error {
 	}
 	return nil
 }
+
+// checkSegmentChains verifies bucket chains and free chain of a segment without panic.
+// Returns used dirs linked from bucket chains (dir -> bucket) and problems found.
+// Note: lock the segment outside.
+func (dm *DirManager) checkSegmentChains(segmentId segId) (linked map[Offset]Offset, problems []string) {
+	dirs := dm.Dirs[segmentId]
+	linked = make(map[Offset]Offset)
+	problemf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("segment %d: ", segmentId)+fmt.Sprintf(format, a...))
+	}
+
+	// bucket chains
+	for b := Offset(0); b < dm.BucketsNumPerSegment; b++ {
+		head := b * DirDepth
+		if dirs[head].offset() == 0 {
+			if dirs[head].next() != 0 {
+				problemf("bucket %d: empty head dir links to %d", b, dirs[head].next())
+			}
+			continue
+		}
+		for index := head; ; {
+			if index >= Offset(len(dirs)) {
+				problemf("bucket %d: chain links out of segment, dir %d", b, index)
+				break
+			}
+			if index != head && index%DirDepth == 0 {
+				problemf("bucket %d: chain links to head of another bucket, dir %d", b, index)
+				break
+			}
+			if dirs[index].offset() == 0 {
+				problemf("bucket %d: chain links to an empty dir %d", b, index)
+				break
+			}
+			if owner, ok := linked[index]; ok {
+				problemf("bucket %d: dir %d is already linked from bucket %d", b, index, owner)
+				break
+			}
+			linked[index] = b
+			index = Offset(dirs[index].next())
+			if index == 0 {
+				break
+			}
+		}
+	}
+
+	// free chain
+	inFreeChain := make(map[Offset]bool)
+	prev := Offset(0)
+	for index := Offset(dm.DirFreeStart[segmentId]); index != 0; index = Offset(dirs[index].next()) {
+		if index >= Offset(len(dirs)) {
+			problemf("free chain links out of segment, dir %d", index)
+			break
+		}
+		if index%DirDepth == 0 {
+			problemf("free chain links to bucket head dir %d", index)
+			break
+		}
+		if dirs[index].offset() != 0 {
+			problemf("free chain links to a used dir %d", index)
+			break
+		}
+		if inFreeChain[index] {
+			problemf("free chain loops at dir %d", index)
+			break
+		}
+		if Offset(dirs[index].prev()) != prev {
+			problemf("free dir %d has prev %d, expect %d", index, dirs[index].prev(), prev)
+		}
+		inFreeChain[index] = true
+		prev = index
+	}
+
+	// hang-up dirs
+	for index := Offset(0); index < Offset(len(dirs)); index++ {
+		if dirs[index].offset() != 0 {
+			if _, ok := linked[index]; !ok {
+				problemf("used dir %d is not linked from any bucket", index)
+			}
+		} else if index%DirDepth != 0 && !inFreeChain[index] {
+			problemf("empty dir %d is not linked in free chain", index)
+		}
+	}
+	return linked, problems
+}
@@ -2,6 +2,7 @@ package bakemono
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -224,7 +225,7 @@ func TestDirManager_Probe(t *testing.T) {
 		}
 		_ = linkEmptyDirs(dirs)
 
-		hit, pos, _ := dirProbe(1, 0, dirs)
+		hit, pos, _, _ := dirProbe(1, 0, dirs)
 		if hit {
 			t.Error("should not hit")
 		}
@@ -232,7 +233,7 @@ func TestDirManager_Probe(t *testing.T) {
 			t.Error("pos should be 0")
 		}
 
-		hit, pos, _ = dirProbe(1, 1, dirs)
+		hit, pos, _, _ = dirProbe(1, 1, dirs)
 		if hit {
 			t.Error("should not hit")
 		}
@@ -251,7 +252,7 @@ func TestDirManager_Probe(t *testing.T) {
 
 		dirs[0].setOffset(1)
 		dirs[0].setTag(1)
-		hit, pos, _ := dirProbe(1, 0, dirs)
+		hit, pos, _, _ := dirProbe(1, 0, dirs)
 		if !hit {
 			t.Error("should hit")
 		}
@@ -261,7 +262,7 @@ func TestDirManager_Probe(t *testing.T) {
 
 		dirs[4].setOffset(1)
 		dirs[4].setTag(1)
-		hit, pos, _ = dirProbe(1, 1, dirs)
+		hit, pos, _, _ = dirProbe(1, 1, dirs)
 		if !hit {
 			t.Error("should hit")
 		}
@@ -285,7 +286,7 @@ func TestDirManager_Probe(t *testing.T) {
 		dirs[1].setTag(2)
 		dirs[1].setNext(0)
 
-		hit, pos, _ := dirProbe(3, 0, dirs)
+		hit, pos, _, _ := dirProbe(3, 0, dirs)
 		if hit {
 			t.Error("should not hit")
 		}
@@ -307,7 +308,7 @@ func TestDirManager_Probe(t *testing.T) {
 		dirs[1].setOffset(1)
 		dirs[1].setTag(2)
 		dirs[1].setNext(0)
-		hit, pos, _ := dirProbe(2, 0, dirs)
+		hit, pos, _, _ := dirProbe(2, 0, dirs)
 		if !hit {
 			t.Error("should not hit")
 		}
@@ -324,7 +325,7 @@ func TestDirManager_Probe(t *testing.T) {
 		dirs[6].setOffset(1)
 		dirs[6].setTag(3)
 		dirs[6].setNext(0)
-		hit, pos, _ = dirProbe(2, 1, dirs)
+		hit, pos, _, _ = dirProbe(2, 1, dirs)
 		if !hit {
 			t.Error("should not hit")
 		}
@@ -459,3 +460,173 @@ func TestDirManager_GetSet(t *testing.T) {
 		}
 	}
 }
+
+func TestDirManager_Delete(t *testing.T) {
+	dm := &DirManager{}
+	dm.Init(20)
+	dm.InitEmptyDirs()
+
+	// fill one segment, make chains grab dirs from free chain
+	keys := make([][]byte, 0)
+	for i := 0; i < 16; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		_, err := dm.Set(key, Offset(100+i), 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	for i, key := range keys {
+		hit, _, d := dm.Get(key)
+		if !hit {
+			// evicted by tag collision
+			continue
+		}
+		if !dm.Delete(key) {
+			t.Fatalf("key %d should be deleted", i)
+		}
+		hit2, _, d2 := dm.Get(key)
+		if hit2 && d2.offset() == d.offset() {
+			t.Fatalf("key %d should not hit after delete", i)
+		}
+		if _, err := dm.DiagHangUsedDirs(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dm.DiagHangFreeDirs(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dm.Delete([]byte("key-not-exist")) {
+		t.Error("delete of not exist key should return false")
+	}
+
+	for _, st := range dm.Stats() {
+		if st.UsedDirs != 0 {
+			t.Errorf("segment %d should be empty, used: %d", st.Id, st.UsedDirs)
+		}
+		if st.FreeDirs != st.Dirs-int(dm.BucketsNumPerSegment) {
+			t.Errorf("segment %d free dirs %d not match", st.Id, st.FreeDirs)
+		}
+	}
+}
+
+func FuzzDirManagerUnmarshalBinary(f *testing.F) {
+	dm := &DirManager{}
+	dm.Init(32)
+	empty, err := dm.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(empty)
+	for i := 0; i < 20; i++ {
+		_, err = dm.Set([]byte(fmt.Sprintf("key-%d", i)), Offset(i+1)*4096, 4096)
+		if err != nil {
+			f.Fatal(err)
+		}
+	}
+	used, err := dm.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(used)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = dm.UnmarshalBinary(data)
+		// fit the size, so the fuzzer spends its time on chains
+		fit := make([]byte, len(used))
+		copy(fit, data)
+		if dm.UnmarshalBinary(fit) != nil {
+			return
+		}
+		// a loaded segment is well linked, and stays so
+		for i := 0; i < 20; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			switch i % 3 {
+			case 0:
+				dm.Get(key)
+			case 1:
+				_, err := dm.Set(key, Offset(i+1)*4096, 4096)
+				if err != nil {
+					t.Fatal(err)
+				}
+			case 2:
+				dm.Delete(key)
+			}
+		}
+		for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
+			if _, problems := dm.checkSegmentChains(i); len(problems) > 0 {
+				t.Fatalf("segment broken after loaded: %v", problems)
+			}
+		}
+	})
+}
+
+func TestDirManager_UnmarshalBrokenChain(t *testing.T) {
+	dm := &DirManager{}
+	dm.Init(32)
+	_, err := dm.Set([]byte("key"), 4096, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := dm.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, link := range map[string]uint16{"out of segment": 1000, "loop": 1} {
+		dirs := make([]*Dir, 32)
+		for i := range dirs {
+			dirs[i] = &Dir{}
+		}
+		_ = linkEmptyDirs(dirs)
+		dirs[0].setOffset(4096)
+		dirs[1].setOffset(8192)
+		dirs[0].setNext(1)
+		dirs[1].setNext(link)
+
+		hit, _, _, err := dirProbe(dirs[0].tag()+1, 0, dirs)
+		if hit || err != ErrDirChainBroken {
+			t.Fatalf("%s: probe should fail on the broken chain, got %v", name, err)
+		}
+
+		data := make([]byte, 0, len(good))
+		for _, d := range dirs {
+			b, _ := d.MarshalBinary()
+			data = append(data, b...)
+		}
+		err = dm.UnmarshalBinary(data)
+		if !errors.Is(err, ErrDirChainBroken) {
+			t.Fatalf("%s: unmarshal should refuse the broken chain, got %v", name, err)
+		}
+		if hit, _, _ := dm.Get([]byte("key")); !hit {
+			t.Fatalf("%s: dirs should be left as they were", name)
+		}
+	}
+}
+
+func TestDirManager_DeleteUnlinked(t *testing.T) {
+	dm := &DirManager{}
+	dm.Init(32)
+	for name, link := range map[string]uint16{"unlinked": 0, "out of segment": 1000, "loop": 1} {
+		dirs := dm.Dirs[0]
+		for _, d := range dirs {
+			*d = Dir{}
+		}
+		_ = linkEmptyDirs(dirs)
+		dirs[0].setOffset(4096)
+		dirs[1].setOffset(8192)
+		dirs[2].setOffset(12288)
+		dirs[0].setNext(1)
+		dirs[1].setNext(link)
+		dm.segDirty[0] = false
+
+		// dir 2 is used, but not linked in bucket 0
+		err := dm.dirDelete(0, 0, 2)
+		if err != ErrDirChainBroken {
+			t.Fatalf("%s: delete should fail on a dir not linked, got %v", name, err)
+		}
+		if dirs[2].offset() != 12288 || dm.segDirty[0] {
+			t.Fatalf("%s: dirs should be left as they were", name)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package bakemono
 
 import (
+	"bytes"
 	"math/rand"
 	"testing"
 
@@ -142,3 +143,29 @@ func testDirOnce(t *testing.T) {
 		})
 	})
 }
+
+func FuzzDirUnmarshalBinary(f *testing.F) {
+	d := newDir(0x123, 0x123456, 100000)
+	d.setNext(7)
+	b, err := d.MarshalBinary()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(b)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := &Dir{}
+		if d.UnmarshalBinary(data) != nil {
+			return
+		}
+		if d.approxSize() > DirMaxDataSize {
+			t.Fatalf("approx size %d of a dir exceeds %d", d.approxSize(), DirMaxDataSize)
+		}
+		b, err := d.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[:DirSize]) {
+			t.Fatalf("dir encodes %x, decoded from %x", b, data[:DirSize])
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package bakemono
+
+import "fmt"
+
+// Durability is the fsync policy of a Vol. Storage must implement Syncer unless DurabilityNone.
+type Durability int
+
+const (
+	// DurabilityNone never syncs, leaves it to the OS.
+	DurabilityNone Durability = iota
+	// DurabilityMeta syncs on every meta flush. Dirs are synced before the header, so the header goes last.
+	DurabilityMeta
+	// DurabilityWrite syncs meta flushes, and every chunk before its dir is published.
+	// Journal records are synced too, so a returned Set survives a crash when journal is enabled.
+	DurabilityWrite
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityNone:
+		return "none"
+	case DurabilityMeta:
+		return "meta"
+	case DurabilityWrite:
+		return "write"
+	}
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// sync commits written data of Fp, if durability is at least d.
+func (v *Vol) sync(d Durability) error {
+	if v.durability < d {
+		return nil
+	}
+	return v.Fp.(Syncer).Sync()
+}
@@ -0,0 +1,114 @@
+package bakemono
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// lossyCrash returns the content of s after a power cut, s must record since it was zeroed.
+// Writes before the last Sync survive, each later one survives with probability keep.
+func lossyCrash(s *MemStore, rnd *rand.Rand, keep float64) *MemStore {
+	records := s.Records()
+	synced := 0
+	for i, w := range records {
+		if w.Sync {
+			synced = i
+		}
+	}
+	c := NewMemStore(s.Size())
+	for i, w := range records {
+		if i < synced || rnd.Float64() < keep {
+			_, _ = c.WriteAt(w.Data, w.Off)
+		}
+	}
+	return c
+}
+
+// noSyncStore hides Sync of the storage.
+type noSyncStore struct {
+	OffsetReaderWriterCloser
+}
+
+const lossyTestingVolSize = 1024 * 1024 * 16
+
+func openLossyTestingVol(t *testing.T, s OffsetReaderWriterCloser, d Durability) (*Vol, bool) {
+	v := &Vol{}
+	corrupted, err := v.Init(&VolOptions{
+		Fp:                s,
+		FileSize:          lossyTestingVolSize,
+		ChunkAvgSize:      64 * 1024,
+		FlushMetaInterval: 3600e9,
+		JournalSize:       64 * 1024,
+		Durability:        d,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, corrupted
+}
+
+func TestVolDurability(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, d := range []Durability{DurabilityNone, DurabilityMeta, DurabilityWrite} {
+		t.Run(d.String(), func(t *testing.T) {
+			s := NewMemStore(lossyTestingVolSize)
+			s.Record()
+			v, _ := openLossyTestingVol(t, s, d)
+			for i := 0; i < 50; i++ {
+				err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i == 24 {
+					err = v.Flush()
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, keep := range []float64{0, 0.5} {
+				v2, corrupted := openLossyTestingVol(t, lossyCrash(s, rnd, keep), DurabilityNone)
+				hits := 0
+				for i := 0; i < 50; i++ {
+					hit, data, err := v2.Get([]byte(fmt.Sprintf("key-%d", i)))
+					if err != nil {
+						continue
+					}
+					if hit && string(data) != fmt.Sprintf("value-%d", i) {
+						t.Fatalf("key-%d should never hit a wrong value: %s", i, data)
+					}
+					if hit {
+						hits++
+					}
+				}
+				t.Logf("durability: %s, keep: %v, corrupted: %v, hits: %d", d, keep, corrupted, hits)
+
+				switch {
+				case d == DurabilityWrite && hits != 50:
+					t.Fatalf("all keys should survive a crash, hits: %d", hits)
+				case d == DurabilityMeta && hits < 25:
+					t.Fatalf("keys before flush should survive a crash, hits: %d", hits)
+				case d == DurabilityNone && keep == 0 && !corrupted:
+					t.Fatal("nothing is synced, vol should be corrupted")
+				}
+				_ = v2.Close()
+			}
+			_ = v.Close()
+		})
+	}
+}
+
+func TestVolDurabilityNeedsSyncer(t *testing.T) {
+	v := &Vol{}
+	_, err := v.Init(&VolOptions{
+		Fp:           noSyncStore{NewMemStore(lossyTestingVolSize)},
+		FileSize:     lossyTestingVolSize,
+		ChunkAvgSize: 64 * 1024,
+		Durability:   DurabilityMeta,
+	})
+	if err == nil {
+		t.Fatal("durability should need Syncer")
+	}
+}
@@ -0,0 +1,141 @@
+package bakemono
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ChunkNonceSize is the nonce size of AES-GCM, every chunk has one for its key and one for its data.
+const ChunkNonceSize = 12
+
+// chunkSealOverhead is the size AES-GCM adds to a sealed key or data.
+const chunkSealOverhead = 16
+
+// EncryptionOptions enables AES-GCM encryption of chunk keys and data.
+// Meta in the chunk header stays in the clear, the whole header is authenticated.
+type EncryptionOptions struct {
+	// Keys are AES keys by id, 16, 24 or 32 bytes. Id 0 is reserved for chunks in the clear.
+	// Keep old keys here after rotating, chunks written with them stay readable until overwritten.
+	Keys map[uint32][]byte
+
+	// KeyID is the id of the key new chunks are written with.
+	KeyID uint32
+}
+
+// Check checks if the EncryptionOptions is valid.
+func (o *EncryptionOptions) Check() error {
+	_, err := NewKeyring(o)
+	return err
+}
+
+// Keyring seals chunks with the active key, and opens them with the key of their KeyID.
+type Keyring struct {
+	aeads  map[uint32]cipher.AEAD
+	active uint32
+}
+
+// NewKeyring creates a Keyring of opts.
+func NewKeyring(opts *EncryptionOptions) (*Keyring, error) {
+	if _, ok := opts.Keys[opts.KeyID]; !ok {
+		return nil, fmt.Errorf("encryption: no key of KeyID %d", opts.KeyID)
+	}
+	k := &Keyring{aeads: make(map[uint32]cipher.AEAD, len(opts.Keys)), active: opts.KeyID}
+	for id, key := range opts.Keys {
+		if id == 0 {
+			return nil, errors.New("encryption: key id 0 is reserved")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %d: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: key %d: %w", id, err)
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// seal encrypts key and stored data of a chunk with the active key into h, once all other header fields are set.
+// Returns the data on disk.
+func (k *Keyring) seal(h *ChunkHeader, key, stored []byte) ([]byte, error) {
+	if len(key)+chunkSealOverhead > ChunkKeyMaxSize {
+		return nil, ErrChunkKeyTooLarge
+	}
+	aead := k.aeads[k.active]
+	h.KeyID = k.active
+	h.KeyLength = uint16(len(key) + chunkSealOverhead)
+	h.DataLength = uint32(len(stored) + chunkSealOverhead)
+	_, err := io.ReadFull(rand.Reader, h.KeyNonce[:])
+	if err == nil {
+		_, err = io.ReadFull(rand.Reader, h.DataNonce[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ad := h.authData()
+	h.Key = [ChunkKeyMaxSize]byte{}
+	aead.Seal(h.Key[:0], h.KeyNonce[:], key, ad)
+	data := aead.Seal(make([]byte, 0, h.DataLength), h.DataNonce[:], stored, append(ad, h.Key[:h.KeyLength]...))
+	return data, nil
+}
+
+// openKey decrypts the key of a chunk header, and authenticates the header.
+func (k *Keyring) openKey(h *ChunkHeader) ([]byte, error) {
+	aead, ok := k.aeads[h.KeyID]
+	if !ok || h.KeyLength < chunkSealOverhead || int(h.KeyLength) > ChunkKeyMaxSize {
+		return nil, ErrChunkVerifyFailed
+	}
+	key, err := aead.Open(nil, h.KeyNonce[:], h.Key[:h.KeyLength], h.authData())
+	if err != nil {
+		return nil, ErrChunkVerifyFailed
+	}
+	return key, nil
+}
+
+// openData decrypts the data on disk of a chunk whose key is opened.
+func (k *Keyring) openData(h *ChunkHeader, data []byte) ([]byte, error) {
+	aead, ok := k.aeads[h.KeyID]
+	if !ok {
+		return nil, ErrChunkVerifyFailed
+	}
+	stored, err := aead.Open(nil, h.DataNonce[:], data, append(h.authData(), h.Key[:h.KeyLength]...))
+	if err != nil {
+		return nil, ErrChunkVerifyFailed
+	}
+	return stored, nil
+}
+
+// authData is the header data authenticated by AES-GCM: every field but Key, Checksum and HeaderChecksum.
+func (c *ChunkHeader) authData() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 80+c.MetaLength))
+	for _, f := range []interface{}{
+		c.Magic, c.DataLength, c.HeaderSize, c.Version, c.Serial, c.Codec, c.RawLength,
+		c.KeyID, c.KeyLength, c.KeyNonce, c.DataNonce, c.MetaLength,
+	} {
+		_ = binary.Write(buf, binary.BigEndian, f)
+	}
+	buf.Write(c.GetMeta())
+	return buf.Bytes()
+}
+
+// Decrypt returns the key of the header, decrypted with keys, and authenticates the header.
+// A header in the clear needs nil keys, and an encrypted one needs keys with its KeyID,
+// otherwise ErrChunkVerifyFailed is returned.
+func (c *ChunkHeader) Decrypt(keys *Keyring) ([]byte, error) {
+	if keys == nil || c.KeyID == 0 {
+		if keys != nil || c.KeyID != 0 {
+			return nil, ErrChunkVerifyFailed
+		}
+		return c.GetKey(), nil
+	}
+	return keys.openKey(c)
+}
@@ -0,0 +1,157 @@
+package bakemono
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func testKeyring(t *testing.T, active uint32, ids ...uint32) *Keyring {
+	opts := &EncryptionOptions{Keys: map[uint32][]byte{}, KeyID: active}
+	for _, id := range ids {
+		opts.Keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	k, err := NewKeyring(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestChunkEncrypt(t *testing.T) {
+	keys := testKeyring(t, 1, 1)
+	key, value := []byte("secret-key"), []byte("secret-value")
+	ck := &Chunk{Keys: keys}
+	err := ck.Set(key, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ck.SetMeta([]byte("meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ck.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Offset(len(b)) != ck.GetBinaryLength() {
+		t.Fatalf("binary length %d, expect %d", len(b), ck.GetBinaryLength())
+	}
+	if bytes.Contains(b, key) || bytes.Contains(b, value) {
+		t.Fatal("key and value should not be on disk in the clear")
+	}
+
+	ck2 := &Chunk{Keys: keys}
+	err = ck2.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, v := ck2.GetKeyData()
+	if !bytes.Equal(k, key) || !bytes.Equal(v, value) {
+		t.Fatalf("decrypted chunk mismatch, key: %q, value: %q", k, v)
+	}
+	if ck2.Header.GetKey() != nil {
+		t.Fatal("GetKey of an encrypted header should be nil")
+	}
+
+	// without keys, or with another key, the chunk fails to verify
+	for _, other := range []*Keyring{nil, testKeyring(t, 2, 2)} {
+		err = (&Chunk{Keys: other}).UnmarshalBinary(b)
+		if err != ErrChunkVerifyFailed {
+			t.Fatalf("chunk should fail to verify with keyring %v, got %v", other, err)
+		}
+	}
+
+	// the header is authenticated, even with checksums fixed up
+	h := ck2.Header
+	h.Meta[0] ^= 1
+	h.HeaderChecksum = h.GenerateHeaderChecksum()
+	_, err = h.Decrypt(keys)
+	if err != ErrChunkVerifyFailed {
+		t.Fatalf("tampered header should fail to decrypt, got %v", err)
+	}
+}
+
+func TestVolEncryptionKeyRotation(t *testing.T) {
+	path := "/tmp/bakemono-test-encryption.vol"
+	defer os.Remove(path)
+	open := func(enc *EncryptionOptions) *Vol {
+		cfg, err := NewDefaultVolOptions(path, 1024*1024*16, 64*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Encryption = enc
+		cfg.Compress = &CompressOptions{Codec: FlateCodec{}}
+		v := &Vol{}
+		_, err = v.Init(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("value-%d,", i)), 100)
+	}
+	set := func(v *Vol, from, to int) {
+		for i := from; i < to; i++ {
+			err := v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), value(i), &ObjectMeta{ContentType: "text/plain"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(v *Vol, from, to int, hit bool) {
+		for i := from; i < to; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			got, data, _ := v.Get(key)
+			if got != hit || hit && !bytes.Equal(data, value(i)) {
+				t.Fatalf("key-%d hit: %v, expect: %v", i, got, hit)
+			}
+			got, info, _ := v.Stat(key)
+			if got != hit || hit && info.Size != len(value(i)) {
+				t.Fatalf("stat key-%d hit: %v, expect: %v", i, got, hit)
+			}
+		}
+	}
+
+	v := open(&EncryptionOptions{Keys: map[uint32][]byte{1: key1}, KeyID: 1})
+	set(v, 0, 10)
+	check(v, 0, 10, true)
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate to key 2, chunks of key 1 stay readable
+	v = open(&EncryptionOptions{Keys: map[uint32][]byte{1: key1, 2: key2}, KeyID: 2})
+	check(v, 0, 10, true)
+	set(v, 10, 20)
+	check(v, 10, 20, true)
+	n := 0
+	err := v.Range(context.Background(), func(key []byte, size int, meta *ObjectMeta) bool {
+		n++
+		return true
+	})
+	if err != nil || n != 20 {
+		t.Fatalf("range should list 20 keys, got %d, err: %v", n, err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// key 1 retired
+	v = open(&EncryptionOptions{Keys: map[uint32][]byte{2: key2}, KeyID: 2})
+	check(v, 0, 10, false)
+	check(v, 10, 20, true)
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a vol in the clear serves no encrypted chunk
+	v = open(nil)
+	defer v.Close()
+	check(v, 0, 20, false)
+}
@@ -1,11 +1,16 @@
 package bakemono
 
-import "os"
+import (
+	"context"
+	"os"
+	"time"
+)
 
 type Engine struct {
 	path        string
 	SizeMb      uint32
 	SliceSizeKb uint32
+	TagIndexKb  uint32
 	fp          *os.File
 
 	Volume *Vol
@@ -16,42 +21,138 @@ func NewEngine(cfg *EngineConfig) *Engine {
 		path:        cfg.Path,
 		SizeMb:      cfg.SizeMb,
 		SliceSizeKb: cfg.SliceSizeKb,
+		TagIndexKb:  cfg.TagIndexSizeKb,
 	}
 }
 
+// Init opens the file of the engine and the vol in it. The file is created or grown to SizeMb.
+// Calling Init again closes the opened vol first.
 func (e *Engine) Init() error {
-	//var fileSize uint64
-	//fileSize = uint64(e.SizeMb) * 1024 * 1024
-	//blocks := fileSize / BlockSize
-	//fileUse := blocks * BlockSize
+	if e.Volume != nil {
+		_ = e.Close()
+	}
 
+	fileSize := int64(e.SizeMb) * 1024 * 1024
 	fp, err := os.OpenFile(e.path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
+	st, err := fp.Stat()
+	if err != nil {
+		_ = fp.Close()
+		return err
+	}
+	if st.Size() < fileSize {
+		err = fp.Truncate(fileSize)
+		if err != nil {
+			_ = fp.Close()
+			return err
+		}
+	}
 	e.fp = fp
 
 	err = e.parseVol()
-
+	if err != nil {
+		_ = fp.Close()
+		e.fp = nil
+		return err
+	}
 	return nil
 }
 
 func (e *Engine) parseVol() error {
-	e.Volume = &Vol{
-		Path: e.path,
-		Fp:   e.fp,
+	v := &Vol{Path: e.path}
+	_, err := v.Init(&VolOptions{
+		Fp:                e.fp,
+		FileSize:          Offset(e.SizeMb) * 1024 * 1024,
+		ChunkAvgSize:      Offset(e.SliceSizeKb) * 1024,
+		FlushMetaInterval: 60 * time.Second,
+		TagIndexSize:      Offset(e.TagIndexKb) * 1024,
+	})
+	if err != nil {
+		return err
 	}
+	e.Volume = v
 	return nil
 }
 
+// Close closes the vol of the engine.
+func (e *Engine) Close() error {
+	if e.Volume == nil {
+		return nil
+	}
+	err := e.Volume.Close()
+	e.Volume, e.fp = nil, nil
+	return err
+}
+
 func (e *Engine) Set(key, value []byte) error {
-	return nil
+	return e.Volume.Set(key, value)
 }
 
+// Get returns the value of key, nil value on a miss.
 func (e *Engine) Get(key []byte) ([]byte, error) {
-	return nil, nil
+	_, value, err := e.Volume.Get(key)
+	return value, err
+}
+
+// Exists calls Vol.Exists.
+func (e *Engine) Exists(key []byte) bool {
+	return e.Volume.Exists(key)
+}
+
+// Stat calls Vol.Stat.
+func (e *Engine) Stat(key []byte) (bool, ObjectInfo, error) {
+	return e.Volume.Stat(key)
+}
+
+// SetWithMeta calls Vol.SetWithMeta.
+func (e *Engine) SetWithMeta(key, value []byte, meta *ObjectMeta) error {
+	return e.Volume.SetWithMeta(key, value, meta)
+}
+
+// PurgeTag calls Vol.PurgeTag.
+func (e *Engine) PurgeTag(tag string) (int, error) {
+	return e.Volume.PurgeTag(tag)
+}
+
+// Namespace calls Vol.Namespace.
+func (e *Engine) Namespace(name string) *Namespace {
+	return e.Volume.Namespace(name)
+}
+
+// InvalidateNamespace calls Vol.InvalidateNamespace.
+func (e *Engine) InvalidateNamespace(name string) error {
+	return e.Volume.InvalidateNamespace(name)
 }
 
 func (e *Engine) Delete(key []byte) error {
-	return nil
+	return e.Volume.Delete(key)
+}
+
+// GetOrLoad calls Vol.GetOrLoad.
+func (e *Engine) GetOrLoad(ctx context.Context, key []byte, loader func() ([]byte, error)) ([]byte, error) {
+	return e.Volume.GetOrLoad(ctx, key, loader)
+}
+
+// MultiGet gets keys in a batch, values are in the same order as keys, nil value on a miss.
+// The first disk error is returned, other values are still filled.
+func (e *Engine) MultiGet(keys [][]byte) ([][]byte, error) {
+	results, err := e.Volume.MultiGet(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i, r := range results {
+		if r.Err != nil && err == nil {
+			err = r.Err
+		}
+		values[i] = r.Value
+	}
+	return values, err
+}
+
+// MultiSet calls Vol.MultiSet.
+func (e *Engine) MultiSet(items []Item) error {
+	return e.Volume.MultiSet(items)
 }
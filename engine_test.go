@@ -1,6 +1,7 @@
 package bakemono
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"os"
@@ -102,3 +103,70 @@ func TestEngineDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestEngineGetOrLoad(t *testing.T) {
+	path := "/tmp/bakemono_test_load.cache"
+	defer os.Remove(path)
+	engine, err := InitEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	value, err := engine.GetOrLoad(context.Background(), []byte("key-load"), func() ([]byte, error) {
+		return []byte("value"), nil
+	})
+	if err != nil || string(value) != "value" {
+		t.Fatalf("should get loaded value, value: %s, err: %v", value, err)
+	}
+	value, err = engine.Get([]byte("key-load"))
+	if err != nil || string(value) != "value" {
+		t.Fatalf("loaded value should be set, value: %s, err: %v", value, err)
+	}
+}
+
+func TestEngineMultiSetGet(t *testing.T) {
+	path := "/tmp/bakemono_test_multi.cache"
+	defer os.Remove(path)
+	engine, err := InitEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	err = engine.MultiSet([]Item{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := engine.MultiGet([][]byte{[]byte("b"), []byte("c"), []byte("a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "2" || values[1] != nil || string(values[2]) != "1" {
+		t.Fatalf("unexpected values: %q", values)
+	}
+}
+
+func TestEnginePurgeTag(t *testing.T) {
+	path := "/tmp/bakemono_test_tag.cache"
+	defer os.Remove(path)
+	eg := NewEngine(&EngineConfig{Path: path, SizeMb: 64, SliceSizeKb: 64, TagIndexSizeKb: 64})
+	err := eg.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eg.Close()
+
+	err = eg.SetWithMeta([]byte("key"), []byte("value"), &ObjectMeta{Tags: []string{"product-123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := eg.PurgeTag("product-123")
+	if err != nil || n != 1 {
+		t.Fatal("purge tag failed", n, err)
+	}
+	value, err := eg.Get([]byte("key"))
+	if err != nil || value != nil {
+		t.Fatal("key should be purged", err)
+	}
+}
@@ -5,9 +5,31 @@ import "errors"
 var ErrChunkVerifyFailed = errors.New("chunk verify failed")
 var ErrChunkDataTooLarge = errors.New("chunk data too large")
 var ErrChunkKeyTooLarge = errors.New("chunk key too large")
+var ErrChunkMetaTooLarge = errors.New("chunk meta too large")
+var ErrChunkMetaInvalid = errors.New("chunk meta invalid")
+var ErrTagIndexDisabled = errors.New("tag index disabled")
+var ErrTagIndexFull = errors.New("tag index full")
+var ErrTagIndexInvalid = errors.New("tag index invalid")
+var ErrNamespaceFull = errors.New("namespace generations full")
+var ErrDirChainBroken = errors.New("dir chain broken")
 
 var ErrVolFileCorrupted = errors.New("vol file corrupted")
+var ErrVolReadOnly = errors.New("vol is read-only")
+var ErrVolLayoutMismatch = errors.New("vol layout mismatch")
+var ErrVolVersionTooNew = errors.New("vol version too new")
+var ErrVolVersionUnsupported = errors.New("vol version not supported")
+var ErrVolResized = errors.New("vol resized")
+
+var ErrExportInvalid = errors.New("export stream invalid")
+var ErrExportChecksum = errors.New("export record checksum mismatch")
+var ErrExportVersion = errors.New("export stream version not supported")
+
+var ErrJournalRecordInvalid = errors.New("journal record invalid")
+var ErrJournalInvalid = errors.New("journal invalid, records were dropped on a full journal")
 
 var ErrKeyTooLong = errors.New("key too long")
 
 var ErrCacheMiss = errors.New("cache miss")
+
+var ErrStoreClosed = errors.New("store closed")
+var ErrFaultInjected = errors.New("fault injected")
@@ -0,0 +1,255 @@
+package bakemono
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultOp is a bit set of the IO a Fault applies to.
+type FaultOp int
+
+const (
+	FaultRead FaultOp = 1 << iota
+	FaultWrite
+	FaultSync
+)
+
+// FaultKind is what a Fault does to an IO.
+type FaultKind int
+
+const (
+	// FaultFail fails the IO with Fault.Err, nothing is read or written.
+	FaultFail FaultKind = iota
+	// FaultDelay sleeps Fault.Delay before the IO.
+	FaultDelay
+	// FaultTear reads or writes a random prefix of the buffer only, then fails with Fault.Err, like a torn write on power loss.
+	FaultTear
+	// FaultBitFlip flips a random bit of the data read or written, and reports success.
+	// The bit is inside the offset range of the fault.
+	FaultBitFlip
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultFail:
+		return "fail"
+	case FaultDelay:
+		return "delay"
+	case FaultTear:
+		return "tear"
+	case FaultBitFlip:
+		return "bitflip"
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// Fault is a rule of FaultStore. An IO matching Op and overlapping [Offset, Offset+Length) triggers it with Probability.
+type Fault struct {
+	Op   FaultOp
+	Kind FaultKind
+
+	// Offset and Length is the range the IO must overlap, Length 0 means any offset.
+	Offset int64
+	Length int64
+
+	// Probability to trigger on a matching IO, 0 means always.
+	Probability float64
+
+	// Count limits the times it triggers, 0 means unlimited.
+	Count int
+
+	// Delay of FaultDelay.
+	Delay time.Duration
+
+	// Err returned by FaultFail and FaultTear, nil means ErrFaultInjected.
+	Err error
+}
+
+func (f *Fault) overlaps(off int64, n int) bool {
+	if f.Length == 0 {
+		return true
+	}
+	return off < f.Offset+f.Length && f.Offset < off+int64(n)
+}
+
+type faultRule struct {
+	Fault
+	triggered int
+}
+
+// FaultStore wraps an OffsetReaderWriterCloser and injects faults into its reads, writes and syncs,
+// to test error paths. Faults are decided by a seeded rand, a sequence of IO triggers the same faults on every run.
+// Sync and Truncate are passed through when the wrapped storage implements them.
+type FaultStore struct {
+	rw OffsetReaderWriterCloser
+
+	mu    sync.Mutex
+	rnd   *rand.Rand
+	rules []*faultRule
+}
+
+// NewFaultStore wraps rw, faults are decided by rand of seed.
+func NewFaultStore(rw OffsetReaderWriterCloser, seed int64) *FaultStore {
+	return &FaultStore{rw: rw, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Inject adds a fault. Faults are checked in order of Inject, every one triggered applies to the IO.
+func (s *FaultStore) Inject(f Fault) {
+	if f.Err == nil {
+		f.Err = ErrFaultInjected
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = append(s.rules, &faultRule{Fault: f})
+}
+
+// Clear removes all faults.
+func (s *FaultStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = nil
+}
+
+// Triggered returns the times faults have triggered since the last Clear.
+func (s *FaultStore) Triggered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.rules {
+		n += r.triggered
+	}
+	return n
+}
+
+// faultAction is a triggered fault, with its random choices made under s.mu.
+type faultAction struct {
+	*Fault
+	cut  int // prefix length of FaultTear
+	flip int // bit index of FaultBitFlip
+}
+
+// match returns faults triggered by an IO.
+func (s *FaultStore) match(op FaultOp, off int64, n int) []faultAction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var actions []faultAction
+	for _, r := range s.rules {
+		if r.Op&op == 0 || op != FaultSync && !r.overlaps(off, n) || r.Count > 0 && r.triggered >= r.Count {
+			continue
+		}
+		if r.Probability > 0 && s.rnd.Float64() >= r.Probability {
+			continue
+		}
+		r.triggered++
+		a := faultAction{Fault: &r.Fault}
+		if n > 0 {
+			a.cut = s.rnd.Intn(n)
+			lo, hi := int64(0), int64(n)
+			if r.Length > 0 {
+				if r.Offset > off {
+					lo = r.Offset - off
+				}
+				if end := r.Offset + r.Length - off; end < hi {
+					hi = end
+				}
+			}
+			a.flip = int(lo*8 + s.rnd.Int63n((hi-lo)*8))
+		}
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+func (s *FaultStore) ReadAt(p []byte, off int64) (int, error) {
+	actions := s.match(FaultRead, off, len(p))
+	for _, a := range actions {
+		switch a.Kind {
+		case FaultFail:
+			return 0, a.Err
+		case FaultDelay:
+			time.Sleep(a.Delay)
+		}
+	}
+	n, err := s.rw.ReadAt(p, off)
+	for _, a := range actions {
+		switch a.Kind {
+		case FaultTear:
+			if a.cut < n {
+				n, err = a.cut, a.Err
+			}
+		case FaultBitFlip:
+			if a.flip/8 < n {
+				p[a.flip/8] ^= 1 << (a.flip % 8)
+			}
+		}
+	}
+	return n, err
+}
+
+func (s *FaultStore) WriteAt(p []byte, off int64) (int, error) {
+	actions := s.match(FaultWrite, off, len(p))
+	for _, a := range actions {
+		switch a.Kind {
+		case FaultFail:
+			return 0, a.Err
+		case FaultDelay:
+			time.Sleep(a.Delay)
+		}
+	}
+	var tear *faultAction
+	flipped := false
+	for i, a := range actions {
+		switch a.Kind {
+		case FaultTear:
+			if tear == nil || a.cut < tear.cut {
+				tear = &actions[i]
+			}
+		case FaultBitFlip:
+			if !flipped {
+				// p belongs to the caller, flip a copy
+				p = append([]byte(nil), p...)
+				flipped = true
+			}
+			p[a.flip/8] ^= 1 << (a.flip % 8)
+		}
+	}
+	if tear != nil {
+		n, err := s.rw.WriteAt(p[:tear.cut], off)
+		if err != nil {
+			return n, err
+		}
+		return n, tear.Err
+	}
+	return s.rw.WriteAt(p, off)
+}
+
+// Sync syncs the wrapped storage if it is a Syncer. Faults of FaultSync apply at any offset, a tear fails it.
+func (s *FaultStore) Sync() error {
+	for _, a := range s.match(FaultSync, 0, 0) {
+		switch a.Kind {
+		case FaultFail, FaultTear:
+			return a.Err
+		case FaultDelay:
+			time.Sleep(a.Delay)
+		}
+	}
+	if sy, ok := s.rw.(Syncer); ok {
+		return sy.Sync()
+	}
+	return nil
+}
+
+// Truncate truncates the wrapped storage, it fails if the storage can't.
+func (s *FaultStore) Truncate(size int64) error {
+	t, ok := s.rw.(truncater)
+	if !ok {
+		return fmt.Errorf("faultstore: %T can't truncate", s.rw)
+	}
+	return t.Truncate(size)
+}
+
+func (s *FaultStore) Close() error {
+	return s.rw.Close()
+}
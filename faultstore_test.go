@@ -0,0 +1,165 @@
+package bakemono
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFaultStore(t *testing.T) {
+	s := NewFaultStore(NewMemStore(4096), 1)
+	data := bytes.Repeat([]byte{0xaa}, 1024)
+
+	s.Inject(Fault{Op: FaultWrite, Kind: FaultFail, Offset: 1024, Length: 1, Count: 1})
+	_, err := s.WriteAt(data, 512)
+	if err != ErrFaultInjected {
+		t.Fatalf("write overlapping the fault should fail, got %v", err)
+	}
+	_, err = s.WriteAt(data, 512)
+	if err != nil {
+		t.Fatalf("fault of count 1 should trigger once, got %v", err)
+	}
+	_, err = s.WriteAt(data, 2048)
+	if err != nil || s.Triggered() != 1 {
+		t.Fatalf("write out of range should not trigger, triggered: %d, err: %v", s.Triggered(), err)
+	}
+
+	// a torn write writes a prefix only
+	s.Clear()
+	s.Inject(Fault{Op: FaultWrite, Kind: FaultTear})
+	n, err := s.WriteAt(bytes.Repeat([]byte{0xbb}, 1024), 0)
+	if err != ErrFaultInjected || n >= 1024 {
+		t.Fatalf("torn write should be short, n: %d, err: %v", n, err)
+	}
+	s.Clear()
+	buf := make([]byte, 1024)
+	_, err = s.ReadAt(buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], bytes.Repeat([]byte{0xbb}, n)) || buf[n] == 0xbb {
+		t.Fatalf("torn write should write %d bytes", n)
+	}
+
+	// a bit flip stays inside the range of the fault
+	s.Inject(Fault{Op: FaultRead, Kind: FaultBitFlip, Offset: 2100, Length: 10})
+	_, err = s.ReadAt(buf, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := 0
+	for i, b := range buf {
+		if b != 0xaa {
+			diff++
+			if i < 52 || i >= 62 {
+				t.Fatalf("bit flipped out of range at %d", i)
+			}
+		}
+	}
+	if diff != 1 {
+		t.Fatalf("one byte should differ, got %d", diff)
+	}
+
+	// the same seed triggers the same faults
+	pattern := func() string {
+		s := NewFaultStore(NewMemStore(4096), 42)
+		s.Inject(Fault{Op: FaultRead | FaultWrite, Kind: FaultFail, Probability: 0.3})
+		out := ""
+		for i := 0; i < 64; i++ {
+			_, err := s.ReadAt(buf[:1], 0)
+			out += fmt.Sprint(err != nil)
+		}
+		return out
+	}
+	if pattern() != pattern() {
+		t.Fatal("faults should be deterministic by seed")
+	}
+
+	s.Clear()
+	s.Inject(Fault{Op: FaultSync, Kind: FaultFail, Err: errors.New("eio")})
+	if err := s.Sync(); err == nil || err.Error() != "eio" {
+		t.Fatalf("sync should fail with the injected error, got %v", err)
+	}
+}
+
+// TestVolFaultMiss checks disk failures end in a miss or an error, never a hit of wrong data.
+func TestVolFaultMiss(t *testing.T) {
+	store := NewFaultStore(NewMemStore(1024*1024*16), 1)
+	cfg := NewMemVolOptions(1024*1024*16, 64*1024)
+	cfg.Fp = store
+	v := &Vol{}
+	_, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("value-%d,", i)), 500)
+	}
+	for i := 0; i < 20; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), value(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(i int, hit bool) {
+		got, data, _ := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if got != hit || got && !bytes.Equal(data, value(i)) {
+			t.Fatalf("key-%d hit: %v, expect: %v", i, got, hit)
+		}
+	}
+	// a flipped bit may land on bytes not checked, like header padding, then the value is still right
+	checkNotWrong := func(i int) {
+		got, data, _ := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if got && !bytes.Equal(data, value(i)) {
+			t.Fatalf("key-%d hit with wrong data", i)
+		}
+	}
+	chunkRange := func(i int) (int64, int64) {
+		_, _, d := v.Dm.Get([]byte(fmt.Sprintf("key-%d", i)))
+		return int64(d.offset()), int64(ChunkHeaderSizeFixed + len(value(i)))
+	}
+
+	// failed and torn reads miss, flipped ones never hit wrong data
+	off, size := chunkRange(0)
+	store.Inject(Fault{Op: FaultRead, Kind: FaultFail, Offset: off, Length: size})
+	check(0, false)
+	check(1, true)
+	store.Clear()
+	for i := 0; i < 50; i++ {
+		store.Inject(Fault{Op: FaultRead, Kind: FaultTear, Offset: off, Length: size})
+		check(0, false)
+		store.Clear()
+		store.Inject(Fault{Op: FaultRead, Kind: FaultBitFlip, Offset: off, Length: size})
+		checkNotWrong(0)
+		store.Clear()
+	}
+	store.Inject(Fault{Op: FaultRead, Kind: FaultDelay, Delay: time.Millisecond})
+	check(0, true)
+	store.Clear()
+
+	// a failed or torn write fails Set, the key keeps its old value or misses
+	for _, kind := range []FaultKind{FaultFail, FaultTear} {
+		store.Inject(Fault{Op: FaultWrite, Kind: kind})
+		err = v.Set([]byte("key-1"), value(100))
+		if err == nil {
+			t.Fatalf("set should fail on a %s write", kind)
+		}
+		store.Clear()
+		check(1, true)
+	}
+
+	// a write flipped on its way to disk is caught on read
+	for i := 0; i < 20; i++ {
+		store.Inject(Fault{Op: FaultWrite, Kind: FaultBitFlip, Count: 1})
+		err = v.Set([]byte(fmt.Sprintf("key-%d", i)), value(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Clear()
+		checkNotWrong(i)
+	}
+}
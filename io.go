@@ -1,9 +1,104 @@
 package bakemono
 
-import "io"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 type OffsetReaderWriterCloser interface {
 	io.WriterAt
 	io.ReaderAt
 	io.Closer
 }
+
+// Syncer is an optional capability of OffsetReaderWriterCloser, like *os.File.
+// Sync commits written data to stable storage.
+type Syncer interface {
+	Sync() error
+}
+
+// contextReaderWriterAt makes reads and writes return ctx.Err() once ctx is done.
+// A blocked IO can't be interrupted, it is abandoned and finishes in background.
+type contextReaderWriterAt struct {
+	ctx context.Context
+	rw  OffsetReaderWriterCloser
+}
+
+type ioResult struct {
+	n   int
+	err error
+}
+
+func (c contextReaderWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	if c.ctx.Done() == nil {
+		return c.rw.ReadAt(p, off)
+	}
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	// p belongs to the caller after return, read into a private buffer
+	buf := make([]byte, len(p))
+	ch := make(chan ioResult, 1)
+	go func() {
+		n, err := c.rw.ReadAt(buf, off)
+		ch <- ioResult{n, err}
+	}()
+	select {
+	case res := <-ch:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
+
+func (c contextReaderWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if c.ctx.Done() == nil {
+		return c.rw.WriteAt(p, off)
+	}
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	buf := append([]byte(nil), p...)
+	ch := make(chan ioResult, 1)
+	go func() {
+		n, err := c.rw.WriteAt(buf, off)
+		ch <- ioResult{n, err}
+	}()
+	select {
+	case res := <-ch:
+		return res.n, res.err
+	case <-c.ctx.Done():
+		return 0, c.ctx.Err()
+	}
+}
+
+// lockContext acquires a lock, or returns ctx.Err() once ctx is done.
+// sync.RWMutex can't be interrupted, so it polls with tryLock while ctx is cancelable.
+func lockContext(ctx context.Context, tryLock func() bool, lock func()) error {
+	if tryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	wait := 10 * time.Microsecond
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if tryLock() {
+			return nil
+		}
+		if wait < time.Millisecond {
+			wait *= 2
+		}
+		timer.Reset(wait)
+	}
+}
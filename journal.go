@@ -0,0 +1,365 @@
+package bakemono
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"sync"
+)
+
+// JournalRecordSize is the fixed size of a journal record on disk.
+const JournalRecordSize = 40
+
+// journal record types
+const (
+	journalSet    = 1
+	journalDelete = 2
+	journalEvict  = 3
+	// journalInvalid marks the journal from its seq invalid, see journal.append
+	journalInvalid = 4
+)
+
+// journalRecord is a dir mutation, addressed by hash position instead of key.
+// Replaying records in seq order on top of the meta snapshot rebuilds the dirs.
+//
+// binary layout, big endian:
+//
+//	seq(8) type(1) reserved(1) tag(2) segment(4) bucket(4) offset(8) size(4) reserved(4) crc(4)
+//
+// for journalEvict, bucket is the bucket kept, size is the purge modulus and tag is the random index.
+type journalRecord struct {
+	Seq     uint64
+	Type    uint8
+	Tag     uint16
+	Segment uint32
+	Bucket  uint32
+	Offset  uint64
+	Size    uint32
+}
+
+func (r *journalRecord) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, JournalRecordSize)
+	binary.BigEndian.PutUint64(data[0:], r.Seq)
+	data[8] = r.Type
+	binary.BigEndian.PutUint16(data[10:], r.Tag)
+	binary.BigEndian.PutUint32(data[12:], r.Segment)
+	binary.BigEndian.PutUint32(data[16:], r.Bucket)
+	binary.BigEndian.PutUint64(data[20:], r.Offset)
+	binary.BigEndian.PutUint32(data[28:], r.Size)
+	binary.BigEndian.PutUint32(data[36:], crc32.ChecksumIEEE(data[:36]))
+	return data, nil
+}
+
+func (r *journalRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < JournalRecordSize {
+		return ErrJournalRecordInvalid
+	}
+	if binary.BigEndian.Uint32(data[36:]) != crc32.ChecksumIEEE(data[:36]) {
+		return ErrJournalRecordInvalid
+	}
+	r.Seq = binary.BigEndian.Uint64(data[0:])
+	r.Type = data[8]
+	r.Tag = binary.BigEndian.Uint16(data[10:])
+	r.Segment = binary.BigEndian.Uint32(data[12:])
+	r.Bucket = binary.BigEndian.Uint32(data[16:])
+	r.Offset = binary.BigEndian.Uint64(data[20:])
+	r.Size = binary.BigEndian.Uint32(data[28:])
+	if r.Type < journalSet || r.Type > journalInvalid {
+		return ErrJournalRecordInvalid
+	}
+	return nil
+}
+
+// journal is a ring of records in a reserved region of the vol.
+// Records from startSeq are not covered by the meta on disk yet, and are never overwritten.
+// Record of seq is at slot (startPos + seq - startSeq) % slots.
+type journal struct {
+	fp    OffsetReaderWriterCloser
+	off   Offset
+	slots uint64
+
+	// mu guards fields below
+	mu       sync.Mutex
+	startSeq uint64
+	startPos uint64
+	nextSeq  uint64
+	pending  []byte // encoded records not written yet, from pendSeq
+	pendSeq  uint64
+	// full is set once a record is dropped, the journal is invalid until a meta flush
+	// checkpointed after the last drop.
+	full      bool
+	drops     uint64
+	ckptDrops uint64
+	// sealed while a flush writes a header starting the journal at sealSeq
+	sealed  bool
+	sealSeq uint64
+	// markSeq is the seq of invalid markers, the biggest start marked so far.
+	// marked is the markSeq each slot is marked with, by the seq of the slot.
+	markSeq uint64
+	marked  map[uint64]uint64
+	// marks are offsets of markers over records written already, to write again
+	marks []Offset
+
+	// writeMu serializes writes to disk, so records land in seq order
+	writeMu sync.Mutex
+
+	// fullCh is notified when the ring is full, a meta flush frees it.
+	fullCh chan struct{}
+}
+
+func newJournal(fp OffsetReaderWriterCloser, off, size Offset) *journal {
+	return &journal{
+		fp:     fp,
+		off:    off,
+		slots:  uint64(size / JournalRecordSize),
+		fullCh: make(chan struct{}, 1),
+		marked: make(map[uint64]uint64),
+	}
+}
+
+// reset starts an empty journal at the given position.
+func (j *journal) reset(seq, pos uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.startSeq, j.startPos = seq, pos%j.slots
+	j.nextSeq, j.pendSeq = seq, seq
+	j.pending = nil
+	j.full = false
+	j.drops, j.ckptDrops = 0, 0
+	j.sealed = false
+	j.markSeq = 0
+	j.marked = make(map[uint64]uint64)
+	j.marks = nil
+}
+
+// slotOffset returns the disk offset of the record of seq. j.mu must be held.
+func (j *journal) slotOffset(seq uint64) Offset {
+	return j.off + Offset((j.startPos+seq-j.startSeq)%j.slots)*JournalRecordSize
+}
+
+// append assigns seq to the record and buffers it. Called under the segment lock,
+// so records of a segment are in the same order as mutations.
+// Records are dropped when the ring is full. A dropped mutation may be in neither meta nor journal,
+// so the start of the journal is overwritten by an invalid marker, and Init resets dirs instead of replaying it.
+// A meta flush checkpointed after the last drop makes the journal valid again.
+func (j *journal) append(r journalRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.nextSeq-j.startSeq >= j.slots {
+		if !j.full {
+			j.full = true
+			log.Printf("warn: journal is full, records are dropped and the journal is invalid until next meta flush")
+		}
+		j.drops++
+		j.mark(j.startSeq)
+		if j.sealed {
+			// the header being flushed may point to the new start already
+			j.mark(j.sealSeq)
+		}
+		select {
+		case j.fullCh <- struct{}{}:
+		default:
+		}
+		return
+	}
+	r.Seq = j.nextSeq
+	j.nextSeq++
+	data, _ := r.MarshalBinary()
+	j.pending = append(j.pending, data...)
+}
+
+// mark writes an invalid marker in the slot of seq at, replay from at stops there with ErrJournalInvalid.
+// Markers carry the biggest seq marked, as starts may share a slot, and a valid start is always after it.
+// A marker of a seq not assigned yet takes it, so no record overwrites it. j.mu must be held.
+func (j *journal) mark(at uint64) {
+	if at > j.markSeq {
+		j.markSeq = at
+	}
+	if m, ok := j.marked[at]; ok && m == j.markSeq {
+		return
+	}
+	j.marked[at] = j.markSeq
+	r := journalRecord{Seq: j.markSeq, Type: journalInvalid}
+	data, _ := r.MarshalBinary()
+	switch {
+	case at == j.nextSeq:
+		j.pending = append(j.pending, data...)
+		j.nextSeq++
+	case at >= j.pendSeq:
+		copy(j.pending[(at-j.pendSeq)*JournalRecordSize:], data)
+	default:
+		// the record is written, or being written under writeMu, write the marker after it
+		j.marks = append(j.marks, j.slotOffset(at))
+	}
+}
+
+// write writes pending records to disk.
+func (j *journal) write() error {
+	if j == nil {
+		return nil
+	}
+	j.writeMu.Lock()
+	defer j.writeMu.Unlock()
+
+	j.mu.Lock()
+	data, seq := j.pending, j.pendSeq
+	j.pending = nil
+	j.pendSeq = j.nextSeq
+	// offsets are calculated under lock, start moves only after records are covered by meta
+	type span struct {
+		off  Offset
+		data []byte
+	}
+	var spans []span
+	if seq < j.startSeq {
+		// covered by meta already
+		skip := (j.startSeq - seq) * JournalRecordSize
+		if skip > uint64(len(data)) {
+			skip = uint64(len(data))
+		}
+		data = data[skip:]
+		seq += skip / JournalRecordSize
+	}
+	for len(data) > 0 {
+		off := j.slotOffset(seq)
+		n := (j.slots - (j.startPos+seq-j.startSeq)%j.slots) * JournalRecordSize
+		if n > uint64(len(data)) {
+			n = uint64(len(data))
+		}
+		spans = append(spans, span{off, data[:n]})
+		data = data[n:]
+		seq += n / JournalRecordSize
+	}
+	if len(j.marks) > 0 {
+		r := journalRecord{Seq: j.markSeq, Type: journalInvalid}
+		marker, _ := r.MarshalBinary()
+		for _, off := range j.marks {
+			spans = append(spans, span{off, marker})
+		}
+		j.marks = nil
+	}
+	j.mu.Unlock()
+
+	for _, s := range spans {
+		_, err := j.fp.WriteAt(s.data, int64(s.off))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint returns the position of the next record.
+// Mutations before it are in any meta snapshot taken afterwards.
+func (j *journal) checkpoint() (seq, pos uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.ckptDrops = j.drops
+	return j.nextSeq, (j.startPos + j.nextSeq - j.startSeq) % j.slots
+}
+
+// seal is called before a flush writes the header starting the journal at seq, and its markers must be written then.
+// Records dropped after the checkpoint are lost from seq too, so seq is marked invalid as well.
+func (j *journal) seal(seq uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sealed, j.sealSeq = true, seq
+	if j.drops != j.ckptDrops {
+		j.mark(seq)
+	}
+}
+
+// unseal is called when the flush fails to write the header.
+func (j *journal) unseal() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.sealed = false
+}
+
+// truncate drops records before seq, after meta covering them is flushed.
+// The journal stays invalid if records were dropped after the checkpoint.
+func (j *journal) truncate(seq, pos uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.startSeq, j.startPos = seq, pos
+	j.sealed = false
+	j.full = j.drops != j.ckptDrops
+	for at := range j.marked {
+		if at < seq {
+			delete(j.marked, at)
+		}
+	}
+}
+
+// replay reads records from the start, and calls fn for each one until the chain breaks.
+// The chain breaks at a torn or stale record, which has a bad checksum or an unexpected seq.
+// It returns ErrJournalInvalid at an invalid marker, which is stale only if its seq is before the expected one.
+func (j *journal) replay(fn func(r journalRecord)) (n uint64, err error) {
+	raw := make([]byte, j.slots*JournalRecordSize)
+	_, err = j.fp.ReadAt(raw, int64(j.off))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	err = nil
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	seq := j.startSeq
+	for n = 0; n < j.slots; n++ {
+		slot := (j.startPos + n) % j.slots
+		r := journalRecord{}
+		if r.UnmarshalBinary(raw[slot*JournalRecordSize:]) != nil {
+			break
+		}
+		if r.Type == journalInvalid && r.Seq >= seq {
+			err = ErrJournalInvalid
+			break
+		}
+		if r.Seq != seq {
+			break
+		}
+		fn(r)
+		seq++
+	}
+	// keep replayed records, they are still not covered by meta on disk
+	j.nextSeq, j.pendSeq = seq, seq
+	return n, err
+}
+
+// newDir makes a used dir pointing to a chunk.
+func newDir(tag uint16, off Offset, size int) Dir {
+	dir := Dir{}
+	dir.setOffset(uint64(off))
+	dir.setApproxSize(uint64(size))
+	dir.setHead(true)
+	dir.setTag(tag)
+	return dir
+}
+
+// applyJournalRecord replays a journal record. Records pointing out of range are ignored.
+func (dm *DirManager) applyJournalRecord(r journalRecord) {
+	if Offset(r.Segment) >= dm.SegmentsNum || Offset(r.Bucket) >= dm.BucketsNumPerSegment {
+		return
+	}
+	segmentId, bucketId := segId(r.Segment), Offset(r.Bucket)
+	dm.SegMutexes[segmentId].Lock()
+	defer dm.SegMutexes[segmentId].Unlock()
+
+	switch r.Type {
+	case journalSet:
+		_, _ = dm.dirInsert(r.Tag, segmentId, bucketId, newDir(r.Tag, Offset(r.Offset), int(r.Size)))
+	case journalDelete:
+		hit, dirOffset, d, err := dirProbe(r.Tag, bucketId, dm.Dirs[segmentId])
+		if err == nil && hit && d.offset() == r.Offset {
+			_ = dm.dirDelete(segmentId, bucketId, dirOffset)
+		}
+	case journalEvict:
+		if r.Size > 0 {
+			dm.purgeBuckets(segmentId, bucketId, Offset(r.Size), Offset(r.Tag))
+		}
+	}
+}
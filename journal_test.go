@@ -0,0 +1,182 @@
+package bakemono
+
+import (
+	"os"
+	"testing"
+)
+
+func TestJournalRecord_Marshal_Unmarshal(t *testing.T) {
+	r := journalRecord{Seq: 1<<40 + 3, Type: journalSet, Tag: 0xabc, Segment: 7, Bucket: 1234, Offset: 1 << 33, Size: 8200}
+	data, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != JournalRecordSize {
+		t.Fatalf("record size should be %d, got %d", JournalRecordSize, len(data))
+	}
+	r2 := journalRecord{}
+	err = r2.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2 != r {
+		t.Fatalf("record mismatch: %+v, expect %+v", r2, r)
+	}
+
+	data[20] ^= 1
+	err = r2.UnmarshalBinary(data)
+	if err != ErrJournalRecordInvalid {
+		t.Fatalf("torn record should be invalid, err: %v", err)
+	}
+	err = r2.UnmarshalBinary(make([]byte, JournalRecordSize))
+	if err != ErrJournalRecordInvalid {
+		t.Fatalf("zero record should be invalid, err: %v", err)
+	}
+}
+
+func TestDirManager_ApplyJournalRecord(t *testing.T) {
+	dm := &DirManager{}
+	dm.Init(1000)
+
+	var records []journalRecord
+	dm.journal = newJournal(nil, 0, 1000*JournalRecordSize)
+	dm.journal.reset(100, 0)
+	for i := 0; i < 300; i++ {
+		_, err := dm.Set([]byte{byte(i), byte(i >> 8)}, Offset(i+1)*4096, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		dm.Delete([]byte{byte(i), byte(i >> 8)})
+	}
+	dm.purgeRandom10(0, 0)
+
+	data := dm.journal.pending
+	for len(data) > 0 {
+		r := journalRecord{}
+		err := r.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+		data = data[JournalRecordSize:]
+	}
+	if records[0].Seq != 100 {
+		t.Fatalf("first record seq should be 100, got %d", records[0].Seq)
+	}
+
+	replayed := &DirManager{}
+	replayed.Init(1000)
+	for _, r := range records {
+		replayed.applyJournalRecord(r)
+	}
+	for i := 0; i < 300; i++ {
+		key := []byte{byte(i), byte(i >> 8)}
+		hit, _, d := dm.Get(key)
+		hit2, _, d2 := replayed.Get(key)
+		if hit != hit2 || d.offset() != d2.offset() {
+			t.Fatalf("key %d mismatch after replay, hit: %v/%v, offset: %d/%d", i, hit, hit2, d.offset(), d2.offset())
+		}
+	}
+}
+
+func TestJournal_FullAndReplay(t *testing.T) {
+	path := "/tmp/bakemono-test-journal-ring.bin"
+	defer os.Remove(path)
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	j := newJournal(fp, 4096, 8*JournalRecordSize)
+	j.reset(1000, 5)
+	for i := 0; i < 12; i++ {
+		j.append(journalRecord{Type: journalSet, Offset: uint64(i)})
+	}
+	select {
+	case <-j.fullCh:
+	default:
+		t.Fatal("full journal should notify")
+	}
+	err = j.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ones after full are dropped, so the journal is invalid
+	j2 := newJournal(fp, 4096, 8*JournalRecordSize)
+	j2.reset(1000, 5)
+	var offsets []uint64
+	n, err := j2.replay(func(r journalRecord) {
+		offsets = append(offsets, r.Offset)
+	})
+	if err != ErrJournalInvalid || n != 0 {
+		t.Fatalf("replay of a journal dropping records should be invalid, got %d records, err: %v", n, err)
+	}
+
+	// after truncate, new records overwrite the old ones, stale records stop the replay
+	seq, pos := j.checkpoint()
+	j.truncate(seq, pos)
+	j.append(journalRecord{Type: journalDelete, Offset: 100})
+	err = j.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j3 := newJournal(fp, 4096, 8*JournalRecordSize)
+	j3.reset(seq, pos)
+	offsets = offsets[:0]
+	n, err = j3.replay(func(r journalRecord) {
+		offsets = append(offsets, r.Offset)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || offsets[0] != 100 {
+		t.Fatalf("should replay 1 record after truncate, got %d: %v", n, offsets)
+	}
+
+	// a record dropped after the checkpoint keeps the journal invalid from the new start too
+	for i := 0; i < 8; i++ {
+		j.append(journalRecord{Type: journalSet, Offset: uint64(i)})
+	}
+	oldSeq, oldPos := seq, pos
+	seq, pos = j.checkpoint()
+	j.append(journalRecord{Type: journalSet, Offset: 200})
+	j.seal(seq)
+	err = j.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.truncate(seq, pos)
+	if !j.full {
+		t.Fatal("journal should stay invalid after truncate")
+	}
+	for _, start := range [][2]uint64{{oldSeq, oldPos}, {seq, pos}} {
+		j4 := newJournal(fp, 4096, 8*JournalRecordSize)
+		j4.reset(start[0], start[1])
+		_, err = j4.replay(func(r journalRecord) {})
+		if err != ErrJournalInvalid {
+			t.Fatalf("replay from %d should be invalid, got %v", start[0], err)
+		}
+	}
+
+	// a flush checkpointed after the last drop makes it valid again
+	seq, pos = j.checkpoint()
+	j.truncate(seq, pos)
+	j.append(journalRecord{Type: journalDelete, Offset: 300})
+	err = j.write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j5 := newJournal(fp, 4096, 8*JournalRecordSize)
+	j5.reset(seq, pos)
+	offsets = offsets[:0]
+	n, err = j5.replay(func(r journalRecord) {
+		offsets = append(offsets, r.Offset)
+	})
+	if err != nil || n != 1 || offsets[0] != 300 {
+		t.Fatalf("should replay 1 record once valid again, got %d: %v, err: %v", n, offsets, err)
+	}
+}
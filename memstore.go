@@ -0,0 +1,168 @@
+package bakemono
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// MemStore is an OffsetReaderWriterCloser in memory, it behaves like a file truncated to its size.
+// Writes past the end grow it. It implements Syncer and Truncate, and is safe for concurrent use.
+type MemStore struct {
+	mu      sync.RWMutex
+	data    []byte
+	closed  bool
+	record  bool
+	records []MemWrite
+}
+
+// MemWrite is a WriteAt or a Sync recorded by MemStore.Record. Data is nil for a Sync.
+type MemWrite struct {
+	Off  int64
+	Data []byte
+	Sync bool
+}
+
+// NewMemStore creates a zeroed MemStore of size bytes.
+func NewMemStore(size int64) *MemStore {
+	return &MemStore{data: make([]byte, size)}
+}
+
+// NewMemStoreFrom creates a MemStore with a copy of data.
+func NewMemStoreFrom(data []byte) *MemStore {
+	return &MemStore{data: append([]byte(nil), data...)}
+}
+
+// NewMemVolOptions creates a VolOptions on a new MemStore, like NewDefaultVolOptions does on a file.
+func NewMemVolOptions(fileSize, avgChunkSize uint64) *VolOptions {
+	return &VolOptions{
+		Fp:                NewMemStore(int64(fileSize)),
+		FileSize:          Offset(fileSize),
+		ChunkAvgSize:      Offset(avgChunkSize),
+		FlushMetaInterval: 60 * time.Second,
+	}
+}
+
+func (m *MemStore) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return 0, ErrStoreClosed
+	}
+	if off < 0 {
+		return 0, errors.New("memstore: negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MemStore) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrStoreClosed
+	}
+	if off < 0 {
+		return 0, errors.New("memstore: negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.grow(end)
+	}
+	if m.record {
+		m.records = append(m.records, MemWrite{Off: off, Data: append([]byte(nil), p...)})
+	}
+	return copy(m.data[off:], p), nil
+}
+
+// grow extends data to size with zeros. m.mu must be held.
+func (m *MemStore) grow(size int64) {
+	if size <= int64(cap(m.data)) {
+		m.data = m.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, m.data)
+	m.data = data
+}
+
+// Truncate changes the size, like os.File.Truncate.
+func (m *MemStore) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	if size < 0 {
+		return errors.New("memstore: negative size")
+	}
+	if size < int64(len(m.data)) {
+		// zero the cut tail, it may be grown back
+		tail := m.data[size:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		m.data = m.data[:size]
+		return nil
+	}
+	m.grow(size)
+	return nil
+}
+
+// Sync does nothing, every write is already visible. It is only recorded.
+func (m *MemStore) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	if m.record {
+		m.records = append(m.records, MemWrite{Sync: true})
+	}
+	return nil
+}
+
+// Record starts recording every WriteAt and Sync in order, e.g. to replay them up to a crash point.
+func (m *MemStore) Record() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record = true
+}
+
+// Records returns what was recorded since Record.
+func (m *MemStore) Records() []MemWrite {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]MemWrite(nil), m.records...)
+}
+
+// Close makes further calls fail with ErrStoreClosed. Bytes still returns the content.
+func (m *MemStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrStoreClosed
+	}
+	m.closed = true
+	return nil
+}
+
+// Size returns the size in bytes.
+func (m *MemStore) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.data))
+}
+
+// Bytes returns a copy of the content, e.g. to reopen it in a new MemStore after Close.
+func (m *MemStore) Bytes() []byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]byte(nil), m.data...)
+}
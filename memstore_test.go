@@ -0,0 +1,94 @@
+package bakemono
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	m := NewMemStore(8)
+	n, err := m.WriteAt([]byte("bocchi"), 4)
+	if err != nil || n != 6 || m.Size() != 10 {
+		t.Fatalf("write past the end should grow, n: %d, size: %d, err: %v", n, m.Size(), err)
+	}
+	buf := make([]byte, 8)
+	n, err = m.ReadAt(buf, 4)
+	if err != io.EOF || n != 6 || string(buf[:n]) != "bocchi" {
+		t.Fatalf("short read should return io.EOF, n: %d, err: %v", n, err)
+	}
+	_, err = m.ReadAt(buf, 10)
+	if err != io.EOF {
+		t.Fatalf("read at the end should return io.EOF, got %v", err)
+	}
+
+	err = m.Truncate(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Truncate(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Bytes(), []byte("\x00\x00\x00\x00bo\x00\x00\x00\x00")) {
+		t.Fatalf("truncated tail should be zeroed, got %q", m.Bytes())
+	}
+
+	m.Record()
+	_, _ = m.WriteAt([]byte("kita"), 0)
+	_ = m.Sync()
+	records := m.Records()
+	if len(records) != 2 || records[0].Off != 0 || string(records[0].Data) != "kita" || !records[1].Sync {
+		t.Fatalf("write and sync should be recorded in order, got %+v", records)
+	}
+
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.ReadAt(buf, 0)
+	if err != ErrStoreClosed {
+		t.Fatalf("read after close should fail, got %v", err)
+	}
+	if m.Size() != 10 {
+		t.Fatal("content should stay after close")
+	}
+}
+
+func TestVolMemStore(t *testing.T) {
+	cfg := NewMemVolOptions(1024*1024*16, 64*1024)
+	cfg.Durability = DurabilityWrite
+	v := &Vol{}
+	_, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the content in a new store
+	image := cfg.Fp.(*MemStore).Bytes()
+	cfg = NewMemVolOptions(1024*1024*16, 64*1024)
+	cfg.Fp = NewMemStoreFrom(image)
+	v = &Vol{}
+	corrupted, err := v.Init(cfg)
+	if err != nil || corrupted {
+		t.Fatalf("reopen failed, corrupted: %v, err: %v", corrupted, err)
+	}
+	defer v.Close()
+	for i := 0; i < 100; i++ {
+		hit, data, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil || !hit || string(data) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("key-%d should hit after reopen, hit: %v, err: %v", i, hit, err)
+		}
+	}
+}
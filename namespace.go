@@ -0,0 +1,280 @@
+package bakemono
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// MaxNamespaces is the number of namespace generations kept in the vol header.
+// Only invalidated namespaces take a slot, until DropNamespace frees it.
+// Use PurgeTag to purge an unbounded set like tenants or hosts.
+const MaxNamespaces = 128
+
+// NamespaceGeneration is the generation of a namespace in the vol header, 0 NameHash means an empty slot.
+// A freed slot keeps its generation, so generations handed out stay unique in the vol.
+type NamespaceGeneration struct {
+	NameHash   uint64
+	Generation uint64
+}
+
+// Namespace is a handle to keys under a name, see Vol.Namespace.
+type Namespace struct {
+	v    *Vol
+	name string
+}
+
+// Namespace returns a handle to keys under name. Keys are stored with the current generation of name,
+// so InvalidateNamespace makes all of them miss at once. Old chunks are reclaimed as the data ring wraps.
+func (v *Vol) Namespace(name string) *Namespace {
+	return &Namespace{v: v, name: name}
+}
+
+// InvalidateNamespace moves name to a new generation, keys set before miss from now on.
+// Meta is flushed at once, so it survives a crash.
+// Returns ErrNamespaceFull if name is new and all MaxNamespaces slots are taken, see DropNamespace.
+// Names invalidated before keep working.
+func (v *Vol) InvalidateNamespace(name string) error {
+	if v.readOnly {
+		return ErrVolReadOnly
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	v.flushMu.Lock()
+	h := namespaceHash(name)
+	slot := -1
+	for i, g := range v.Header.Namespaces {
+		if g.NameHash == h {
+			slot = i
+			break
+		}
+		if g.NameHash == 0 && slot < 0 {
+			slot = i
+		}
+	}
+	if slot < 0 {
+		v.flushMu.Unlock()
+		return ErrNamespaceFull
+	}
+	v.nsMu.Lock()
+	v.Header.Namespaces[slot] = NamespaceGeneration{NameHash: h, Generation: v.nextNamespaceGeneration()}
+	v.nsMu.Unlock()
+	v.flushMu.Unlock()
+
+	// on error the generation stays bumped in memory, the next flush writes it again
+	return v.flushMetaToFp()
+}
+
+// DropNamespace deletes every key of name from dirs, and frees its slot for another name.
+// Every used dir is confirmed by reading its chunk header, like Range, so it takes a while on a big vol.
+// Keys of name set meanwhile may be kept, and miss once the slot is freed: generations are never handed out again,
+// and name starts over from generation 0, with no key of it left in dirs.
+// A chunk header failing to read keeps the slot, call it again. Returns the number of keys deleted.
+func (v *Vol) DropNamespace(ctx context.Context, name string) (dropped int, err error) {
+	if v.readOnly {
+		return 0, ErrVolReadOnly
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+
+	for seg := segId(0); Offset(seg) < v.Dm.SegmentsNum; seg++ {
+		for _, e := range v.Dm.usedDirs(seg) {
+			err = ctx.Err()
+			if err != nil {
+				return dropped, err
+			}
+			_, key, err := v.readChunkHeader(contextReaderWriterAt{ctx, v.Fp}, Offset(e.d.offset()))
+			if err == ErrChunkVerifyFailed {
+				// never hits, Get verifies the chunk too
+				continue
+			}
+			if err != nil {
+				return dropped, err
+			}
+			if keyName, _, ok := namespaceOfKey(key); !ok || keyName != name {
+				continue
+			}
+			tag, keySeg, bucket := calcDirHashPosition(key, v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+			if keySeg == seg && v.Dm.deleteDir(seg, bucket, tag, e.d.offset()) {
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 {
+		v.writeJournal()
+	}
+
+	h := namespaceHash(name)
+	v.flushMu.Lock()
+	v.nsMu.Lock()
+	freed := false
+	for i, g := range v.Header.Namespaces {
+		if g.NameHash == h {
+			v.Header.Namespaces[i].NameHash = 0
+			freed = true
+			break
+		}
+	}
+	v.nsMu.Unlock()
+	v.flushMu.Unlock()
+	if !freed {
+		return dropped, nil
+	}
+	return dropped, v.flushMetaToFp()
+}
+
+// nextNamespaceGeneration returns a generation above every one handed out, freed slots included. nsMu must be held.
+func (v *Vol) nextNamespaceGeneration() uint64 {
+	var gen uint64
+	for _, g := range v.Header.Namespaces {
+		if g.Generation > gen {
+			gen = g.Generation
+		}
+	}
+	return gen + 1
+}
+
+// namespaceGeneration returns the current generation of name, 0 if never invalidated.
+func (v *Vol) namespaceGeneration(name string) uint64 {
+	h := namespaceHash(name)
+	v.nsMu.RLock()
+	defer v.nsMu.RUnlock()
+	for _, g := range v.Header.Namespaces {
+		if g.NameHash == h {
+			return g.Generation
+		}
+	}
+	return 0
+}
+
+func namespaceHash(name string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(name))
+	h := f.Sum64()
+	if h == 0 {
+		h = 1
+	}
+	return h
+}
+
+// key returns the key in vol: "\x00ns:" + name + "#" + generation + "\x00" + key.
+func (ns *Namespace) key(key []byte) []byte {
+	gen := ns.v.namespaceGeneration(ns.name)
+	b := make([]byte, 0, len(ns.name)+len(key)+24)
+	b = append(b, "\x00ns:"...)
+	b = append(b, ns.name...)
+	b = append(b, '#')
+	b = strconv.AppendUint(b, gen, 10)
+	b = append(b, 0)
+	return append(b, key...)
+}
+
+// namespaceOfKey parses name and generation from a key in vol of a namespace.
+func namespaceOfKey(key []byte) (name string, gen uint64, ok bool) {
+	name, gen, _, ok = splitNamespaceKey(key)
+	return name, gen, ok
+}
+
+// splitNamespaceKey parses a key in vol of a namespace, rest is the key in the namespace.
+func splitNamespaceKey(key []byte) (name string, gen uint64, rest []byte, ok bool) {
+	s := string(key)
+	if !strings.HasPrefix(s, "\x00ns:") {
+		return "", 0, nil, false
+	}
+	s = s[len("\x00ns:"):]
+	end := strings.IndexByte(s, 0)
+	if end < 0 {
+		return "", 0, nil, false
+	}
+	sep := strings.LastIndexByte(s[:end], '#')
+	if sep < 0 {
+		return "", 0, nil, false
+	}
+	gen, err := strconv.ParseUint(s[sep+1:end], 10, 64)
+	if err != nil {
+		return "", 0, nil, false
+	}
+	return s[:sep], gen, []byte(s[end+1:]), true
+}
+
+// recoverNamespaceKey moves the namespace of a key recovered from data past its generation.
+// Generations in the header are lost then, a key of an invalidated generation must not hit again.
+// Keys of the current generation miss too, it is a cache.
+func (v *Vol) recoverNamespaceKey(key []byte) {
+	name, gen, ok := namespaceOfKey(key)
+	if !ok {
+		return
+	}
+	h := namespaceHash(name)
+	v.nsMu.Lock()
+	defer v.nsMu.Unlock()
+	slot := -1
+	for i, g := range v.Header.Namespaces {
+		if g.NameHash == h {
+			if g.Generation > gen {
+				return
+			}
+			slot = i
+			break
+		}
+		if g.NameHash == 0 && slot < 0 {
+			slot = i
+		}
+	}
+	if slot >= 0 {
+		next := v.nextNamespaceGeneration()
+		if next <= gen {
+			next = gen + 1
+		}
+		v.Header.Namespaces[slot] = NamespaceGeneration{NameHash: h, Generation: next}
+		return
+	}
+	log.Printf("warn: no slot for namespace %s recovered, keys of invalidated generations may hit", name)
+}
+
+// Name returns the name of the namespace.
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Invalidate calls Vol.InvalidateNamespace.
+func (ns *Namespace) Invalidate() error {
+	return ns.v.InvalidateNamespace(ns.name)
+}
+
+// Drop calls Vol.DropNamespace.
+func (ns *Namespace) Drop(ctx context.Context) (dropped int, err error) {
+	return ns.v.DropNamespace(ctx, ns.name)
+}
+
+// Set calls Vol.Set with the key in the namespace.
+func (ns *Namespace) Set(key, value []byte) error {
+	return ns.v.Set(ns.key(key), value)
+}
+
+// SetWithMeta calls Vol.SetWithMeta with the key in the namespace.
+func (ns *Namespace) SetWithMeta(key, value []byte, meta *ObjectMeta) error {
+	return ns.v.SetWithMeta(ns.key(key), value, meta)
+}
+
+// Get calls Vol.Get with the key in the namespace.
+func (ns *Namespace) Get(key []byte) (hit bool, value []byte, err error) {
+	return ns.v.Get(ns.key(key))
+}
+
+// Stat calls Vol.Stat with the key in the namespace.
+func (ns *Namespace) Stat(key []byte) (hit bool, info ObjectInfo, err error) {
+	return ns.v.Stat(ns.key(key))
+}
+
+// Exists calls Vol.Exists with the key in the namespace.
+func (ns *Namespace) Exists(key []byte) bool {
+	return ns.v.Exists(ns.key(key))
+}
+
+// Delete calls Vol.Delete with the key in the namespace.
+func (ns *Namespace) Delete(key []byte) error {
+	return ns.v.Delete(ns.key(key))
+}
@@ -0,0 +1,185 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestNamespaceOfKey(t *testing.T) {
+	ns := &Namespace{v: &Vol{Header: &VolHeaderFooter{}}, name: "host#1"}
+	name, gen, ok := namespaceOfKey(ns.key([]byte("/a#b")))
+	if !ok || name != "host#1" || gen != 0 {
+		t.Fatal("parse namespace key failed", name, gen, ok)
+	}
+	_, _, ok = namespaceOfKey([]byte("plain"))
+	if ok {
+		t.Fatal("plain key is not in a namespace")
+	}
+}
+
+func TestVolNamespaceInvalidate(t *testing.T) {
+	path := "/tmp/bakemono-test-ns.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+
+	a, b := v.Namespace("a.com"), v.Namespace("b.com")
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("/obj-%d", i))
+		if err := a.Set(key, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Set(key, []byte("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hit, value, err := a.Get([]byte("/obj-1"))
+	if err != nil || !hit || string(value) != "a" {
+		t.Fatal("namespace a should hit", hit, err)
+	}
+
+	err = v.InvalidateNamespace("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("/obj-%d", i))
+		if hit, _, _ := a.Get(key); hit {
+			t.Fatal("namespace a should miss after invalidate")
+		}
+		if hit, _, _ := b.Get(key); !hit {
+			t.Fatal("namespace b should still hit")
+		}
+	}
+	err = a.Set([]byte("/new"), []byte("a2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the generation is on disk at once, open the file as it is after a crash
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := &Vol{}
+	_, err = v2.Init(&VolOptions{Fp: fp, FileSize: 1024 * 1024 * 100, ChunkAvgSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.namespaceGeneration("a.com") != 1 || v2.namespaceGeneration("b.com") != 0 {
+		t.Fatal("generations should be persisted")
+	}
+	_ = v2.Close()
+
+	// generations survive recovery from data with the header lost
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptVolMeta(t, v, path)
+	v, _ = openRecoverTestingVol(t, path, 1024*1024*100, 1024*1024, &RecoverOptions{})
+	defer v.Close()
+	a = v.Namespace("a.com")
+	if hit, _, _ := a.Get([]byte("/obj-1")); hit {
+		t.Fatal("invalidated key should not hit after recovery")
+	}
+	if v.namespaceGeneration("a.com") <= 1 {
+		t.Fatal("generation should move past recovered keys", v.namespaceGeneration("a.com"))
+	}
+}
+
+func TestVolNamespaceFull(t *testing.T) {
+	path := "/tmp/bakemono-test-ns-full.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	defer v.Close()
+
+	for i := 0; i < MaxNamespaces; i++ {
+		err := v.InvalidateNamespace(fmt.Sprintf("ns-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := v.InvalidateNamespace("ns-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.InvalidateNamespace("one-more")
+	if err != ErrNamespaceFull {
+		t.Fatal(err)
+	}
+}
+
+func TestVolNamespaceDrop(t *testing.T) {
+	path := "/tmp/bakemono-test-ns-drop.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*64, 64*1024)
+	defer v.Close()
+
+	plain := []byte("plain")
+	err := v.Set(plain, []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more names than slots take a slot and free it, the last ones are reused
+	names := MaxNamespaces + 16
+	for i := 0; i < names+16; i++ {
+		ns := v.Namespace(fmt.Sprintf("ns-%d", i%names))
+		err := ns.Set([]byte("/before"), []byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ns.Invalidate()
+		if err != nil {
+			t.Fatalf("invalidate %s: %v", ns.Name(), err)
+		}
+		err = ns.Set([]byte("/after"), []byte("after"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped, err := ns.Drop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a reused name also has the key set after its last drop
+		want := 2
+		if i >= names {
+			want = 3
+		}
+		if dropped != want {
+			t.Fatalf("drop %s should delete %d keys, got %d", ns.Name(), want, dropped)
+		}
+		for _, key := range []string{"/before", "/after"} {
+			if hit, _, _ := ns.Get([]byte(key)); hit {
+				t.Fatalf("key %s of %s should miss after drop", key, ns.Name())
+			}
+		}
+		// keys of the name set from now on hit again
+		err = ns.Set([]byte("/new"), []byte("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit, data, _ := ns.Get([]byte("/new")); !hit || string(data) != "new" {
+			t.Fatalf("key of %s set after drop should hit", ns.Name())
+		}
+	}
+	if hit, _, _ := v.Get(plain); !hit {
+		t.Fatal("key out of namespaces should be kept")
+	}
+
+	// generations handed out are unique, an invalidated name never gets an older one back
+	seen := make(map[uint64]bool)
+	for i := 0; i < MaxNamespaces; i++ {
+		name := fmt.Sprintf("ns-%d", i)
+		err := v.InvalidateNamespace(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen := v.namespaceGeneration(name)
+		if gen <= uint64(names+16) || seen[gen] {
+			t.Fatalf("generation %d of %s should be new", gen, name)
+		}
+		seen[gen] = true
+	}
+}
@@ -0,0 +1,165 @@
+package bakemono
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// MetaType is the type of an attribute in the metadata section of a chunk header.
+type MetaType uint8
+
+const (
+	MetaStatus       MetaType = 1 // uint16, e.g. http status code
+	MetaContentType  MetaType = 2 // string
+	MetaETag         MetaType = 3 // string
+	MetaLastModified MetaType = 4 // int64, unix nano
+	MetaHeader       MetaType = 5 // name and value, both uint16 length-prefixed strings
+	MetaSurrogateTag MetaType = 6 // string, repeated
+)
+
+// metaAttrHeaderSize is type(1) and length(2) of an attribute.
+const metaAttrHeaderSize = 3
+
+// ObjectMeta is the metadata stored in the chunk header next to the value.
+// Zero fields are not stored.
+type ObjectMeta struct {
+	Status       int
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	Headers      map[string][]string
+
+	// Tags are surrogate tags, the object is purged by Vol.PurgeTag of any of them.
+	Tags []string
+}
+
+// MarshalBinary encodes the metadata as attributes of type(1) length(2) value, big endian.
+// Headers are written sorted by name, values of a name keep their order.
+func (m *ObjectMeta) MarshalBinary() ([]byte, error) {
+	var b []byte
+	var err error
+	if m.Status != 0 {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, uint16(m.Status))
+		b, err = appendMetaAttr(b, MetaStatus, v)
+	}
+	if err == nil && m.ContentType != "" {
+		b, err = appendMetaAttr(b, MetaContentType, []byte(m.ContentType))
+	}
+	if err == nil && m.ETag != "" {
+		b, err = appendMetaAttr(b, MetaETag, []byte(m.ETag))
+	}
+	if err == nil && !m.LastModified.IsZero() {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(m.LastModified.UnixNano()))
+		b, err = appendMetaAttr(b, MetaLastModified, v)
+	}
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range m.Headers[name] {
+			if err != nil {
+				break
+			}
+			if len(name) > 0xffff || len(value) > 0xffff {
+				return nil, ErrChunkMetaTooLarge
+			}
+			v := make([]byte, 0, 4+len(name)+len(value))
+			v = binary.BigEndian.AppendUint16(v, uint16(len(name)))
+			v = append(v, name...)
+			v = binary.BigEndian.AppendUint16(v, uint16(len(value)))
+			v = append(v, value...)
+			b, err = appendMetaAttr(b, MetaHeader, v)
+		}
+	}
+	for _, tag := range m.Tags {
+		if err != nil {
+			break
+		}
+		b, err = appendMetaAttr(b, MetaSurrogateTag, []byte(tag))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > ChunkMetaMaxSize {
+		return nil, ErrChunkMetaTooLarge
+	}
+	return b, nil
+}
+
+func appendMetaAttr(b []byte, t MetaType, v []byte) ([]byte, error) {
+	if len(v) > ChunkMetaMaxSize {
+		return nil, ErrChunkMetaTooLarge
+	}
+	b = append(b, byte(t))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...), nil
+}
+
+// UnmarshalBinary decodes the attributes. Unknown types are skipped, so newer writers stay readable.
+func (m *ObjectMeta) UnmarshalBinary(data []byte) error {
+	*m = ObjectMeta{}
+	for len(data) > 0 {
+		if len(data) < metaAttrHeaderSize {
+			return ErrChunkMetaInvalid
+		}
+		t := MetaType(data[0])
+		l := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[metaAttrHeaderSize:]
+		if len(data) < l {
+			return ErrChunkMetaInvalid
+		}
+		v := data[:l]
+		data = data[l:]
+
+		switch t {
+		case MetaStatus:
+			if l != 2 {
+				return ErrChunkMetaInvalid
+			}
+			m.Status = int(binary.BigEndian.Uint16(v))
+		case MetaContentType:
+			m.ContentType = string(v)
+		case MetaETag:
+			m.ETag = string(v)
+		case MetaLastModified:
+			if l != 8 {
+				return ErrChunkMetaInvalid
+			}
+			m.LastModified = time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+		case MetaHeader:
+			name, rest, ok := cutMetaString(v)
+			if !ok {
+				return ErrChunkMetaInvalid
+			}
+			value, rest, ok := cutMetaString(rest)
+			if !ok || len(rest) != 0 {
+				return ErrChunkMetaInvalid
+			}
+			if m.Headers == nil {
+				m.Headers = make(map[string][]string)
+			}
+			m.Headers[name] = append(m.Headers[name], value)
+		case MetaSurrogateTag:
+			m.Tags = append(m.Tags, string(v))
+		}
+	}
+	return nil
+}
+
+// cutMetaString cuts a uint16 length-prefixed string from the front of b.
+func cutMetaString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < l {
+		return "", nil, false
+	}
+	return string(b[:l]), b[l:], true
+}
@@ -0,0 +1,51 @@
+package bakemono
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestObjectMeta_MarshalUnmarshal(t *testing.T) {
+	m := &ObjectMeta{
+		Status:       200,
+		ContentType:  "text/html",
+		ETag:         `"abc"`,
+		LastModified: time.Unix(1700000000, 0),
+		Headers:      map[string][]string{"Cache-Control": {"max-age=60"}, "Vary": {"Accept", "Accept-Encoding"}},
+	}
+	b, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := &ObjectMeta{}
+	err = m2.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.LastModified.Equal(m.LastModified) {
+		t.Fatal("last modified mismatch")
+	}
+	m2.LastModified = m.LastModified
+	if !reflect.DeepEqual(m, m2) {
+		t.Fatalf("meta mismatch: %+v, %+v", m, m2)
+	}
+
+	// unknown types are skipped
+	b = append([]byte{0xff, 0, 1, 'x'}, b...)
+	err = m2.UnmarshalBinary(b)
+	if err != nil || m2.Status != 200 {
+		t.Fatal("unknown type not skipped", err)
+	}
+
+	err = m2.UnmarshalBinary(b[:len(b)-1])
+	if err != ErrChunkMetaInvalid {
+		t.Fatal("truncated meta should be invalid", err)
+	}
+
+	big := &ObjectMeta{ETag: string(make([]byte, ChunkMetaMaxSize))}
+	_, err = big.MarshalBinary()
+	if err != ErrChunkMetaTooLarge {
+		t.Fatal("meta should be too large", err)
+	}
+}
@@ -0,0 +1,208 @@
+package bakemono
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+// tagRefSize is the binary size of a tagRef: segment(4) bucket(4) tag(2) offset(8).
+const tagRefSize = 18
+
+// tagRef locates the dir of a tagged chunk, without keeping its key.
+// It is stale once the dir is deleted or points to another chunk, and dropped by prune.
+type tagRef struct {
+	Segment uint32
+	Bucket  uint32
+	Tag     uint16
+	Offset  uint64
+}
+
+// tagIndex maps surrogate tags to dirs of chunks carrying them.
+// binary: count(4), then per tag: len(2) tag count(4) refs, big endian.
+type tagIndex struct {
+	mu    sync.Mutex
+	refs  map[string][]tagRef
+	size  int // binary size
+	max   int
+	dirty bool
+}
+
+func newTagIndex(max int) *tagIndex {
+	return &tagIndex{refs: make(map[string][]tagRef), size: 4, max: max}
+}
+
+// add adds ref to tags. Returns ErrTagIndexFull if the binary would not fit in max.
+func (t *tagIndex) add(tags []string, ref tagRef) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	grow := 0
+	for i, tag := range tags {
+		if containsString(tags[:i], tag) {
+			continue
+		}
+		if _, ok := t.refs[tag]; !ok {
+			grow += 6 + len(tag)
+		}
+		grow += tagRefSize
+	}
+	if t.size+grow > t.max {
+		return ErrTagIndexFull
+	}
+	for i, tag := range tags {
+		if containsString(tags[:i], tag) {
+			continue
+		}
+		t.refs[tag] = append(t.refs[tag], ref)
+	}
+	t.size += grow
+	t.dirty = true
+	return nil
+}
+
+// take removes tag and returns its refs.
+func (t *tagIndex) take(tag string) []tagRef {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	refs, ok := t.refs[tag]
+	if !ok {
+		return nil
+	}
+	delete(t.refs, tag)
+	t.size -= 6 + len(tag) + len(refs)*tagRefSize
+	t.dirty = true
+	return refs
+}
+
+// prune drops stale refs, and duplicated refs of a tag.
+func (t *tagIndex) prune(live func(r tagRef) bool) (dropped int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for tag, refs := range t.refs {
+		seen := make(map[tagRef]bool, len(refs))
+		kept := refs[:0]
+		for _, r := range refs {
+			if seen[r] || !live(r) {
+				continue
+			}
+			seen[r] = true
+			kept = append(kept, r)
+		}
+		dropped += len(refs) - len(kept)
+		if len(kept) == 0 {
+			delete(t.refs, tag)
+			t.size -= 6 + len(tag)
+		} else {
+			t.refs[tag] = kept
+		}
+	}
+	t.size -= dropped * tagRefSize
+	if dropped > 0 {
+		t.dirty = true
+	}
+	return dropped
+}
+
+// snapshot returns the binary if dirty, and clears dirty. Call markDirty if it fails to persist.
+func (t *tagIndex) snapshot() (data []byte, dirty bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		return nil, false
+	}
+	t.dirty = false
+	return t.marshalBinary(), true
+}
+
+func (t *tagIndex) markDirty() {
+	t.mu.Lock()
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// Len returns the number of tags.
+func (t *tagIndex) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.refs)
+}
+
+func (t *tagIndex) marshalBinary() []byte {
+	tags := make([]string, 0, len(t.refs))
+	for tag := range t.refs {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	b := make([]byte, 0, t.size)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(tags)))
+	for _, tag := range tags {
+		refs := t.refs[tag]
+		b = binary.BigEndian.AppendUint16(b, uint16(len(tag)))
+		b = append(b, tag...)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(refs)))
+		for _, r := range refs {
+			b = binary.BigEndian.AppendUint32(b, r.Segment)
+			b = binary.BigEndian.AppendUint32(b, r.Bucket)
+			b = binary.BigEndian.AppendUint16(b, r.Tag)
+			b = binary.BigEndian.AppendUint64(b, r.Offset)
+		}
+	}
+	return b
+}
+
+func (t *tagIndex) unmarshalBinary(data []byte) error {
+	refs := make(map[string][]tagRef)
+	size := len(data)
+	if len(data) < 4 {
+		return ErrTagIndexInvalid
+	}
+	n := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	for i := uint32(0); i < n; i++ {
+		if len(data) < 2 {
+			return ErrTagIndexInvalid
+		}
+		l := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < l+4 {
+			return ErrTagIndexInvalid
+		}
+		tag := string(data[:l])
+		count := int(binary.BigEndian.Uint32(data[l:]))
+		data = data[l+4:]
+		if count == 0 || len(data)/tagRefSize < count {
+			return ErrTagIndexInvalid
+		}
+		if _, ok := refs[tag]; ok {
+			return ErrTagIndexInvalid
+		}
+		list := make([]tagRef, count)
+		for j := range list {
+			list[j] = tagRef{
+				Segment: binary.BigEndian.Uint32(data),
+				Bucket:  binary.BigEndian.Uint32(data[4:]),
+				Tag:     binary.BigEndian.Uint16(data[8:]),
+				Offset:  binary.BigEndian.Uint64(data[10:]),
+			}
+			data = data[tagRefSize:]
+		}
+		refs[tag] = list
+	}
+	if len(data) != 0 {
+		return ErrTagIndexInvalid
+	}
+	t.mu.Lock()
+	t.refs, t.size = refs, size
+	t.mu.Unlock()
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,27 +1,30 @@
 package bakemono
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Offset uint64
 type segId uint64
 
-// TODO(meta): flush/rebuild to A/B alternately
-
 var (
-	HeaderSize = binary.Size(&VolHeaderFooter{})
+	HeaderSize = VolHeaderSizeFixed
 	DirSize    = binary.Size(&Dir{})
 )
 
 // Vol is a volume represents a file on disk.
-// structure: Meta_A(header, dirs, footer) + Meta_B(header, dirs, footer) + Data(Chunks)
-// dirs are organized segment->bucket->dir logically.
+// structure: Meta_A(header, dir checksums, dirs, footer) + Meta_B(header, dir checksums, dirs, footer) + Journal + TagIndex + Data(Chunks)
+// dirs are organized segment->bucket->dir logically. Every segment has a checksum, flushed only if dirty.
+// Meta is flushed to A and B alternately, the header last, so a torn flush leaves the other copy intact.
 type Vol struct {
 	Path     string
 	Fp       OffsetReaderWriterCloser
@@ -35,12 +38,71 @@ type Vol struct {
 	ChunkAvgSize Offset // average chunk size, adjusted by user.
 	ChunksMaxNum Offset // max chunks num in this vol. calculated from ChunkAvgSize and Length
 
-	HeaderAOffset Offset
-	FooterAOffset Offset
-	HeaderBOffset Offset
-	FooterBOffset Offset
-	DataOffset    Offset
-	DirAOffset    Offset
+	HeaderAOffset       Offset
+	FooterAOffset       Offset
+	HeaderBOffset       Offset
+	FooterBOffset       Offset
+	DataOffset          Offset
+	DirAOffset          Offset
+	DirChecksumsAOffset Offset
+	DirBOffset          Offset
+	DirChecksumsBOffset Offset
+	JournalOffset       Offset
+	JournalSize         Offset
+	TagIndexOffset      Offset
+	TagIndexSize        Offset
+
+	// journal records dir mutations between meta flushes, nil if disabled.
+	journal *journal
+
+	// metaCopy is the copy of meta the header on disk is in, 0 for A and 1 for B, the next flush goes to the other one.
+	// segChecksums are checksums of segments flushed to each copy, segStale marks segments a copy misses
+	// changes flushed to the other one. Guarded by flushMu.
+	flushMu      sync.Mutex
+	metaCopy     int
+	segChecksums [2][]uint32
+	segStale     [2][]bool
+
+	// tags is the surrogate tag index, nil if disabled. tagIndexHalf is the copy pointed by the header on disk.
+	tags         *tagIndex
+	tagIndexHalf uint32
+
+	// nsMu guards Header.Namespaces, written under flushMu too
+	nsMu sync.RWMutex
+
+	// layoutMu is held for reading by every call on dirs, meta or data, and for writing by Resize, which replaces them.
+	// Calls holding it must not call each other, a nested read lock deadlocks once Resize waits.
+	layoutMu sync.RWMutex
+
+	readOnly   bool
+	durability Durability
+
+	// headerLoaded reports whether the header was read from Fp in Init, not created empty.
+	headerLoaded bool
+
+	// upgradeChunks are chunks of an older layout loaded in Init, linked by the format upgrade.
+	upgradeChunks []resizeChunk
+
+	// cleanShutdown reports whether the previous shutdown was clean, set in Init.
+	cleanShutdown bool
+
+	// writeMu guards WritePos and writeSerial
+	writeMu     sync.Mutex
+	writeSerial uint64
+
+	scrub         *scrubber
+	flushInterval time.Duration
+
+	ioDepth int
+
+	// compress encodes values of chunks written, nil means stored as is
+	compress *CompressOptions
+	// keys encrypts chunks, nil means in the clear
+	keys *Keyring
+
+	// loads and negative serve GetOrLoad
+	loads    loadGroup
+	negative *negativeCache
 
 	closeCh chan struct{}
 	flushCh chan struct{}
@@ -54,6 +116,44 @@ type VolOptions struct {
 	ChunkAvgSize Offset
 
 	FlushMetaInterval time.Duration
+
+	// JournalSize reserves a region for the dir journal, 0 means disabled.
+	// Dir mutations are journaled and replayed in Init, so a crash loses nothing flushed to the journal.
+	// It is part of the layout, open a vol with the same size.
+	JournalSize Offset
+
+	// TagIndexSize reserves a region for the surrogate tag index, 0 means disabled.
+	// The region keeps two copies, so half of it is the capacity. Set with tags fails once it is full.
+	// It is part of the layout, open a vol with the same size.
+	TagIndexSize Offset
+
+	// Durability is the fsync policy, DurabilityNone by default.
+	Durability Durability
+
+	// ReadOnly opens the vol without writing anything back to Fp.
+	// Set/Delete return ErrVolReadOnly, and metadata is never flushed.
+	ReadOnly bool
+
+	// Recover rebuilds dirs by scanning the data region when metadata is corrupted.
+	// nil means start with empty dirs.
+	Recover *RecoverOptions
+
+	// Scrub starts a background scrubber, nil means disabled.
+	Scrub *ScrubOptions
+
+	// NegativeCache caches loader errors of GetOrLoad, nil means disabled.
+	NegativeCache *NegativeCacheOptions
+
+	// IODepth limits reads in flight of a MultiGet, 0 means DefaultIODepth.
+	IODepth int
+
+	// Compress compresses values of chunks written, nil means disabled.
+	// Chunks are read back by the codec recorded in their header, see RegisterCodec.
+	Compress *CompressOptions
+
+	// Encryption encrypts keys and values of chunks with AES-GCM, nil means disabled.
+	// Chunks in the clear are not served by an encrypted vol, nor encrypted ones by a vol in the clear.
+	Encryption *EncryptionOptions
 }
 
 // NewDefaultVolOptions creates a VolOptions with a file path.
@@ -88,62 +188,296 @@ func (cfg *VolOptions) Check() error {
 	if cfg.ChunkAvgSize == 0 {
 		return errors.New("invalid config: ChunkAvgSize is 0")
 	}
+	if cfg.JournalSize+cfg.TagIndexSize >= cfg.FileSize {
+		return errors.New("invalid config: JournalSize and TagIndexSize exceed FileSize")
+	}
+	if cfg.Durability < DurabilityNone || cfg.Durability > DurabilityWrite {
+		return fmt.Errorf("invalid config: unknown durability %d", cfg.Durability)
+	}
+	if _, ok := cfg.Fp.(Syncer); !ok && cfg.Durability != DurabilityNone && !cfg.ReadOnly {
+		return fmt.Errorf("invalid config: durability %s needs Fp implementing Syncer", cfg.Durability)
+	}
+	if cfg.Compress != nil {
+		err := cfg.Compress.Check()
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
+	if cfg.Encryption != nil {
+		err := cfg.Encryption.Check()
+		if err != nil {
+			return fmt.Errorf("invalid config: %w", err)
+		}
+	}
 	return nil
 }
 
 func (v *Vol) Init(cfg *VolOptions) (corrupted bool, err error) {
+	return v.InitContext(context.Background(), cfg)
+}
+
+// InitContext is Init, returns ctx.Err() once ctx is done while loading meta or scanning data region.
+// Nothing is written to Fp if it returns ctx.Err() before recovery.
+func (v *Vol) InitContext(ctx context.Context, cfg *VolOptions) (corrupted bool, err error) {
 	log.Printf("initing vol, config: %+v", cfg)
 	err = cfg.Check()
 	if err != nil {
 		return false, err
 	}
-
-	// channel init
-	v.closeCh = make(chan struct{})
-	v.flushCh = make(chan struct{})
+	err = ctx.Err()
+	if err != nil {
+		return false, err
+	}
 
 	// storage interface
 	v.Fp = cfg.Fp
+	v.readOnly = cfg.ReadOnly
+	v.durability = cfg.Durability
+	if cfg.NegativeCache != nil {
+		v.negative = newNegativeCache(*cfg.NegativeCache)
+	}
+	v.ioDepth = cfg.IODepth
+	if v.ioDepth <= 0 {
+		v.ioDepth = DefaultIODepth
+	}
+	v.compress = cfg.Compress
+	v.keys = nil
+	if cfg.Encryption != nil {
+		v.keys, err = NewKeyring(cfg.Encryption)
+		if err != nil {
+			return false, err
+		}
+	}
 
-	// dir manager size init. note: dir data setup in next step
-	v.Dm = &DirManager{}
-	expectedDirNum := (cfg.FileSize - 4*Offset(HeaderSize)) / (cfg.ChunkAvgSize + 2*Offset(DirSize))
-	v.ChunksMaxNum = v.Dm.Init(expectedDirNum)
-
-	// calculate vol offsets
-	v.prepareOffsets(cfg)
+	v.initLayout(cfg)
+	err = v.checkLayout()
+	if err != nil {
+		return false, err
+	}
 
-	err = v.buildMetaFromFp()
+	badSegments, err := v.buildMetaFromFp(ctx)
+	if err != nil && ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	metaLoaded := err == nil
+	v.headerLoaded = metaLoaded
 	if err != nil {
 		log.Printf("warn: build meta from fp failed, file may corrupted, err: %v", err)
 		corrupted = true
 		v.initEmptyMeta()
+	} else if badSegments > 0 {
+		log.Printf("warn: %d segments failed to verify, reset them as empty", badSegments)
+		corrupted = true
+	}
+
+	// an older minor version is upgraded once meta is replayed and recovered, and flushed at the end
+	upgrade := metaLoaded && v.Header.MinorVersion < MinorVersion
+
+	// a clean shutdown flushed everything, no need to replay or scan
+	v.cleanShutdown = metaLoaded && v.Header.CleanShutdown
+	if v.cleanShutdown && !v.readOnly && !upgrade {
+		// clear the flag first, a crash from now on is not clean
+		v.Header.CleanShutdown = false
+		err = v.flushHeaderFooterToFp(v.metaCopy)
+		if err == nil {
+			err = v.sync(DurabilityMeta)
+		}
+		if err != nil {
+			return corrupted, fmt.Errorf("clear clean shutdown flag: %w", err)
+		}
+	}
+
+	if v.TagIndexSize > 0 {
+		v.tags = newTagIndex(int(v.tagIndexHalfSize()))
+		if metaLoaded {
+			err = v.loadTagIndex()
+			if err != nil {
+				log.Printf("warn: load tag index failed, purging by tag misses keys set before, err: %v", err)
+				v.tags = newTagIndex(int(v.tagIndexHalfSize()))
+				v.tags.markDirty()
+			}
+		}
 	}
 
 	// sync meta to vol, avoid mutex for header
-	v.WritePos = v.DataOffset
+	v.WritePos = v.Header.WritePos
+	journalInvalid := false
+	if v.JournalSize > 0 {
+		v.journal = newJournal(v.Fp, v.JournalOffset, v.JournalSize)
+		if metaLoaded && v.Header.JournalSize == v.JournalSize {
+			v.journal.reset(v.Header.JournalSeq, v.Header.JournalPos)
+		} else {
+			// new epoch, stale records on disk never match the seq
+			v.journal.reset(uint64(time.Now().UnixNano()), 0)
+		}
+		if metaLoaded && v.Header.JournalSize == v.JournalSize && !v.cleanShutdown {
+			writeEnd, err := v.replayJournal()
+			if err == ErrJournalInvalid {
+				// dirs on disk may miss mutations dropped from the journal, and serve stale chunks
+				log.Printf("warn: journal is invalid, reset dirs, err: %v", err)
+				corrupted, journalInvalid = true, true
+				v.Dm.InitEmptyDirs()
+				v.Dm.markDirty()
+				v.journal.reset(uint64(time.Now().UnixNano()), 0)
+			} else if err != nil {
+				log.Printf("warn: replay journal failed, err: %v", err)
+			}
+			if writeEnd != 0 {
+				v.WritePos = writeEnd
+			}
+		}
+	}
+	if v.WritePos < v.DataOffset || v.WritePos >= v.Length {
+		v.WritePos = v.DataOffset
+	}
+	// serial starts from wall clock, so chunks are still newer than the ones on disk when meta is lost.
+	v.writeSerial = uint64(time.Now().UnixNano())
+	if v.Header.WriteSerial > v.writeSerial {
+		v.writeSerial = v.Header.WriteSerial
+	}
 
-	// start sync flush thread
-	go v.SyncFlushLoop(cfg.FlushMetaInterval)
+	if corrupted && cfg.Recover != nil && !v.cleanShutdown {
+		p, err := v.RecoverFromData(ctx, cfg.Recover)
+		if err != nil && ctx.Err() != nil {
+			return corrupted, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("warn: recover from data failed, err: %v", err)
+		}
+		log.Printf("recover from data: %+v", p)
+	}
+
+	if upgrade {
+		err = v.upgradeFormat()
+		if err != nil {
+			return corrupted, err
+		}
+		if v.readOnly {
+			log.Printf("warn: vol is read-only, upgraded in memory only")
+		} else {
+			// rewrites meta in the current format, and clears the clean shutdown flag
+			err = v.flushMetaToFp()
+			if err != nil {
+				return corrupted, fmt.Errorf("upgrade format: %w", err)
+			}
+		}
+	}
 
-	log.Printf("init vol done, corrupted: %v, err: %v", corrupted, err)
+	if !v.readOnly && v.journal != nil {
+		// journal replays on top of meta on disk, so anchor it with a flush if there is none
+		if !metaLoaded || journalInvalid {
+			err := v.flushMetaToFp()
+			if err != nil {
+				log.Printf("warn: flush meta for journal failed, err: %v", err)
+			}
+		}
+		v.Dm.journal = v.journal
+	}
+
+	v.startLoops(cfg.FlushMetaInterval, cfg.Scrub)
+
+	log.Printf("init vol done, corrupted: %v, clean shutdown: %v", corrupted, v.cleanShutdown)
 	return corrupted, nil
 }
 
-// Close closes the Vol.
+// Close closes the Vol. Unless read-only, metadata is flushed and marked as clean shutdown.
 func (v *Vol) Close() error {
+	return v.CloseContext(context.Background())
+}
+
+// CloseContext is Close, returns ctx.Err() once ctx is done.
+// Closing goes on in background then, the previous shutdown is not clean if the process exits before it is done.
+func (v *Vol) CloseContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		return v.close()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- v.close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (v *Vol) close() error {
+	v.stopLoops()
+
+	var err error
+	if !v.readOnly {
+		err = v.flushMeta(true)
+		if err != nil {
+			log.Printf("error: final flush meta failed, err: %v", err)
+		}
+	}
+	closeErr := v.Fp.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// startLoops starts the flush loop and the scrubber, unless read-only.
+func (v *Vol) startLoops(flushInterval time.Duration, scrub *ScrubOptions) {
+	v.closeCh = make(chan struct{})
+	v.flushCh = make(chan struct{})
+	v.flushInterval = flushInterval
+	v.scrub = nil
+	if v.readOnly {
+		close(v.flushCh)
+		return
+	}
+	go v.SyncFlushLoop(flushInterval)
+	if scrub != nil {
+		v.scrub = &scrubber{opts: *scrub, doneCh: make(chan struct{})}
+		go v.ScrubLoop()
+	}
+}
+
+// stopLoops stops the loops started by startLoops, and waits for them.
+func (v *Vol) stopLoops() {
 	close(v.closeCh)
 	<-v.flushCh
-	return v.Fp.Close()
+	if v.scrub != nil {
+		<-v.scrub.doneCh
+	}
+}
+
+// CleanShutdown reports whether the vol was closed cleanly last time, so Init skipped replay and recovery.
+func (v *Vol) CleanShutdown() bool {
+	return v.cleanShutdown
+}
+
+// Flush flushes metadata to disk immediately.
+func (v *Vol) Flush() error {
+	if v.readOnly {
+		return ErrVolReadOnly
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	return v.flushMetaToFp()
 }
 
 // SyncFlushLoop flushes metadata to disk periodically.
 func (v *Vol) SyncFlushLoop(interval time.Duration) {
+	// a full journal triggers a flush early
+	var journalFullCh chan struct{}
+	if v.journal != nil {
+		journalFullCh = v.journal.fullCh
+	}
 	for {
 		select {
 		case <-v.closeCh:
 			close(v.flushCh)
 			return
+		case <-journalFullCh:
+			err := v.flushMetaToFp()
+			if err != nil {
+				log.Printf("error: flush meta to fp failed, err: %v", err)
+			}
 		case <-time.After(interval):
 			err := v.flushMetaToFp()
 			if err != nil {
@@ -155,6 +489,42 @@ func (v *Vol) SyncFlushLoop(interval time.Duration) {
 	}
 }
 
+// initLayout sizes dirs and calculates offsets from options. Dirs are empty until meta is loaded.
+func (v *Vol) initLayout(cfg *VolOptions) {
+	v.Dm = &DirManager{}
+	expectedDirNum := (cfg.FileSize - 4*Offset(HeaderSize) - cfg.JournalSize - cfg.TagIndexSize) / (cfg.ChunkAvgSize + 2*Offset(DirSize))
+	v.ChunksMaxNum = v.Dm.Init(expectedDirNum)
+	v.prepareOffsets(cfg)
+}
+
+// checkLayout compares the layout with the one recorded in the newest header, if any.
+// Reading a vol with another layout would misread dirs, see Resize to change it.
+// A vol of a newer version, or too old to upgrade, is refused too, instead of being reset as corrupted.
+func (v *Vol) checkLayout() error {
+	h, _, err := v.readNewestHeader()
+	if errors.Is(err, ErrVolVersionTooNew) || errors.Is(err, ErrVolVersionUnsupported) {
+		return err
+	}
+	if err != nil || h.FileSize == 0 {
+		// no header, or written by a version without layout
+		return nil
+	}
+	var diffs []string
+	diff := func(name string, got, want Offset) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s %d, vol has %d", name, got, want))
+		}
+	}
+	diff("FileSize", v.Length, h.FileSize)
+	diff("ChunkAvgSize", v.ChunkAvgSize, h.ChunkAvgSize)
+	diff("JournalSize", v.JournalSize, h.JournalSize)
+	diff("TagIndexSize", v.TagIndexSize, h.TagIndexSize)
+	if len(diffs) > 0 {
+		return fmt.Errorf("%w: %s", ErrVolLayoutMismatch, strings.Join(diffs, ", "))
+	}
+	return nil
+}
+
 // prepareOffsets calculates offsets and block numbers before initing a Vol.
 func (v *Vol) prepareOffsets(cfg *VolOptions) {
 	v.ChunkAvgSize = cfg.ChunkAvgSize
@@ -162,26 +532,47 @@ func (v *Vol) prepareOffsets(cfg *VolOptions) {
 	v.Length = cfg.FileSize
 
 	// calculate sizeInternal to allocate
-	// Meta_A(header, dirs, footer) + Meta_B(header, dirs, footer) + Data(Chunks)
+	// Meta_A(header, dir checksums, dirs, footer) + Meta_B(header, dir checksums, dirs, footer) + Journal + TagIndex + Data(Chunks)
 	HeaderFooterSize := Offset(HeaderSize)
 	DirSize := Offset(binary.Size(&Dir{}))
+	DirChecksumsSize := v.Dm.SegmentsNum * 4
 	// TotalChunk init by DirManager
 	//TotalChunks := (cfg.FileSize - 4*HeaderFooterSize) / (cfg.ChunkAvgSize + 2*DirSize)
-	MetaSize := 2 * (2*HeaderFooterSize + v.ChunksMaxNum*DirSize)
-	DataSize := cfg.FileSize - MetaSize
+	MetaSize := 2 * (2*HeaderFooterSize + DirChecksumsSize + v.ChunksMaxNum*DirSize)
+	v.JournalSize = cfg.JournalSize / JournalRecordSize * JournalRecordSize
+	v.TagIndexSize = cfg.TagIndexSize / (2 * BlockSize) * (2 * BlockSize)
+	DataSize := cfg.FileSize - MetaSize - v.JournalSize - v.TagIndexSize
 	log.Printf("initing vol: ChunksMaxNum: %d, MetaSize: %d, DataSize: %d, VolLength: %d", v.ChunksMaxNum, MetaSize, DataSize, v.Length)
 
 	// calculate offsets
 	v.HeaderAOffset = 0
-	v.FooterAOffset = HeaderFooterSize + v.ChunksMaxNum*DirSize
+	v.DirChecksumsAOffset = v.HeaderAOffset + HeaderFooterSize
+	v.DirAOffset = v.DirChecksumsAOffset + DirChecksumsSize
+	v.FooterAOffset = v.DirAOffset + v.ChunksMaxNum*DirSize
 	v.HeaderBOffset = v.FooterAOffset + HeaderFooterSize
-	v.FooterBOffset = v.HeaderBOffset + HeaderFooterSize + v.ChunksMaxNum*DirSize
-	v.DataOffset = MetaSize
-	v.DirAOffset = v.HeaderAOffset + HeaderFooterSize
+	v.DirChecksumsBOffset = v.HeaderBOffset + HeaderFooterSize
+	v.DirBOffset = v.DirChecksumsBOffset + DirChecksumsSize
+	v.FooterBOffset = v.DirBOffset + v.ChunksMaxNum*DirSize
+	v.JournalOffset = MetaSize
+	v.TagIndexOffset = v.JournalOffset + v.JournalSize
+	v.DataOffset = v.TagIndexOffset + v.TagIndexSize
 
 	log.Printf("initing vol: ActualLength: %d, ChunksMaxNum: %d", v.Length, v.ChunksMaxNum)
 }
 
+// metaCopyOffsets are offsets of a copy of meta.
+type metaCopyOffsets struct {
+	header, dirChecksums, dirs, footer Offset
+}
+
+// metaOffsets returns offsets of meta copy c, 0 for A and 1 for B.
+func (v *Vol) metaOffsets(c int) metaCopyOffsets {
+	if c == 0 {
+		return metaCopyOffsets{v.HeaderAOffset, v.DirChecksumsAOffset, v.DirAOffset, v.FooterAOffset}
+	}
+	return metaCopyOffsets{v.HeaderBOffset, v.DirChecksumsBOffset, v.DirBOffset, v.FooterBOffset}
+}
+
 // buildMetaFromFp builds new empty metadata.
 func (v *Vol) initEmptyMeta() {
 	v.Header = &VolHeaderFooter{
@@ -193,91 +584,288 @@ func (v *Vol) initEmptyMeta() {
 	}
 
 	v.Dm.InitEmptyDirs()
+	v.Dm.markDirty()
+	v.resetMetaCopies()
 }
 
-// buildMetaFromFp builds metadata from io.
-func (v *Vol) buildMetaFromFp() error {
-	h := &VolHeaderFooter{}
-	data := make([]byte, HeaderSize)
-	_, err := v.Fp.ReadAt(data, int64(v.HeaderAOffset))
+// resetMetaCopies forgets what both copies of meta hold, the next flush goes to A and writes every segment.
+func (v *Vol) resetMetaCopies() {
+	v.metaCopy = 1
+	for c := range v.segChecksums {
+		v.segChecksums[c] = make([]uint32, v.Dm.SegmentsNum)
+		v.segStale[c] = make([]bool, v.Dm.SegmentsNum)
+		for i := range v.segStale[c] {
+			v.segStale[c][i] = true
+		}
+	}
+}
+
+// buildMetaFromFp builds metadata from io, from the copy of the newest header.
+// Segments failed to verify are reset as empty, and counted in badSegments.
+func (v *Vol) buildMetaFromFp(ctx context.Context) (badSegments int, err error) {
+	headers, c, err := v.readMetaHeaders()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	err = h.UnmarshalBinary(data)
+	h := headers[c]
+	if u := formatUpgrades[h.MinorVersion]; h.MinorVersion < MinorVersion && u.loadMeta != nil {
+		v.Header = h
+		return 0, u.loadMeta(ctx, v, h)
+	}
+
+	off := v.metaOffsets(c)
+	checksums, matched, err := v.readDirChecksums(off.dirChecksums, h)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if !matched {
+		log.Printf("warn: dir checksums not matching header, last flush may be interrupted")
 	}
-	v.Header = h
 
-	DirSize := Offset(binary.Size(&Dir{})) * v.ChunksMaxNum
-	dirsRaw := make([]byte, DirSize)
-	_, err = v.Fp.ReadAt(dirsRaw, int64(v.DirAOffset))
+	dirsRaw := make([]byte, Offset(DirSize)*v.ChunksMaxNum)
+	_, err = contextReaderWriterAt{ctx, v.Fp}.ReadAt(dirsRaw, int64(off.dirs))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	DirsCheckSum := crc32.ChecksumIEEE(dirsRaw)
-	log.Printf("DirsCheckSum: %d, v.Header.DirsChecksum: %d", DirsCheckSum, v.Header.DirsChecksum)
-	if DirsCheckSum != v.Header.DirsChecksum {
-		return errors.New("invalid dir checksum")
+	v.resetMetaCopies()
+	segSize := v.Dm.segmentBinarySize()
+	for i := segId(0); Offset(i) < v.Dm.SegmentsNum; i++ {
+		raw := dirsRaw[Offset(i)*segSize : Offset(i+1)*segSize]
+		if crc32.ChecksumIEEE(raw) != checksums[i] {
+			log.Printf("warn: invalid dir checksum of segment %d", i)
+			badSegments++
+			v.Dm.initEmptySegment(i)
+			v.Dm.markDirty(i)
+			continue
+		}
+		err = v.Dm.unmarshalSegment(i, raw)
+		if err != nil {
+			log.Printf("warn: invalid dirs of segment %d, err: %v", i, err)
+			badSegments++
+			v.Dm.initEmptySegment(i)
+			v.Dm.markDirty(i)
+			continue
+		}
+		v.segStale[c][i] = false
+	}
+
+	// the other copy is a flush older, it misses segments with another checksum
+	if o := headers[1-c]; o != nil && o.MinorVersion == MinorVersion {
+		others, matched, err := v.readDirChecksums(v.metaOffsets(1-c).dirChecksums, o)
+		if err == nil && matched {
+			for i := range others {
+				v.segStale[1-c][i] = others[i] != checksums[i]
+			}
+			v.segChecksums[1-c] = others
+		}
+	}
+
+	v.Header = h
+	v.metaCopy = c
+	v.segChecksums[c] = checksums
+	return badSegments, nil
+}
+
+// readMetaHeaders reads headers of both copies of meta, nil if invalid, and returns the newest one in c.
+// A newer version, or one too old to upgrade, is returned as error, as is no valid header.
+func (v *Vol) readMetaHeaders() (headers [2]*VolHeaderFooter, c int, err error) {
+	var errs [2]error
+	for i := range headers {
+		headers[i], errs[i] = v.readHeaderFooter(v.metaOffsets(i).header)
+		if errors.Is(errs[i], ErrVolVersionTooNew) || errors.Is(errs[i], ErrVolVersionUnsupported) {
+			return headers, 0, errs[i]
+		}
 	}
+	switch {
+	case headers[0] == nil && headers[1] == nil:
+		return headers, 0, errs[0]
+	case headers[0] == nil:
+		return headers, 1, nil
+	case headers[1] != nil && headers[1].SyncSerial > headers[0].SyncSerial:
+		return headers, 1, nil
+	}
+	return headers, 0, nil
+}
 
-	err = v.Dm.UnmarshalBinary(dirsRaw)
+// readNewestHeader returns the newest valid header and the copy of meta it is in.
+func (v *Vol) readNewestHeader() (*VolHeaderFooter, int, error) {
+	headers, c, err := v.readMetaHeaders()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	return headers[c], c, nil
+}
 
-	return nil
+// readDirChecksums reads checksums of segments at off, and verifies them with the header.
+// The table may not match the header if a flush was interrupted before writing the header.
+// It is still usable then, every segment is verified by its own checksum.
+func (v *Vol) readDirChecksums(off Offset, h *VolHeaderFooter) (checksums []uint32, matched bool, err error) {
+	raw := make([]byte, v.Dm.SegmentsNum*4)
+	_, err = v.Fp.ReadAt(raw, int64(off))
+	if err != nil {
+		return nil, false, err
+	}
+	checksums = make([]uint32, v.Dm.SegmentsNum)
+	for i := range checksums {
+		checksums[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+	return checksums, crc32.ChecksumIEEE(raw) == h.DirsChecksum, nil
+}
+
+// readHeaderFooter reads a header or footer copy from io.
+func (v *Vol) readHeaderFooter(off Offset) (*VolHeaderFooter, error) {
+	h := &VolHeaderFooter{}
+	data := make([]byte, HeaderSize)
+	_, err := v.Fp.ReadAt(data, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	err = h.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
 }
 
 // flushMetaToFp flushes metadata to io.
 func (v *Vol) flushMetaToFp() error {
+	return v.flushMeta(false)
+}
+
+// flushMeta flushes metadata to io. clean marks the header as clean shutdown, no dir must change after it.
+// It goes to the copy of meta not holding the header on disk, which stays intact if the flush is torn.
+// Dirty segments are written, and the ones the copy misses from the last flush. Segment lock is held only to copy its dirs.
+// Order: segments, dir checksums, then header/footer of the copy.
+func (v *Vol) flushMeta(clean bool) error {
+	v.flushMu.Lock()
+	defer v.flushMu.Unlock()
+	c := 1 - v.metaCopy
+
+	// take the journal position before snapshots, records before it are covered by the flushed dirs
+	var journalSeq, journalPos uint64
+	if v.journal != nil {
+		journalSeq, journalPos = v.journal.checkpoint()
+	}
+
+	var flushed []segId
+	for i := segId(0); Offset(i) < v.Dm.SegmentsNum; i++ {
+		raw, dirty := v.Dm.snapshotSegment(i, true)
+		if dirty {
+			flushed = append(flushed, i)
+		} else if v.segStale[c][i] {
+			raw, _ = v.Dm.snapshotSegment(i, false)
+		} else {
+			continue
+		}
+		err := v.flushSegmentToFp(c, i, raw)
+		if err != nil {
+			v.Dm.markDirty(flushed...)
+			return err
+		}
+		if dirty {
+			v.segStale[1-c][i] = true
+		}
+	}
+
+	checksumsRaw := make([]byte, 4*len(v.segChecksums[c]))
+	for i, crc := range v.segChecksums[c] {
+		binary.BigEndian.PutUint32(checksumsRaw[i*4:], crc)
+	}
+	_, err := v.Fp.WriteAt(checksumsRaw, int64(v.metaOffsets(c).dirChecksums))
+	if err != nil {
+		v.Dm.markDirty(flushed...)
+		return err
+	}
+	if v.tags != nil {
+		err = v.flushTagIndex()
+		if err != nil {
+			v.Dm.markDirty(flushed...)
+			return err
+		}
+	}
+
 	v.Header.Magic = MagicBocchi
 	v.Header.MajorVersion = MajorVersion
 	v.Header.MinorVersion = MinorVersion
+	v.writeMu.Lock()
 	v.Header.WritePos = v.WritePos
+	v.Header.WriteSerial = v.writeSerial
+	v.writeMu.Unlock()
 	v.Header.SyncSerial++
-	dirsRaw, err := v.Dm.MarshalBinary()
+	v.Header.DirsChecksum = crc32.ChecksumIEEE(checksumsRaw)
+	v.Header.FileSize = v.Length
+	v.Header.ChunkAvgSize = v.ChunkAvgSize
+	v.Header.JournalSize = v.JournalSize
+	v.Header.JournalSeq = journalSeq
+	v.Header.JournalPos = journalPos
+	v.Header.TagIndexSize = v.TagIndexSize
+	v.Header.CleanShutdown = clean
+
+	// markers of an invalid journal start must be on disk before the header pointing to it
+	if v.journal != nil {
+		v.journal.seal(journalSeq)
+		err = v.journal.write()
+		if err != nil {
+			v.journal.unseal()
+			v.Dm.markDirty(flushed...)
+			return err
+		}
+	}
+	// dirs must be on disk before the header pointing to them
+	err = v.sync(DurabilityMeta)
 	if err != nil {
+		v.journal.unseal()
+		v.Dm.markDirty(flushed...)
 		return err
 	}
-	v.Header.DirsChecksum = crc32.ChecksumIEEE(dirsRaw)
-
-	err = v.flushHeaderFooterToFp()
+	err = v.flushHeaderFooterToFp(c)
+	if err == nil {
+		err = v.sync(DurabilityMeta)
+	}
 	if err != nil {
+		v.journal.unseal()
+		v.Dm.markDirty(flushed...)
+		if v.tags != nil && v.Header.TagIndexPos != v.tagIndexHalf {
+			v.tags.markDirty()
+		}
 		return err
 	}
-	err = v.flushDirRawToFp(dirsRaw)
+	v.metaCopy = c
+	v.tagIndexHalf = v.Header.TagIndexPos
+	if v.journal != nil {
+		v.journal.truncate(journalSeq, journalPos)
+	}
+	return nil
+}
+
+// flushSegmentToFp writes dirs of a segment to copy c of meta, and keeps its checksum.
+func (v *Vol) flushSegmentToFp(c int, segmentId segId, raw []byte) error {
+	segSize := v.Dm.segmentBinarySize()
+	if Offset(len(raw)) != segSize {
+		return errors.New("invalid dir data size")
+	}
+	_, err := v.Fp.WriteAt(raw, int64(v.metaOffsets(c).dirs+Offset(segmentId)*segSize))
 	if err != nil {
 		return err
 	}
+	v.segChecksums[c][segmentId] = crc32.ChecksumIEEE(raw)
+	v.segStale[c][segmentId] = false
 	return nil
 }
 
-func (v *Vol) flushHeaderFooterToFp() error {
+// flushHeaderFooterToFp writes the header and footer of copy c of meta.
+func (v *Vol) flushHeaderFooterToFp(c int) error {
 	data, err := v.Header.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	offsets := []Offset{v.HeaderAOffset, v.FooterAOffset, v.HeaderBOffset, v.FooterBOffset}
-	for _, off := range offsets {
-		_, err = v.Fp.WriteAt(data, int64(off))
+	off := v.metaOffsets(c)
+	for _, o := range []Offset{off.header, off.footer} {
+		_, err = v.Fp.WriteAt(data, int64(o))
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
-
-func (v *Vol) flushDirRawToFp(data []byte) error {
-	// check if data size is correct
-	DirSize := Offset(binary.Size(&Dir{})) * v.ChunksMaxNum
-	if DirSize < Offset(len(data)) {
-		return errors.New("invalid dir data size")
-	}
-	_, err := v.Fp.WriteAt(data, int64(v.DirAOffset))
-	if err != nil {
-		return err
-	}
-	return nil
-}
@@ -0,0 +1,196 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+)
+
+// MaxCheckProblems limits the problems recorded in a CheckReport.
+const MaxCheckProblems = 1000
+
+// CheckReport is the result of Vol.Check.
+type CheckReport struct {
+	UsedDirs    int // used dirs checked
+	BadDirs     int // used dirs point to invalid chunks
+	BadSegments int // segments with broken chains
+
+	// Problems are the first MaxCheckProblems problems found, ProblemsNum counts all.
+	Problems    []string
+	ProblemsNum int
+
+	Repaired bool
+}
+
+// OK returns true if no problem is found.
+func (r *CheckReport) OK() bool {
+	return r.ProblemsNum == 0
+}
+
+func (r *CheckReport) addProblem(format string, a ...interface{}) {
+	r.ProblemsNum++
+	if len(r.Problems) < MaxCheckProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+	}
+}
+
+// Check verifies the vol:
+//   - header/footer of the meta copy flushed last agree with each other
+//   - dirs of every segment in that copy match its checksum
+//   - bucket chains and free chain of every segment are well linked
+//   - every used dir points to a valid chunk, whose key matches the dir
+//
+// With repair, bad dirs are dropped, broken segments are relinked, and metadata is flushed.
+// Note: every segment is locked while checking it, better run it offline.
+func (v *Vol) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	if repair && v.readOnly {
+		return nil, ErrVolReadOnly
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	r := &CheckReport{}
+	v.checkMeta(r)
+
+	for i := segId(0); Offset(i) < v.Dm.SegmentsNum; i++ {
+		if err := ctx.Err(); err != nil {
+			return r, err
+		}
+		err := v.checkSegment(ctx, i, repair, r)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	if repair && !r.OK() {
+		err := v.flushMetaToFp()
+		if err != nil {
+			return r, err
+		}
+		r.Repaired = true
+	}
+	return r, nil
+}
+
+// checkMeta verifies the copy of meta holding the newest header: its footer, dirs checksum and segments.
+// The other copy is a flush older, and may be torn by an interrupted flush.
+func (v *Vol) checkMeta(r *CheckReport) {
+	h, c, err := v.readNewestHeader()
+	if err != nil {
+		r.addProblem("meta: no valid header: %v", err)
+		return
+	}
+	name := [2]string{"A", "B"}[c]
+	off := v.metaOffsets(c)
+	f, err := v.readHeaderFooter(off.footer)
+	if err != nil {
+		r.addProblem("meta: footer %s at %d: %v", name, off.footer, err)
+	} else if *f != *h {
+		r.addProblem("meta: footer %s disagrees with header %s, SyncSerial: %d, header SyncSerial: %d", name, name, f.SyncSerial, h.SyncSerial)
+	}
+
+	checksums, matched, err := v.readDirChecksums(off.dirChecksums, h)
+	if err != nil {
+		r.addProblem("meta: dir checksums %s: %v", name, err)
+		return
+	}
+	if !matched {
+		r.addProblem("meta: dir checksums %s not matching header", name)
+	}
+	dirsRaw := make([]byte, Offset(DirSize)*v.ChunksMaxNum)
+	_, err = v.Fp.ReadAt(dirsRaw, int64(off.dirs))
+	if err != nil {
+		r.addProblem("meta: read dirs %s: %v", name, err)
+		return
+	}
+	segSize := v.Dm.segmentBinarySize()
+	for i := Offset(0); i < v.Dm.SegmentsNum; i++ {
+		if crc := crc32.ChecksumIEEE(dirsRaw[i*segSize : (i+1)*segSize]); crc != checksums[i] {
+			r.addProblem("meta: segment %d of %s dirs checksum %#08x, expect %#08x", i, name, crc, checksums[i])
+		}
+	}
+}
+
+// checkSegment verifies chains and chunks of a segment, and relinks it with good dirs when repair.
+func (v *Vol) checkSegment(ctx context.Context, segmentId segId, repair bool, r *CheckReport) error {
+	dm := v.Dm
+	if repair {
+		dm.SegMutexes[segmentId].Lock()
+		defer dm.SegMutexes[segmentId].Unlock()
+	} else {
+		dm.SegMutexes[segmentId].RLock()
+		defer dm.SegMutexes[segmentId].RUnlock()
+	}
+
+	linked, problems := dm.checkSegmentChains(segmentId)
+	broken := len(problems) > 0
+	for _, p := range problems {
+		r.addProblem("%s", p)
+	}
+
+	type goodDir struct {
+		d        Dir
+		bucketId Offset
+	}
+	var good []goodDir
+	used := 0
+	for i, d := range dm.Dirs[segmentId] {
+		if d.offset() == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		used++
+		bucketId, err := v.checkDirChunk(segmentId, *d)
+		if err != nil {
+			r.BadDirs++
+			r.addProblem("segment %d: dir %d: %v", segmentId, i, err)
+			continue
+		}
+		if owner, ok := linked[Offset(i)]; ok && owner != bucketId {
+			broken = true
+			r.addProblem("segment %d: dir %d is linked from bucket %d, but key hashes to bucket %d", segmentId, i, owner, bucketId)
+		}
+		good = append(good, goodDir{d: *d, bucketId: bucketId})
+	}
+	r.UsedDirs += used
+	if broken {
+		r.BadSegments++
+	}
+
+	if !repair || (!broken && len(good) == used) {
+		return nil
+	}
+
+	// relink the segment with good dirs only, free chain is rebuilt as well.
+	dm.initEmptySegment(segmentId)
+	dm.segDirty[segmentId] = true
+	for _, g := range good {
+		g.d.setNext(0)
+		_, err := dm.dirInsert(g.d.tag(), segmentId, g.bucketId, g.d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDirChunk reads the chunk a dir points to, and verifies it belongs to the dir.
+// Returns the bucket the chunk key hashes to.
+func (v *Vol) checkDirChunk(segmentId segId, d Dir) (bucketId Offset, err error) {
+	off := Offset(d.offset())
+	if off < v.DataOffset || off >= v.Length {
+		return 0, fmt.Errorf("chunk offset %d is out of data range", off)
+	}
+	ck := &Chunk{Keys: v.keys}
+	err = ck.ReadAt(v.Fp, int64(off), int64(d.approxSize()))
+	if err != nil {
+		return 0, fmt.Errorf("chunk at %d: %w", off, err)
+	}
+	key, _ := ck.GetKeyData()
+	tag, seg, bucketId := calcDirHashPosition(key, v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+	if tag != d.tag() || seg != segmentId {
+		return 0, fmt.Errorf("chunk at %d: key %q does not match the dir", off, key)
+	}
+	return bucketId, nil
+}
@@ -0,0 +1,136 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestVolCheckRepair(t *testing.T) {
+	path := "/tmp/bakemono-test-check.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	for i := 0; i < 50; i++ {
+		err = v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := v.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("vol should be ok, problems: %v", r.Problems)
+	}
+	usedDirs := r.UsedDirs
+
+	// 1. corrupt a chunk
+	_, _, d := v.Dm.Get([]byte("key-7"))
+	_, err = v.Fp.WriteAt([]byte("bit rot"), int64(d.offset())+ChunkHeaderSizeFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2. corrupt the footer of the current meta copy
+	_, err = v.Fp.WriteAt([]byte{0xff, 0xff}, int64(v.metaOffsets(v.metaCopy).footer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = v.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || r.BadDirs != 1 {
+		t.Fatalf("should find 1 bad dir and bad footer, bad dirs: %d, problems: %v", r.BadDirs, r.Problems)
+	}
+	t.Logf("problems: %v", r.Problems)
+
+	r, err = v.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Repaired {
+		t.Fatal("vol should be repaired")
+	}
+
+	r, err = v.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("vol should be ok after repair, problems: %v", r.Problems)
+	}
+	if r.UsedDirs != usedDirs-1 {
+		t.Fatalf("used dirs should be %d, got %d", usedDirs-1, r.UsedDirs)
+	}
+	hit, data, err := v.Get([]byte("key-8"))
+	if err != nil || !hit || string(data) != "value-8" {
+		t.Fatalf("key-8 should hit after repair, hit: %v, err: %v", hit, err)
+	}
+}
+
+func TestVolCheckBrokenChain(t *testing.T) {
+	path := "/tmp/bakemono-test-check-chain.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	err = v.Set([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dirOffset, _ := v.Dm.Get([]byte("key"))
+
+	// hang up a free dir, and make the chain of key loop
+	dirs := v.Dm.Dirs[0]
+	freeDir := Offset(v.Dm.DirFreeStart[0])
+	v.Dm.DirFreeStart[0] = dirs[freeDir].next()
+	dirs[dirOffset].setNext(uint16(dirOffset))
+
+	r, err := v.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.BadSegments != 1 {
+		t.Fatalf("should find 1 bad segment, problems: %v", r.Problems)
+	}
+	t.Logf("problems: %v", r.Problems)
+
+	_, err = v.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = v.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.OK() {
+		t.Fatalf("vol should be ok after repair, problems: %v", r.Problems)
+	}
+	hit, data, err := v.Get([]byte("key"))
+	if err != nil || !hit || string(data) != "value" {
+		t.Fatalf("key should hit after repair, hit: %v, err: %v", hit, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = v.Check(ctx, false)
+	if err != context.Canceled {
+		t.Fatalf("check should be canceled, err: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package bakemono
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func openContextTestingVol(t *testing.T) (*Vol, *FaultStore) {
+	s := NewFaultStore(NewMemStore(lossyTestingVolSize), 1)
+	v := &Vol{}
+	_, err := v.InitContext(context.Background(), &VolOptions{Fp: s, FileSize: lossyTestingVolSize, ChunkAvgSize: 64 * 1024, FlushMetaInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, s
+}
+
+func TestVolContextCanceled(t *testing.T) {
+	v, _ := openContextTestingVol(t)
+	defer v.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := v.GetContext(ctx, []byte("key"))
+	if err != context.Canceled {
+		t.Fatalf("get should be canceled, err: %v", err)
+	}
+	err = v.SetContext(ctx, []byte("key"), []byte("value"))
+	if err != context.Canceled {
+		t.Fatalf("set should be canceled, err: %v", err)
+	}
+	if hit, _, _ := v.Dm.Get([]byte("key")); hit {
+		t.Fatal("canceled set should not be visible")
+	}
+	_, err = (&Vol{}).InitContext(ctx, &VolOptions{Fp: NewMemStore(lossyTestingVolSize), FileSize: lossyTestingVolSize, ChunkAvgSize: 64 * 1024})
+	if err != context.Canceled {
+		t.Fatalf("init should be canceled, err: %v", err)
+	}
+}
+
+func TestVolContextSegmentLock(t *testing.T) {
+	v, _ := openContextTestingVol(t)
+	defer v.Close()
+
+	_, seg, _ := calcDirHashPosition([]byte("key"), v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+	v.Dm.SegMutexes[seg].Lock()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := v.GetContext(ctx, []byte("key"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("get should time out waiting for segment lock, err: %v", err)
+	}
+	err = v.SetContext(ctx, []byte("key"), []byte("value"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("set should time out waiting for segment lock, err: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("should return promptly, took %s", time.Since(start))
+	}
+
+	v.Dm.SegMutexes[seg].Unlock()
+	err = v.SetContext(context.Background(), []byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVolContextSlowIO(t *testing.T) {
+	v, s := openContextTestingVol(t)
+	err := v.Set([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reads and writes are slow from now on
+	s.Inject(Fault{Op: FaultRead | FaultWrite, Kind: FaultDelay, Delay: time.Second})
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = v.GetContext(ctx, []byte("key"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("get should time out on slow read, err: %v", err)
+	}
+	err = v.SetContext(ctx, []byte("key2"), []byte("value"))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("set should time out on slow write, err: %v", err)
+	}
+	err = v.CloseContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("close should time out on slow flush, err: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("should return promptly, took %s", time.Since(start))
+	}
+}
+
+func TestVolInitContextRecover(t *testing.T) {
+	path := "/tmp/bakemono-test-init-ctx.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Recover = &RecoverOptions{
+		// cancel during the scan
+		Progress:         func(p RecoverProgress) { time.Sleep(20 * time.Millisecond) },
+		ProgressInterval: time.Nanosecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	v := &Vol{}
+	_, err = v.InitContext(ctx, cfg)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("init should stop recovery when ctx is done, err: %v", err)
+	}
+	_ = cfg.Fp.Close()
+}
@@ -0,0 +1,145 @@
+package bakemono
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var crashRounds = flag.Int("crash-rounds", 25, "crash points replayed per case of TestVolCrashConsistency")
+
+// crashImage is the image of size after the first n writes, and a random prefix of the next one if torn.
+// Writes reach the disk in the order issued, a crash keeps a prefix of them.
+func crashImage(size int64, writes []MemWrite, n int, torn bool, rnd *rand.Rand) []byte {
+	image := make([]byte, size)
+	for _, w := range writes[:n] {
+		copy(image[w.Off:], w.Data)
+	}
+	if torn && n < len(writes) {
+		w := writes[n]
+		copy(image[w.Off:], w.Data[:rnd.Intn(len(w.Data)+1)])
+	}
+	return image
+}
+
+// crashValue is the version ver of the value of key i, unique for every Set.
+func crashValue(rnd *rand.Rand, i, ver int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("key-%d/v%d,", i, ver)), 1+rnd.Intn(3000))
+}
+
+func TestVolCrashConsistency(t *testing.T) {
+	const fileSize, avgSize = 4 * 1024 * 1024, 16 * 1024
+	for _, c := range []struct {
+		name    string
+		options func(cfg *VolOptions)
+	}{
+		{"plain", func(cfg *VolOptions) {}},
+		{"journal", func(cfg *VolOptions) {
+			cfg.JournalSize = 64 * JournalRecordSize
+		}},
+		{"recover", func(cfg *VolOptions) {
+			cfg.JournalSize = 64 * JournalRecordSize
+			cfg.Recover = &RecoverOptions{}
+		}},
+		{"compress-encrypt", func(cfg *VolOptions) {
+			cfg.Compress = &CompressOptions{Codec: FlateCodec{}}
+			cfg.Encryption = &EncryptionOptions{Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, KeyID: 1}
+			cfg.Recover = &RecoverOptions{}
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			options := func(fp OffsetReaderWriterCloser) *VolOptions {
+				cfg := NewMemVolOptions(fileSize, avgSize)
+				cfg.Fp = fp
+				c.options(cfg)
+				return cfg
+			}
+
+			// every value ever set for a key, any of them may be served after a crash
+			model := map[int]map[string]bool{}
+			store := NewMemStore(fileSize)
+			store.Record()
+			v := &Vol{}
+			_, err := v.Init(options(store))
+			if err != nil {
+				t.Fatal(err)
+			}
+			const keys = 64
+			for op := 0; op < 600; op++ {
+				i := rnd.Intn(keys)
+				switch r := rnd.Intn(20); {
+				case r < 14:
+					value := crashValue(rnd, i, op)
+					if model[i] == nil {
+						model[i] = map[string]bool{}
+					}
+					model[i][string(value)] = true
+					err = v.Set([]byte(fmt.Sprintf("key-%d", i)), value)
+				case r < 16:
+					items := make([]Item, 1+rnd.Intn(4))
+					for j := range items {
+						k := (i + j) % keys
+						value := crashValue(rnd, k, op)
+						if model[k] == nil {
+							model[k] = map[string]bool{}
+						}
+						model[k][string(value)] = true
+						items[j] = Item{Key: []byte(fmt.Sprintf("key-%d", k)), Value: value}
+					}
+					err = v.MultiSet(items)
+				case r < 19:
+					err = v.Delete([]byte(fmt.Sprintf("key-%d", i)))
+				default:
+					err = v.Flush()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = v.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var writes []MemWrite
+			for _, w := range store.Records() {
+				if !w.Sync {
+					writes = append(writes, w)
+				}
+			}
+			t.Logf("%d writes recorded", len(writes))
+
+			for round := 0; round < *crashRounds; round++ {
+				n := rnd.Intn(len(writes) + 1)
+				torn := rnd.Intn(2) == 0
+				image := crashImage(fileSize, writes, n, torn, rnd)
+				v := &Vol{}
+				_, err := v.Init(options(NewMemStoreFrom(image)))
+				if err != nil {
+					t.Fatalf("crash after %d writes, torn: %v: init failed: %v", n, torn, err)
+				}
+				for i := 0; i < keys; i++ {
+					hit, data, _ := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+					if hit && !model[i][string(data)] {
+						t.Fatalf("crash after %d writes, torn: %v: key-%d hit a value never set, %d bytes", n, torn, i, len(data))
+					}
+				}
+				// the vol stays writable after the crash
+				err = v.Set([]byte("key-after-crash"), []byte("value"))
+				if err != nil {
+					t.Fatalf("crash after %d writes, torn: %v: set failed: %v", n, torn, err)
+				}
+				hit, data, err := v.Get([]byte("key-after-crash"))
+				if err != nil || !hit || string(data) != "value" {
+					t.Fatalf("crash after %d writes, torn: %v: get of a new key failed, hit: %v, err: %v", n, torn, hit, err)
+				}
+				err = v.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package bakemono
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+/*
+Export stream format, all integers big endian:
+
+	stream header: magic "BKMX"(4) version(2) reserved(2)
+	record:        type(1)=1 key_len(4) meta_len(4) value_len(4) key meta value crc(4)
+	end record:    type(1)=0xff count(8) crc(4)
+
+crc is crc32 IEEE of the record from its type byte. meta is ObjectMeta in binary.
+Keys of namespaces are exported as they are in vol, and moved to the current generation on import.
+A reader refuses a stream with a newer version.
+*/
+
+const (
+	ExportMagic   = "BKMX"
+	ExportVersion = 1
+
+	exportRecordKV  = 1
+	exportRecordEnd = 0xff
+)
+
+// Export writes all live keys with their meta and values to w, see the stream format above.
+// Keys changed during Export may or may not be exported. Returns the number of keys exported.
+func (v *Vol) Export(w io.Writer) (n int, err error) {
+	bw := bufio.NewWriter(w)
+	hdr := make([]byte, 8)
+	copy(hdr, ExportMagic)
+	binary.BigEndian.PutUint16(hdr[4:], ExportVersion)
+	_, err = bw.Write(hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	var writeErr error
+	// each chunk is read once, its value comes with the header confirming the dir
+	err = v.rangeChunks(context.Background(), nil, true, func(key []byte, h *ChunkHeader, value []byte, _ *ObjectMeta) bool {
+		rawMeta := h.GetMeta()
+		rec := make([]byte, 13, 13+len(key)+len(rawMeta)+len(value)+4)
+		rec[0] = exportRecordKV
+		binary.BigEndian.PutUint32(rec[1:], uint32(len(key)))
+		binary.BigEndian.PutUint32(rec[5:], uint32(len(rawMeta)))
+		binary.BigEndian.PutUint32(rec[9:], uint32(len(value)))
+		rec = append(rec, key...)
+		rec = append(rec, rawMeta...)
+		rec = append(rec, value...)
+		rec = binary.BigEndian.AppendUint32(rec, crc32.ChecksumIEEE(rec))
+		_, writeErr = bw.Write(rec)
+		if writeErr != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return n, err
+	}
+
+	end := make([]byte, 9, 13)
+	end[0] = exportRecordEnd
+	binary.BigEndian.PutUint64(end[1:], uint64(n))
+	end = binary.BigEndian.AppendUint32(end, crc32.ChecksumIEEE(end))
+	_, err = bw.Write(end)
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// Import sets every record of a stream written by Export, and returns the number of keys imported.
+// Keys set before a bad record are kept. Tags are dropped if the vol has no tag index.
+func (v *Vol) Import(r io.Reader) (n int, err error) {
+	if v.readOnly {
+		return 0, ErrVolReadOnly
+	}
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 8)
+	_, err = io.ReadFull(br, hdr)
+	if err != nil {
+		return 0, err
+	}
+	if string(hdr[:4]) != ExportMagic {
+		return 0, ErrExportInvalid
+	}
+	if binary.BigEndian.Uint16(hdr[4:]) > ExportVersion {
+		return 0, ErrExportVersion
+	}
+
+	for {
+		t, err := br.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		switch t {
+		case exportRecordKV:
+			key, value, meta, err := readExportRecord(br)
+			if err != nil {
+				return n, err
+			}
+			err = v.importRecord(key, value, meta)
+			if err != nil {
+				return n, err
+			}
+			n++
+		case exportRecordEnd:
+			rec := make([]byte, 13)
+			rec[0] = t
+			_, err = io.ReadFull(br, rec[1:])
+			if err != nil {
+				return n, unexpectedEOF(err)
+			}
+			if crc32.ChecksumIEEE(rec[:9]) != binary.BigEndian.Uint32(rec[9:]) {
+				return n, ErrExportChecksum
+			}
+			if binary.BigEndian.Uint64(rec[1:]) != uint64(n) {
+				return n, ErrExportInvalid
+			}
+			return n, nil
+		default:
+			return n, ErrExportInvalid
+		}
+	}
+}
+
+// readExportRecord reads a key-value record after its type byte, and verifies it.
+func readExportRecord(br *bufio.Reader) (key, value []byte, meta *ObjectMeta, err error) {
+	rec := make([]byte, 13)
+	rec[0] = exportRecordKV
+	_, err = io.ReadFull(br, rec[1:])
+	if err != nil {
+		return nil, nil, nil, unexpectedEOF(err)
+	}
+	keyLen := binary.BigEndian.Uint32(rec[1:])
+	metaLen := binary.BigEndian.Uint32(rec[5:])
+	valueLen := binary.BigEndian.Uint32(rec[9:])
+	if keyLen > ChunkKeyMaxSize || metaLen > ChunkMetaMaxSize || valueLen > ChunkDataSize {
+		return nil, nil, nil, ErrExportInvalid
+	}
+	body := make([]byte, int(keyLen+metaLen+valueLen)+4)
+	_, err = io.ReadFull(br, body)
+	if err != nil {
+		return nil, nil, nil, unexpectedEOF(err)
+	}
+	crc := binary.BigEndian.Uint32(body[len(body)-4:])
+	body = body[:len(body)-4]
+	h := crc32.NewIEEE()
+	h.Write(rec)
+	h.Write(body)
+	if h.Sum32() != crc {
+		return nil, nil, nil, ErrExportChecksum
+	}
+
+	key, rawMeta, value := body[:keyLen], body[keyLen:keyLen+metaLen], body[keyLen+metaLen:]
+	meta = &ObjectMeta{}
+	err = meta.UnmarshalBinary(rawMeta)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, value, meta, nil
+}
+
+func (v *Vol) importRecord(key, value []byte, meta *ObjectMeta) error {
+	if name, _, rest, ok := splitNamespaceKey(key); ok {
+		key = v.Namespace(name).key(rest)
+	}
+	if v.tags == nil {
+		meta.Tags = nil
+	}
+	return v.SetWithMeta(key, value, meta)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
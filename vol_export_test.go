@@ -0,0 +1,140 @@
+package bakemono
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestVolExportImport(t *testing.T) {
+	srcPath, dstPath := "/tmp/bakemono-test-export-src.vol", "/tmp/bakemono-test-export-dst.vol"
+	defer os.Remove(srcPath)
+	defer os.Remove(dstPath)
+	src, _, _ := CreateTestingVol(srcPath, 1024*1024*100, 1024*1024)
+	defer src.Close()
+
+	for i := 0; i < 30; i++ {
+		err := src.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)), &ObjectMeta{Status: 200, ETag: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Namespace("ns").Set([]byte("key"), []byte("ns-value")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := src.Export(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 31 {
+		t.Fatalf("exported should be 31, got %d", n)
+	}
+	stream := buf.Bytes()
+
+	// a vol of another size and chunk size, the namespace is at another generation
+	cfg, err := NewDefaultVolOptions(dstPath, 1024*1024*64, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &Vol{}
+	_, err = dst.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.InvalidateNamespace("ns"); err != nil {
+		t.Fatal(err)
+	}
+	n, err = dst.Import(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 31 {
+		t.Fatalf("imported should be 31, got %d", n)
+	}
+	for i := 0; i < 30; i++ {
+		hit, value, meta, err := dst.GetWithMeta([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil || !hit || string(value) != fmt.Sprintf("value-%d", i) || meta.ETag != fmt.Sprint(i) {
+			t.Fatalf("key-%d not imported, hit: %v, err: %v", i, hit, err)
+		}
+	}
+	hit, value, err := dst.Namespace("ns").Get([]byte("key"))
+	if err != nil || !hit || string(value) != "ns-value" {
+		t.Fatal("namespace key not imported", hit, err)
+	}
+
+	// broken streams
+	bad := append([]byte{}, stream...)
+	bad[20] ^= 0xff
+	_, err = dst.Import(bytes.NewReader(bad))
+	if err != ErrExportChecksum {
+		t.Fatal("flipped byte should fail checksum", err)
+	}
+	_, err = dst.Import(bytes.NewReader(stream[:len(stream)-5]))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatal("truncated stream should fail", err)
+	}
+	bad = append([]byte{}, stream...)
+	bad[5] = ExportVersion + 1
+	_, err = dst.Import(bytes.NewReader(bad))
+	if err != ErrExportVersion {
+		t.Fatal("newer version should be refused", err)
+	}
+}
+
+func TestVolExportEncrypted(t *testing.T) {
+	cfg := NewMemVolOptions(1024*1024*16, 64*1024)
+	cfg.Compress = &CompressOptions{Codec: FlateCodec{}}
+	cfg.Encryption = &EncryptionOptions{Keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)}, KeyID: 1}
+	src := &Vol{}
+	_, err := src.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 20; i++ {
+		value := bytes.Repeat([]byte(fmt.Sprintf("value-%d,", i)), 100)
+		err = src.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), value, &ObjectMeta{ETag: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a chunk failing to verify is skipped
+	_, _, d := src.Dm.Get([]byte("key-3"))
+	_, err = src.Fp.WriteAt([]byte("bit rot"), int64(d.offset())+ChunkHeaderSizeFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := src.Export(buf)
+	if err != nil || n != 19 {
+		t.Fatalf("exported should be 19, got %d, err: %v", n, err)
+	}
+	dst := &Vol{}
+	_, err = dst.Init(NewMemVolOptions(1024*1024*16, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	_, err = dst.Import(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		hit, value, meta, err := dst.GetWithMeta([]byte(fmt.Sprintf("key-%d", i)))
+		if i == 3 {
+			if hit {
+				t.Fatal("key-3 should not be exported")
+			}
+			continue
+		}
+		if err != nil || !hit || !bytes.Equal(value, bytes.Repeat([]byte(fmt.Sprintf("value-%d,", i)), 100)) || meta.ETag != fmt.Sprint(i) {
+			t.Fatalf("key-%d should be exported in the clear, hit: %v, err: %v", i, hit, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package bakemono
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+)
+
+/*
+Format versions of a vol, the version of header A is the version of the whole vol.
+
+A newer major version can not be read, Init refuses it instead of resetting the vol as corrupted.
+An older minor version is upgraded in place by Init: its header is decoded by the registered decoder
+of that version, and its meta loaded by the registered loader if the layout differs.
+Then the migration of every minor version up to MinorVersion runs on the loaded meta,
+and meta is flushed in the current format. A read-only vol is upgraded in memory only.
+
+	0.1  released format. Header of its binary size with a checksum of fmt output,
+	     one checksum of all dirs, chunk header version 0
+	0.2  header padded to VolHeaderSizeFixed with a binary checksum, per-segment dir checksums,
+	     journal and tag index regions before data, chunk header version 1
+*/
+
+// MinUpgradableMinorVersion is the oldest minor version Init upgrades.
+const MinUpgradableMinorVersion = 1
+
+// volHeaderVersionSize is the size of the fields before SyncSerial, same in every version.
+const volHeaderVersionSize = 28
+
+// formatUpgrade upgrades a vol of minor version From to From+1.
+type formatUpgrade struct {
+	// decodeHeader decodes a header written in minor version From into the current header.
+	decodeHeader func(data []byte) (*VolHeaderFooter, error)
+	// loadMeta loads meta written in minor version From, nil if it is read as in the current version.
+	loadMeta func(ctx context.Context, v *Vol, h *VolHeaderFooter) error
+	// migrate changes meta loaded from minor version From, nil if only the header changes.
+	migrate func(v *Vol) error
+}
+
+var formatUpgrades = map[uint32]formatUpgrade{}
+
+func registerFormatUpgrade(from uint32, u formatUpgrade) {
+	if _, ok := formatUpgrades[from]; ok {
+		panic(fmt.Sprintf("format upgrade from minor version %d registered twice", from))
+	}
+	formatUpgrades[from] = u
+}
+
+func init() {
+	registerFormatUpgrade(1, formatUpgrade{decodeHeader: decodeVolHeaderV1, loadMeta: loadMetaV1, migrate: migrateV1})
+}
+
+// checkVolVersion checks the version fields of a marshaled header.
+// Returns the minor version, or an error if it is newer or too old.
+func checkVolVersion(data []byte) (minor uint32, err error) {
+	if len(data) < volHeaderVersionSize {
+		return 0, ErrVolFileCorrupted
+	}
+	major := binary.BigEndian.Uint32(data[20:])
+	minor = binary.BigEndian.Uint32(data[24:])
+	if major > MajorVersion || major == MajorVersion && minor > MinorVersion {
+		return 0, fmt.Errorf("%w: %d.%d, supported %d.%d", ErrVolVersionTooNew, major, minor, MajorVersion, MinorVersion)
+	}
+	if major < MajorVersion || minor < MinUpgradableMinorVersion {
+		return 0, fmt.Errorf("%w: %d.%d, oldest upgradable %d.%d, remove the file to start over", ErrVolVersionUnsupported, major, minor, MajorVersion, MinUpgradableMinorVersion)
+	}
+	return minor, nil
+}
+
+// upgradeFormat runs the migrations from the minor version of the loaded header up to MinorVersion.
+// Dirs changed are marked dirty, the caller flushes them with the header in the current format.
+func (v *Vol) upgradeFormat() error {
+	from := v.Header.MinorVersion
+	for minor := from; minor < MinorVersion; minor++ {
+		u, ok := formatUpgrades[minor]
+		if !ok {
+			return fmt.Errorf("%w: no upgrade from %d.%d", ErrVolVersionUnsupported, MajorVersion, minor)
+		}
+		if u.migrate != nil {
+			err := u.migrate(v)
+			if err != nil {
+				return fmt.Errorf("upgrade from %d.%d: %w", MajorVersion, minor, err)
+			}
+		}
+	}
+	v.Header.MinorVersion = MinorVersion
+	log.Printf("info: vol upgraded from %d.%d to %d.%d", MajorVersion, from, MajorVersion, MinorVersion)
+	return nil
+}
+
+// volHeaderV1 is the header of 0.1, checksummed by fmt output of its fields.
+type volHeaderV1 struct {
+	Magic          uint32
+	CreateUnixTime int64
+	WritePos       Offset
+	MajorVersion   uint32
+	MinorVersion   uint32
+	SyncSerial     uint64
+	DirsChecksum   uint32
+	Checksum       uint32
+}
+
+func (h *volHeaderV1) generateChecksum() uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v", h.Magic, h.CreateUnixTime, h.WritePos, h.MajorVersion, h.MinorVersion, h.SyncSerial)))
+}
+
+func decodeVolHeaderV1(data []byte) (*VolHeaderFooter, error) {
+	h := &volHeaderV1{}
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Checksum != h.generateChecksum() {
+		return nil, errors.New("invalid checksum")
+	}
+	return &VolHeaderFooter{
+		Magic:          h.Magic,
+		CreateUnixTime: h.CreateUnixTime,
+		WritePos:       h.WritePos,
+		MajorVersion:   h.MajorVersion,
+		MinorVersion:   h.MinorVersion,
+		SyncSerial:     h.SyncSerial,
+		DirsChecksum:   h.DirsChecksum,
+		Checksum:       h.Checksum,
+	}, nil
+}
+
+// loadMetaV1 reads dirs of 0.1, laid out as header, dirs and footer of meta A, the same of meta B, then data.
+// Confirmed chunks are kept for migrateV1, dirs of the current layout stay empty until then.
+func loadMetaV1(ctx context.Context, v *Vol, h *VolHeaderFooter) error {
+	headerSize := Offset(binary.Size(&volHeaderV1{}))
+	old := &DirManager{}
+	n := old.Init((v.Length - 4*headerSize) / (v.ChunkAvgSize + 2*Offset(DirSize)))
+	raw := make([]byte, n*Offset(DirSize))
+	_, err := contextReaderWriterAt{ctx, v.Fp}.ReadAt(raw, int64(headerSize))
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(raw) != h.DirsChecksum {
+		return errors.New("invalid dir checksum")
+	}
+	err = old.UnmarshalBinary(raw)
+	if err != nil {
+		return err
+	}
+
+	dm := v.Dm
+	v.Dm = old
+	chunks, err := v.liveChunks(ctx)
+	v.Dm = dm
+	if err != nil {
+		return err
+	}
+	v.upgradeChunks = chunks
+	v.Dm.markDirty()
+	v.resetMetaCopies()
+	return nil
+}
+
+// migrateV1 links chunks of 0.1 in the current layout. Chunks in the way of the current meta are moved to the write position,
+// chunks overwritten by them are dropped. A read-only vol links every chunk where it is.
+func migrateV1(v *Vol) error {
+	chunks := v.upgradeChunks
+	v.upgradeChunks = nil
+	placed := chunks
+	if !v.readOnly {
+		var stats ResizeStats
+		var err error
+		placed, v.WritePos, err = v.relocateChunks(chunks, v.WritePos, &stats)
+		if err != nil {
+			return err
+		}
+		log.Printf("info: chunks of 0.1 relocated, stats: %+v", stats)
+	}
+	for _, ck := range placed {
+		_, err := v.Dm.Set(ck.key, ck.off, int(ck.size))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
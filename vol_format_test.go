@@ -0,0 +1,296 @@
+package bakemono
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden header of the current version")
+
+// goldenVolHeader is the header in testdata/vol_header_v0.<minor>.golden, with fields of that version only.
+// The one of 0.1 is written by 0.1.
+func goldenVolHeader(minor uint32) *VolHeaderFooter {
+	h := &VolHeaderFooter{
+		Magic:          MagicBocchi,
+		CreateUnixTime: 1700000000,
+		WritePos:       0x123000,
+		MajorVersion:   MajorVersion,
+		MinorVersion:   minor,
+		SyncSerial:     42,
+		DirsChecksum:   0xdeadbeef,
+	}
+	if minor >= 2 {
+		h.WriteSerial = 1700000000123456789
+		h.FileSize = 64 << 20
+		h.ChunkAvgSize = 1 << 16
+		h.JournalSize = 1 << 20
+		h.JournalSeq = 1700000000987654321
+		h.JournalPos = 77
+		h.TagIndexSize = 1 << 16
+		h.TagIndexPos = 1
+		h.TagIndexLength = 123
+		h.TagIndexChecksum = 0xcafebabe
+		h.Namespaces[0] = NamespaceGeneration{NameHash: 0x1122334455667788, Generation: 3}
+		h.Namespaces[5] = NamespaceGeneration{NameHash: 0x99, Generation: 1}
+		h.CleanShutdown = true
+	}
+	return h
+}
+
+func TestVolHeaderGolden(t *testing.T) {
+	for minor := uint32(MinUpgradableMinorVersion); minor <= MinorVersion; minor++ {
+		path := fmt.Sprintf("testdata/vol_header_v%d.%d.golden", MajorVersion, minor)
+		want := goldenVolHeader(minor)
+		if minor == MinorVersion && *updateGolden {
+			b, err := want.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(path, b, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &VolHeaderFooter{}
+		err = got.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		want.Checksum = got.Checksum
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: decoded header mismatch\ngot:  %+v\nwant: %+v", path, got, want)
+		}
+
+		if minor == MinorVersion {
+			// the current version must still encode the same bytes
+			b, err := goldenVolHeader(minor).MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("%s: encoding changed, bump MinorVersion and register an upgrade", path)
+			}
+		}
+	}
+}
+
+func TestFormatUpgradesRegistered(t *testing.T) {
+	for minor := uint32(MinUpgradableMinorVersion); minor < MinorVersion; minor++ {
+		u, ok := formatUpgrades[minor]
+		if !ok || u.decodeHeader == nil {
+			t.Fatalf("no upgrade from %d.%d", MajorVersion, minor)
+		}
+	}
+}
+
+func TestVolHeaderVersionCheck(t *testing.T) {
+	h := goldenVolHeader(MinorVersion)
+	for _, c := range []struct {
+		major, minor uint32
+		err          error
+	}{
+		{MajorVersion + 1, 0, ErrVolVersionTooNew},
+		{MajorVersion, MinorVersion + 1, ErrVolVersionTooNew},
+		{MajorVersion, MinUpgradableMinorVersion - 1, ErrVolVersionUnsupported},
+	} {
+		h.MajorVersion, h.MinorVersion = c.major, c.minor
+		h.Checksum = h.GenerateChecksum()
+		buf := bytes.NewBuffer(nil)
+		err := binary.Write(buf, binary.BigEndian, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = (&VolHeaderFooter{}).UnmarshalBinary(buf.Bytes())
+		if !errors.Is(err, c.err) {
+			t.Fatalf("version %d.%d: expect %v, got %v", c.major, c.minor, c.err, err)
+		}
+	}
+}
+
+// writeVolHeaders writes a marshaled header to every header and footer copy of the vol file.
+func writeVolHeaders(t *testing.T, path string, v *Vol, data []byte) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	for _, off := range []Offset{v.HeaderAOffset, v.FooterAOffset, v.HeaderBOffset, v.FooterBOffset} {
+		_, err = fp.WriteAt(data, int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVolInitRefusesNewerVersion(t *testing.T) {
+	path := "/tmp/bakemono-test-format-newer.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*16, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Set([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := *v.Header
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.MajorVersion = MajorVersion + 1
+	h.Checksum = h.GenerateChecksum()
+	buf := bytes.NewBuffer(nil)
+	err = binary.Write(buf, binary.BigEndian, &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeVolHeaders(t, path, v, buf.Bytes())
+
+	cfg, err = NewDefaultVolOptions(path, 1024*1024*16, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = &Vol{}
+	_, err = v.Init(cfg)
+	if !errors.Is(err, ErrVolVersionTooNew) {
+		t.Fatalf("init should refuse a newer major version, got %v", err)
+	}
+	cfg.Fp.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:buf.Len()], buf.Bytes()) {
+		t.Fatal("header of a newer version should not be overwritten")
+	}
+}
+
+// goldenV1Value is the value of key-<i> in testdata/vol_v0.1.img.gz.
+func goldenV1Value(i int) []byte {
+	s := fmt.Sprintf("value-%d", i)
+	n := 1000 * (i%7 + 1)
+	return bytes.Repeat([]byte(s), n/len(s)+1)[:n]
+}
+
+// openGoldenV1 writes testdata/vol_v0.1.img.gz to path, a vol of 4MB with chunks of 16KB written by 0.1,
+// with key-0 to key-39 set and meta flushed, and opens it.
+func openGoldenV1(t *testing.T, path string, readOnly bool) *Vol {
+	f, err := os.Open("testdata/vol_v0.1.img.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, img, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openV1(t, path, readOnly)
+}
+
+func openV1(t *testing.T, path string, readOnly bool) *Vol {
+	cfg, err := NewDefaultVolOptions(path, 4<<20, 16<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ReadOnly = readOnly
+	v := &Vol{}
+	corrupted, err := v.Init(cfg)
+	if err != nil || corrupted {
+		t.Fatalf("init vol of 0.1, corrupted: %v, err: %v", corrupted, err)
+	}
+	return v
+}
+
+// minorVersionOnDisk returns the minor version of header A of the vol file.
+func minorVersionOnDisk(t *testing.T, path string) uint32 {
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	h, err := ReadVolHeader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.MinorVersion
+}
+
+func TestVolUpgradeFromV1(t *testing.T) {
+	path := "/tmp/bakemono-test-format-v1.vol"
+	defer os.Remove(path)
+	check := func(v *Vol) {
+		for i := 0; i < 40; i++ {
+			hit, data, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+			if err != nil || !hit || !bytes.Equal(data, goldenV1Value(i)) {
+				t.Fatalf("key-%d should be kept by the upgrade, hit: %v, err: %v", i, hit, err)
+			}
+		}
+	}
+
+	// read-only serves chunks where they are, and leaves the file as is
+	v := openGoldenV1(t, path, true)
+	if v.Header.MinorVersion != MinorVersion {
+		t.Fatalf("header should be upgraded in memory, got %d", v.Header.MinorVersion)
+	}
+	check(v)
+	err := v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minor := minorVersionOnDisk(t, path); minor != 1 {
+		t.Fatalf("read-only vol should not be upgraded on disk, got %d", minor)
+	}
+
+	// chunks in the way of the current meta are moved
+	v = openGoldenV1(t, path, false)
+	check(v)
+	err = v.Set([]byte("key-new"), []byte("value-new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if minor := minorVersionOnDisk(t, path); minor != MinorVersion {
+		t.Fatalf("header on disk should be upgraded in place, got %d", minor)
+	}
+
+	v = openV1(t, path, false)
+	check(v)
+	hit, data, err := v.Get([]byte("key-new"))
+	if err != nil || !hit || string(data) != "value-new" {
+		t.Fatalf("key set after upgrade, hit: %v, err: %v", hit, err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 )
 
 type VolHeaderFooter struct {
@@ -15,38 +16,115 @@ type VolHeaderFooter struct {
 	MajorVersion   uint32
 	MinorVersion   uint32
 	SyncSerial     uint64
+	WriteSerial    uint64 // serial of the last chunk written before this flush
 	DirsChecksum   uint32
 
+	// layout the vol is created with
+	FileSize     Offset
+	ChunkAvgSize Offset
+
+	// journal records from JournalSeq, at slot JournalPos, are not covered by dirs yet
+	JournalSize Offset
+	JournalSeq  uint64
+	JournalPos  uint64
+
+	// tag index copy TagIndexPos(0 or 1) holds TagIndexLength bytes
+	TagIndexSize     Offset
+	TagIndexPos      uint32
+	TagIndexLength   uint64
+	TagIndexChecksum uint32
+
+	// Namespaces are generations of invalidated namespaces
+	Namespaces [MaxNamespaces]NamespaceGeneration
+
+	// CleanShutdown is set by the final flush in Close, and cleared once the vol is opened for writing.
+	CleanShutdown bool
+
 	Checksum uint32
 }
 
+// ReadVolHeader reads header A of a vol, to find the layout it is created with.
+// Layout fields are 0 in a header of an older version.
+func ReadVolHeader(r io.ReaderAt) (*VolHeaderFooter, error) {
+	data := make([]byte, VolHeaderSizeFixed)
+	_, err := r.ReadAt(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	h := &VolHeaderFooter{}
+	err = h.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// GenerateChecksum returns crc32 of the header in binary, with Checksum as 0.
 func (v *VolHeaderFooter) GenerateChecksum() uint32 {
-	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%v,%v,%v,%v,%v,%v", v.Magic, v.CreateUnixTime, v.WritePos, v.MajorVersion, v.MinorVersion, v.SyncSerial)))
+	h := *v
+	h.Checksum = 0
+	buf := bytes.NewBuffer(make([]byte, 0, binary.Size(&h)))
+	_ = binary.Write(buf, binary.BigEndian, &h)
+	return crc32.ChecksumIEEE(buf.Bytes())
 }
 
+// MarshalBinary returns the binary of the header in the current version, padded to VolHeaderSizeFixed.
 func (v *VolHeaderFooter) MarshalBinary() (data []byte, err error) {
-	buf := &bytes.Buffer{}
+	buf := bytes.NewBuffer(make([]byte, 0, VolHeaderSizeFixed))
 	v.Magic = MagicBocchi
+	v.MajorVersion = MajorVersion
+	v.MinorVersion = MinorVersion
 	v.Checksum = v.GenerateChecksum()
 
 	err = binary.Write(buf, binary.BigEndian, *v)
 	if err != nil {
 		return nil, err
 	}
+	buf.Write(make([]byte, VolHeaderSizeFixed-buf.Len()))
 	return buf.Bytes(), nil
 }
 
+// UnmarshalBinary decodes a header of the current version, or of an older minor version by its registered decoder.
+// MinorVersion is kept as on disk, see Vol.upgradeFormat.
+// Returns ErrVolVersionTooNew for a newer version, and ErrVolVersionUnsupported for one too old to upgrade.
 func (v *VolHeaderFooter) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	err := binary.Read(buf, binary.BigEndian, v)
+	if len(data) < volHeaderVersionSize || binary.BigEndian.Uint32(data) != MagicBocchi {
+		return errors.New("invalid magic")
+	}
+	minor, err := checkVolVersion(data)
 	if err != nil {
 		return err
 	}
-	if v.Magic != MagicBocchi {
-		return errors.New("invalid magic")
+	if minor < MinorVersion {
+		u, ok := formatUpgrades[minor]
+		if !ok || u.decodeHeader == nil {
+			return fmt.Errorf("%w: no decoder of %d.%d", ErrVolVersionUnsupported, MajorVersion, minor)
+		}
+		h, err := u.decodeHeader(data)
+		if err != nil {
+			return err
+		}
+		*v = *h
+		return nil
 	}
-	if v.Checksum != v.GenerateChecksum() {
-		return errors.New("invalid checksum")
+
+	h, err := decodeVolHeader(data)
+	if err != nil {
+		return err
 	}
+	*v = *h
 	return nil
 }
+
+// decodeVolHeader decodes a header of the current version, with a binary checksum.
+func decodeVolHeader(data []byte) (*VolHeaderFooter, error) {
+	h := &VolHeaderFooter{}
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Checksum != h.GenerateChecksum() {
+		return nil, errors.New("invalid checksum")
+	}
+	return h, nil
+}
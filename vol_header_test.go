@@ -1,6 +1,9 @@
 package bakemono
 
 import (
+	"encoding/binary"
+	"fmt"
+	"os"
 	"reflect"
 	"testing"
 )
@@ -45,3 +48,45 @@ func TestVolHeaderFooterUnmarshal(t *testing.T) {
 	}
 	t.Log("v2 is equal to v")
 }
+
+func TestVolHeaderFooterSize(t *testing.T) {
+	if binary.Size(&VolHeaderFooter{}) > VolHeaderSizeFixed {
+		t.Fatal("VolHeaderFooter is larger than VolHeaderSizeFixed")
+	}
+	b, err := (&VolHeaderFooter{}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != VolHeaderSizeFixed {
+		t.Fatalf("marshaled header should be padded to %d, got %d", VolHeaderSizeFixed, len(b))
+	}
+}
+
+func FuzzVolHeaderFooterUnmarshalBinary(f *testing.F) {
+	for minor := uint32(MinUpgradableMinorVersion); minor <= MinorVersion; minor++ {
+		data, err := os.ReadFile(fmt.Sprintf("testdata/vol_header_v%d.%d.golden", MajorVersion, minor))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := &VolHeaderFooter{}
+		if h.UnmarshalBinary(data) != nil {
+			return
+		}
+		// a decoded header of any version encodes as the current one, and decodes back the same
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2 := &VolHeaderFooter{}
+		err = h2.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatalf("encoded header fails to decode: %v", err)
+		}
+		if *h2 != *h {
+			t.Fatalf("header mismatch after round trip\ngot:  %+v\nwant: %+v", h2, h)
+		}
+	})
+}
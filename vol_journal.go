@@ -0,0 +1,41 @@
+package bakemono
+
+import "log"
+
+// replayJournal applies journal records on top of dirs loaded from meta.
+// Returns the end of the last chunk set by the journal, 0 if none.
+// Tags of chunks set by the journal are indexed again, the tag index flushed may miss them.
+func (v *Vol) replayJournal() (writeEnd Offset, err error) {
+	var sets []journalRecord
+	n, err := v.journal.replay(func(r journalRecord) {
+		if r.Type == journalSet {
+			end := Offset(r.Offset) + Offset(r.Size)
+			if Offset(r.Offset) < v.DataOffset || end > v.Length {
+				return
+			}
+			writeEnd = end
+			if v.tags != nil {
+				sets = append(sets, r)
+			}
+		}
+		v.Dm.applyJournalRecord(r)
+	})
+	v.indexJournalSets(sets)
+	log.Printf("replay journal done, records: %d", n)
+	return writeEnd, err
+}
+
+// writeJournal writes pending journal records to disk.
+// A failed write only loses records on crash, so it is logged instead of failing the request.
+func (v *Vol) writeJournal() {
+	if v.journal == nil {
+		return
+	}
+	err := v.journal.write()
+	if err == nil {
+		err = v.sync(DurabilityWrite)
+	}
+	if err != nil {
+		log.Printf("warn: write journal failed, err: %v", err)
+	}
+}
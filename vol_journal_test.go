@@ -0,0 +1,181 @@
+package bakemono
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func createJournalTestingVol(t *testing.T, path string, journalSize Offset, readOnly bool) *Vol {
+	var cfg *VolOptions
+	var err error
+	if readOnly {
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = &VolOptions{Fp: fp, FileSize: 1024 * 1024 * 100, ChunkAvgSize: 1024 * 1024, ReadOnly: true}
+	} else {
+		cfg, err = NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.JournalSize = journalSize
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVolJournalReplay(t *testing.T) {
+	path := "/tmp/bakemono-test-journal.vol"
+	defer os.Remove(path)
+	// 16 records, so the ring wraps
+	v := createJournalTestingVol(t, path, 16*JournalRecordSize, false)
+
+	set := func(v *Vol, from, to int) {
+		for i := from; i < to; i++ {
+			err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set(v, 0, 10)
+	err := v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(v, 10, 20)
+	err = v.Delete([]byte("key-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Delete([]byte("key-15"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// open the file as it is after a crash, v is never flushed again
+	v2 := createJournalTestingVol(t, path, 16*JournalRecordSize, true)
+	for i := 0; i < 20; i++ {
+		hit, data, err := v2.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 || i == 15 {
+			if hit {
+				t.Fatalf("key-%d should miss after delete", i)
+			}
+			continue
+		}
+		if !hit || string(data) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("key-%d should hit after replay, hit: %v", i, hit)
+		}
+	}
+	if v2.WritePos != v.WritePos {
+		t.Fatalf("write pos should be restored from journal, got %d, expect %d", v2.WritePos, v.WritePos)
+	}
+	_ = v2.Close()
+	_ = v.Close()
+
+	// without journal, layout is different and refused
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&Vol{}).Init(cfg)
+	if !errors.Is(err, ErrVolLayoutMismatch) {
+		t.Fatal("open with another journal size should fail", err)
+	}
+	_ = cfg.Fp.Close()
+}
+
+// TestVolJournalDropped checks a crash after records are dropped on a full journal never serves
+// a value overwritten or deleted, as Init resets dirs instead of replaying an incomplete journal.
+func TestVolJournalDropped(t *testing.T) {
+	path := "/tmp/bakemono-test-journal-dropped.vol"
+	defer os.Remove(path)
+	v := createJournalTestingVol(t, path, 8*JournalRecordSize, false)
+	defer v.Close()
+
+	for i := 0; i < 4; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("old"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no flush frees the journal meanwhile
+	v.flushMu.Lock()
+	for i := 10; i < 30; i++ {
+		err = v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = v.Set([]byte("key-0"), []byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Delete([]byte("key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// open the file as it is after a crash
+	v2 := createJournalTestingVol(t, path, 8*JournalRecordSize, true)
+	v.flushMu.Unlock()
+	hit, data, _ := v2.Get([]byte("key-0"))
+	if hit && string(data) != "new" {
+		t.Fatalf("key-0 should never hit the overwritten value, got %s", data)
+	}
+	hit, _, _ = v2.Get([]byte("key-1"))
+	if hit {
+		t.Fatal("key-1 should never hit after delete")
+	}
+	_ = v2.Close()
+}
+
+func TestVolJournalFull(t *testing.T) {
+	path := "/tmp/bakemono-test-journal-full.vol"
+	defer os.Remove(path)
+	v := createJournalTestingVol(t, path, 8*JournalRecordSize, false)
+	defer v.Close()
+
+	for i := 0; i < 20; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a full journal triggers a meta flush, which frees the journal
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		v.journal.mu.Lock()
+		full := v.journal.full
+		v.journal.mu.Unlock()
+		if !full {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("journal should be freed by a meta flush")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v.flushMu.Lock()
+	serial := v.Header.SyncSerial
+	v.flushMu.Unlock()
+	if serial < 2 {
+		t.Fatalf("meta should be flushed when journal is full, SyncSerial: %d", serial)
+	}
+}
@@ -0,0 +1,201 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// DefaultNegativeCacheMaxEntries limits loader errors cached when NegativeCacheOptions.MaxEntries is 0.
+const DefaultNegativeCacheMaxEntries = 10000
+
+// NegativeCacheOptions caches loader errors of GetOrLoad in memory,
+// so a failing origin is not hit again by every miss.
+type NegativeCacheOptions struct {
+	// TTL is how long a loader error is returned without calling loader again.
+	TTL time.Duration
+	// MaxEntries limits the errors cached, 0 means DefaultNegativeCacheMaxEntries.
+	// New errors are not cached when it is full of unexpired ones.
+	MaxEntries int
+}
+
+// loadCall is a loader call in flight, shared by all callers of the same key.
+type loadCall struct {
+	done  chan struct{}
+	value []byte
+	err   error
+	// panicked is set if loader panicked, it is panicked again in every waiter
+	panicked *LoaderPanic
+}
+
+// LoaderPanic is the panic of a waiter of GetOrLoad when loader panicked, with the value and stack of it.
+type LoaderPanic struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *LoaderPanic) Error() string {
+	return fmt.Sprintf("loader panicked: %v\n\n%s", p.Value, p.Stack)
+}
+
+// loadGroup collapses concurrent loads of a key into one loader call.
+type loadGroup struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+type negativeEntry struct {
+	err    error
+	expire time.Time
+}
+
+// negativeCache holds loader errors until they expire.
+type negativeCache struct {
+	opts NegativeCacheOptions
+
+	mu      sync.Mutex
+	entries map[string]negativeEntry
+}
+
+func newNegativeCache(opts NegativeCacheOptions) *negativeCache {
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = DefaultNegativeCacheMaxEntries
+	}
+	return &negativeCache{opts: opts, entries: make(map[string]negativeEntry)}
+}
+
+func (c *negativeCache) get(key string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expire) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.err
+}
+
+func (c *negativeCache) set(key string, err error) {
+	if c == nil || c.opts.TTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.opts.MaxEntries {
+		for k, e := range c.entries {
+			if now.After(e.expire) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.opts.MaxEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{err: err, expire: now.Add(c.opts.TTL)}
+}
+
+func (c *negativeCache) delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// GetOrLoad returns the value of key, calls loader on a miss and writes the result through Set.
+// Concurrent misses of the same key share a single loader call, and get the same value.
+// The returned value must not be modified.
+//
+// Disk errors are treated as a miss. A loader error is returned to all waiters,
+// and cached for VolOptions.NegativeCache.TTL if enabled.
+// A loader panic is recovered, and panicked again in all waiters as *LoaderPanic.
+// A waiter returns ctx.Err() once ctx is done, the loader call goes on for the others.
+func (v *Vol) GetOrLoad(ctx context.Context, key []byte, loader func() ([]byte, error)) ([]byte, error) {
+	hit, value, err := v.GetContext(ctx, key)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == ErrChunkKeyTooLarge {
+		return nil, err
+	}
+	if hit {
+		return value, nil
+	}
+	if err := v.negative.get(string(key)); err != nil {
+		return nil, err
+	}
+
+	call := v.loads.start(string(key), func(call *loadCall) {
+		v.load(key, loader, call)
+	})
+	select {
+	case <-call.done:
+		if call.panicked != nil {
+			panic(call.panicked)
+		}
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// load runs in its own goroutine, not bound to the ctx of any caller.
+func (v *Vol) load(key []byte, loader func() ([]byte, error), call *loadCall) {
+	// a flight just finished may have set it
+	hit, value, err := v.Get(key)
+	if err == nil && hit {
+		call.value = value
+		return
+	}
+
+	call.value, call.err = loader()
+	if call.err != nil {
+		v.negative.set(string(key), call.err)
+		return
+	}
+	v.negative.delete(string(key))
+	err = v.Set(key, call.value)
+	if err != nil {
+		log.Printf("warn: set loaded value failed, key: %s, err: %v", key, err)
+	}
+}
+
+// start joins the call in flight of key, or starts a new one running fn.
+func (g *loadGroup) start(key string, fn func(call *loadCall)) *loadCall {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	call := &loadCall{done: make(chan struct{})}
+	g.calls[key] = call
+	go func() {
+		defer func() {
+			// fn runs detached, a panic of it must not kill the process
+			if r := recover(); r != nil {
+				call.panicked = &LoaderPanic{Value: r, Stack: debug.Stack()}
+				log.Printf("error: loader panicked, key: %s, panic: %v", key, r)
+			}
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+		fn(call)
+	}()
+	return call
+}
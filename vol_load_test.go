@@ -0,0 +1,165 @@
+package bakemono
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVolGetOrLoad(t *testing.T) {
+	path := "/tmp/bakemono-test-load.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	var calls int32
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte("value"), nil
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := v.GetOrLoad(context.Background(), []byte("key"), loader)
+			if err != nil || string(value) != "value" {
+				t.Errorf("should get loaded value, value: %s, err: %v", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("concurrent misses should call loader once, called %d", calls)
+	}
+
+	hit, data, err := v.Get([]byte("key"))
+	if err != nil || !hit || string(data) != "value" {
+		t.Fatalf("loaded value should be set, hit: %v, err: %v", hit, err)
+	}
+	_, err = v.GetOrLoad(context.Background(), []byte("key"), loader)
+	if err != nil || calls != 1 {
+		t.Fatalf("hit should not call loader, called %d, err: %v", calls, err)
+	}
+}
+
+func TestVolGetOrLoadNegativeCache(t *testing.T) {
+	path := "/tmp/bakemono-test-load-negative.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.NegativeCache = &NegativeCacheOptions{TTL: 100 * time.Millisecond}
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	errOrigin := errors.New("origin down")
+	var calls int32
+	loader := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errOrigin
+	}
+	for i := 0; i < 3; i++ {
+		_, err = v.GetOrLoad(context.Background(), []byte("key"), loader)
+		if err != errOrigin {
+			t.Fatalf("loader error should be returned, err: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("loader error should be cached, called %d", calls)
+	}
+	time.Sleep(150 * time.Millisecond)
+	_, err = v.GetOrLoad(context.Background(), []byte("key"), loader)
+	if err != errOrigin || calls != 2 {
+		t.Fatalf("loader should be called after ttl, called %d, err: %v", calls, err)
+	}
+}
+
+func TestVolGetOrLoadContext(t *testing.T) {
+	path := "/tmp/bakemono-test-load-ctx.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	loaded := make(chan struct{})
+	loader := func() ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		defer close(loaded)
+		return []byte("value"), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = v.GetOrLoad(ctx, []byte("key"), loader)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("waiter should return when ctx is done, err: %v", err)
+	}
+
+	// loader goes on, and its value is set
+	<-loaded
+	value, err := v.GetOrLoad(context.Background(), []byte("key"), func() ([]byte, error) {
+		return nil, errors.New("should not be called")
+	})
+	if err != nil || string(value) != "value" {
+		t.Fatalf("value of abandoned load should be set, value: %s, err: %v", value, err)
+	}
+}
+
+func TestVolGetOrLoadPanic(t *testing.T) {
+	path := "/tmp/bakemono-test-load-panic.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	release := make(chan struct{})
+	loader := func() ([]byte, error) {
+		<-release
+		panic("origin down")
+	}
+	var wg sync.WaitGroup
+	var panicked int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				p, ok := recover().(*LoaderPanic)
+				if ok && p.Value == "origin down" {
+					atomic.AddInt32(&panicked, 1)
+				}
+			}()
+			_, _ = v.GetOrLoad(context.Background(), []byte("key"), loader)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if panicked != 4 {
+		t.Fatalf("panic of loader should be panicked again in every waiter, got %d", panicked)
+	}
+
+	value, err := v.GetOrLoad(context.Background(), []byte("key"), func() ([]byte, error) {
+		return []byte("value"), nil
+	})
+	if err != nil || string(value) != "value" {
+		t.Fatalf("key should load again after a panic, value: %s, err: %v", value, err)
+	}
+}
@@ -0,0 +1,203 @@
+package bakemono
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+var modelSeed = flag.Int64("model-seed", 1, "seed of TestVolModel")
+var modelRounds = flag.Int("model-rounds", 5, "rounds of TestVolModel")
+var modelDuration = flag.Duration("model-duration", 0, "time budget of TestVolModel for soak runs, it stops before -model-rounds once reached, 0 means no budget")
+
+// volModel is the reference of keys owned by a worker: the latest value of each key, nil once deleted,
+// and digests of every value ever set, to check reads of keys owned by other workers.
+type volModel struct {
+	mu     sync.Mutex
+	latest map[string][]byte
+	ever   map[string]map[uint64]bool
+}
+
+func modelDigest(value []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(value)
+	return h.Sum64()
+}
+
+func (m *volModel) set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latest[key] = value
+	if m.ever[key] == nil {
+		m.ever[key] = make(map[uint64]bool)
+	}
+	m.ever[key][modelDigest(value)] = true
+}
+
+func (m *volModel) setEver(key string, value []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ever[key][modelDigest(value)]
+}
+
+// modelValue is a value unique to key and version, of a random size, mostly small.
+func modelValue(rnd *rand.Rand, key string, ver int) []byte {
+	size := 1 + rnd.Intn(4096)
+	switch r := rnd.Intn(20); {
+	case r == 0:
+		size = 1 + rnd.Intn(512*1024)
+	case r < 5:
+		size = 1 + rnd.Intn(64*1024)
+	}
+	unit := []byte(fmt.Sprintf("%s/v%d,", key, ver))
+	return bytes.Repeat(unit, size/len(unit)+1)[:size]
+}
+
+// TestVolModel runs random Set/Get/Delete by concurrent workers, with Close and reopen in between,
+// against a reference of keys. Keys may be evicted, but a hit must be the latest value set.
+// Every worker owns its keys, and reads keys of others, which must be a value ever set for them.
+// Ops of a round follow from -model-seed, rerun a failure with it and the same -model-rounds.
+// Soak with many -model-rounds and a -model-duration budget, the round reached is logged.
+func TestVolModel(t *testing.T) {
+	const fileSize, avgSize = 8 * 1024 * 1024, 16 * 1024
+	const workers, keysPerWorker, opsPerRound = 4, 32, 200
+	t.Logf("seed: %d", *modelSeed)
+	rnd := rand.New(rand.NewSource(*modelSeed))
+
+	open := func(image []byte) *Vol {
+		cfg := NewMemVolOptions(fileSize, avgSize)
+		cfg.JournalSize = 256 * JournalRecordSize
+		if image != nil {
+			cfg.Fp = NewMemStoreFrom(image)
+		}
+		v := &Vol{}
+		_, err := v.Init(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	models := make([]*volModel, workers)
+	for i := range models {
+		models[i] = &volModel{latest: make(map[string][]byte), ever: make(map[string]map[uint64]bool)}
+	}
+	keyOf := func(worker, i int) string {
+		return fmt.Sprintf("w%d/key-%d", worker, i)
+	}
+
+	// checkOwn checks a read of a key owned by the reader
+	checkOwn := func(m *volModel, key string, hit bool, data []byte) error {
+		latest := m.latest[key]
+		if hit && latest == nil {
+			return fmt.Errorf("%s hit, but it is deleted or never set", key)
+		}
+		if hit && !bytes.Equal(data, latest) {
+			return fmt.Errorf("%s hit %d bytes, not the latest value of %d bytes", key, len(data), len(latest))
+		}
+		return nil
+	}
+	checkAll := func(v *Vol, when string) {
+		for w, m := range models {
+			for i := 0; i < keysPerWorker; i++ {
+				key := keyOf(w, i)
+				hit, data, _ := v.Get([]byte(key))
+				if err := checkOwn(m, key, hit, data); err != nil {
+					t.Fatalf("seed %d, %s: %v", *modelSeed, when, err)
+				}
+			}
+		}
+	}
+
+	v := open(nil)
+	deadline := time.Now().Add(*modelDuration)
+	round, hits, gets := 0, 0, 0
+	for ; round < *modelRounds; round++ {
+		if *modelDuration > 0 && time.Now().After(deadline) {
+			t.Logf("seed %d: -model-duration %s reached, stopped at round %d of %d", *modelSeed, *modelDuration, round, *modelRounds)
+			break
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var errs []error
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int, rnd *rand.Rand) {
+				defer wg.Done()
+				m := models[w]
+				fail := func(err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					errs = append(errs, fmt.Errorf("round %d, worker %d: %w", round, w, err))
+				}
+				for op := 0; op < opsPerRound; op++ {
+					key := keyOf(w, rnd.Intn(keysPerWorker))
+					switch r := rnd.Intn(10); {
+					case r < 5:
+						value := modelValue(rnd, key, round*opsPerRound+op)
+						// recorded before Set, so readers of other workers may see it at once
+						m.set(key, value)
+						if err := v.Set([]byte(key), value); err != nil {
+							fail(err)
+							return
+						}
+					case r < 8:
+						hit, data, _ := v.Get([]byte(key))
+						if err := checkOwn(m, key, hit, data); err != nil {
+							fail(err)
+							return
+						}
+						mu.Lock()
+						gets++
+						if hit {
+							hits++
+						}
+						mu.Unlock()
+					case r < 9:
+						m.mu.Lock()
+						m.latest[key] = nil
+						m.mu.Unlock()
+						if err := v.Delete([]byte(key)); err != nil {
+							fail(err)
+							return
+						}
+					default:
+						other := rnd.Intn(workers)
+						key := keyOf(other, rnd.Intn(keysPerWorker))
+						hit, data, _ := v.Get([]byte(key))
+						if hit && !models[other].setEver(key, data) {
+							fail(fmt.Errorf("%s hit %d bytes never set", key, len(data)))
+							return
+						}
+					}
+				}
+			}(w, rand.New(rand.NewSource(rnd.Int63())))
+		}
+		wg.Wait()
+		if len(errs) > 0 {
+			t.Fatalf("seed %d: %v", *modelSeed, errs[0])
+		}
+		checkAll(v, fmt.Sprintf("round %d", round))
+
+		if rnd.Intn(3) == 0 {
+			err := v.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			v = open(v.Fp.(*MemStore).Bytes())
+			checkAll(v, fmt.Sprintf("reopen after round %d", round))
+		}
+	}
+	err := v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("rounds: %d, gets of own keys: %d, hits: %d", round, gets, hits)
+	if hits == 0 || hits == gets {
+		t.Fatalf("seed %d: gets should both hit and miss, hits: %d of %d", *modelSeed, hits, gets)
+	}
+}
@@ -0,0 +1,169 @@
+package bakemono
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// DefaultIODepth is the reads in flight of MultiGet when VolOptions.IODepth is 0.
+const DefaultIODepth = 8
+
+// GetResult is the result of a key in MultiGet.
+type GetResult struct {
+	Hit   bool
+	Value []byte
+	Err   error // disk error of this key, consider it as a miss
+}
+
+// Item is a key-value pair for MultiSet.
+type Item struct {
+	Key   []byte
+	Value []byte
+}
+
+// MultiGet gets keys in a batch, results are in the same order as keys.
+// Dirs are looked up segment by segment, each segment lock is taken once.
+// Chunks are read in order of disk offset, with at most VolOptions.IODepth reads in flight.
+func (v *Vol) MultiGet(keys [][]byte) ([]GetResult, error) {
+	for _, key := range keys {
+		err := v.checkGetRequest(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	results := make([]GetResult, len(keys))
+	hits, dirs := v.Dm.MultiGet(keys)
+
+	var reads []int
+	for i := range keys {
+		if hits[i] {
+			reads = append(reads, i)
+		}
+	}
+	sort.Slice(reads, func(a, b int) bool {
+		return dirs[reads[a]].offset() < dirs[reads[b]].offset()
+	})
+
+	depth := v.ioDepth
+	if depth > len(reads) {
+		depth = len(reads)
+	}
+	ch := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < depth; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				results[i] = v.readChunk(keys[i], dirs[i])
+			}
+		}()
+	}
+	for _, i := range reads {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	return results, nil
+}
+
+// readChunk reads the chunk of a dir, and checks its key.
+func (v *Vol) readChunk(key []byte, d Dir) GetResult {
+	ck := &Chunk{Keys: v.keys}
+	err := ck.ReadAt(v.Fp, int64(d.offset()), int64(d.approxSize()))
+	if err != nil {
+		log.Printf("warning: failed to read data chunk. key: %s, offset: %d, approxSize: %d, err: %s", key, d.offset(), d.approxSize(), err)
+		return GetResult{Err: err}
+	}
+	ckKey, ckData := ck.GetKeyData()
+	if string(ckKey) != string(key) {
+		return GetResult{}
+	}
+	return GetResult{Hit: true, Value: ckData}
+}
+
+// MultiSet sets items in a batch. Chunks are written back to back with as few writes as possible,
+// then dirs are set segment by segment, each segment lock is taken once.
+// Nothing is visible if chunks fail to write.
+func (v *Vol) MultiSet(items []Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	cks := make([]*Chunk, len(items))
+	sizes := make([]int, len(items))
+	for i, it := range items {
+		err := v.checkSetRequest(it.Key, it.Value)
+		if err != nil {
+			return err
+		}
+		cks[i] = &Chunk{Compress: v.compress, Keys: v.keys}
+		err = cks[i].Set(it.Key, it.Value)
+		if err != nil {
+			return err
+		}
+		sizes[i] = int(cks[i].GetBinaryLength())
+	}
+
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+
+	// reserve write positions and serials together, so a later serial is never at an earlier position.
+	// a run is contiguous on disk until the ring wraps
+	offsets := make([]Offset, len(items))
+	var runs [][2]int
+	v.writeMu.Lock()
+	for i, ck := range cks {
+		size := Offset(sizes[i])
+		if v.WritePos+size > v.Length {
+			log.Printf("data write overflowed, start from dataOffset. set: writePos: %d, dataOffset: %d", v.WritePos, v.DataOffset)
+			v.WritePos = v.DataOffset
+		}
+		if i == 0 || v.WritePos != offsets[i-1]+Offset(sizes[i-1]) {
+			runs = append(runs, [2]int{i, i})
+		}
+		offsets[i] = v.WritePos
+		runs[len(runs)-1][1] = i + 1
+		v.WritePos += size
+		v.writeSerial++
+		ck.SetSerial(v.writeSerial)
+	}
+	v.writeMu.Unlock()
+
+	chunks := make([][]byte, len(items))
+	for i, ck := range cks {
+		var err error
+		chunks[i], err = ck.MarshalBinary()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, run := range runs {
+		var buf []byte
+		for i := run[0]; i < run[1]; i++ {
+			buf = append(buf, chunks[i]...)
+		}
+		_, err := v.Fp.WriteAt(buf, int64(offsets[run[0]]))
+		if err != nil {
+			return err
+		}
+	}
+	err := v.sync(DurabilityWrite)
+	if err != nil {
+		return err
+	}
+
+	keys := make([][]byte, len(items))
+	for i, it := range items {
+		keys[i] = it.Key
+	}
+	err = v.Dm.MultiSet(keys, offsets, sizes)
+	if err != nil {
+		return err
+	}
+	v.writeJournal()
+	return nil
+}
@@ -0,0 +1,127 @@
+package bakemono
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestVolMultiSetGet(t *testing.T) {
+	path := "/tmp/bakemono-test-multi.vol"
+	defer os.Remove(path)
+	// small vol, so the batch wraps around the data region
+	v, _, err := CreateTestingVol(path, 1024*1024*4, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	n := 100
+	var items []Item
+	for i := 0; i < n; i++ {
+		items = append(items, Item{Key: []byte(fmt.Sprintf("key-%d", i)), Value: bytes.Repeat([]byte{byte(i)}, 40*1024)})
+	}
+	items = append(items, Item{Key: []byte("key-7"), Value: []byte("value-7-new")})
+	err = v.MultiSet(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys [][]byte
+	for i := n - 1; i >= 0; i-- {
+		keys = append(keys, []byte(fmt.Sprintf("key-%d", i)))
+	}
+	keys = append(keys, []byte("missing"))
+	results, err := v.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("should return %d results, got %d", len(keys), len(results))
+	}
+	hits := 0
+	for j, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", keys[j], r.Err)
+		}
+		if !r.Hit {
+			continue
+		}
+		hits++
+		i := n - 1 - j
+		expected := bytes.Repeat([]byte{byte(i)}, 40*1024)
+		if i == 7 {
+			expected = []byte("value-7-new")
+		}
+		if !bytes.Equal(r.Value, expected) {
+			t.Fatalf("%s value mismatch", keys[j])
+		}
+	}
+	if results[len(results)-1].Hit {
+		t.Fatal("missing key should miss")
+	}
+	if r := results[n-1-7]; !r.Hit {
+		t.Fatal("key-7 should hit the last value")
+	}
+	// older chunks are overwritten by the wrap
+	if hits == 0 || hits == n {
+		t.Fatalf("tail of the batch should hit, and head overwritten, hits: %d", hits)
+	}
+
+	// same as Get one by one
+	for j, key := range keys {
+		hit, data, _ := v.Get(key)
+		if hit != results[j].Hit || !bytes.Equal(data, results[j].Value) {
+			t.Fatalf("%s should be the same as Get", key)
+		}
+	}
+}
+
+// TestVolMultiSetSerialOrder checks serials of chunks grow with their position, with Set and MultiSet
+// racing, so recovery picks the chunk written last.
+func TestVolMultiSetSerialOrder(t *testing.T) {
+	path := "/tmp/bakemono-test-multi-serial.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*16, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				var err error
+				if w%2 == 0 {
+					err = v.Set([]byte("key"), []byte(fmt.Sprintf("value-%d-%d", w, i)))
+				} else {
+					err = v.MultiSet([]Item{{Key: []byte("key"), Value: []byte(fmt.Sprintf("value-%d-%d", w, i))}, {Key: []byte("other"), Value: []byte("value")}})
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var last uint64
+	for pos := v.DataOffset; pos < v.WritePos; {
+		h := &ChunkHeader{}
+		err = h.ReadAt(v.Fp, int64(pos))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Serial <= last {
+			t.Fatalf("chunk at %d has serial %d, not after %d of the chunk before", pos, h.Serial, last)
+		}
+		last = h.Serial
+		pos += ChunkHeaderSizeFixed + Offset(h.DataLength)
+	}
+}
@@ -0,0 +1,144 @@
+package bakemono
+
+import (
+	"context"
+	"log"
+	"sort"
+)
+
+// RangeOptions controls Vol.RangeWithOptions.
+type RangeOptions struct {
+	// Snapshot copies all dirs before the first call of fn, and lists keys live at that moment.
+	// Keys set or deleted later are not seen. A key whose chunk is overwritten since is skipped, its value is gone.
+	// Without it, dirs are copied segment by segment, keys changed during Range may or may not be seen.
+	Snapshot bool
+}
+
+// Range calls fn for every live key with its value size and meta, until fn returns false.
+// See RangeWithOptions.
+func (v *Vol) Range(ctx context.Context, fn func(key []byte, size int, meta *ObjectMeta) bool) error {
+	return v.RangeWithOptions(ctx, nil, fn)
+}
+
+// RangeWithOptions walks dirs segment by segment, copying each under its read lock.
+// Every dir is confirmed by reading its chunk header, values are not read.
+// Stale dirs, keys of invalidated namespaces and chunks failing to verify are skipped.
+// fn must not modify key or meta after it returns. Returns ctx.Err() once ctx is done.
+// fn may call the vol, the layout lock is not held while it runs. Returns ErrVolResized if Resize runs meanwhile.
+func (v *Vol) RangeWithOptions(ctx context.Context, opts *RangeOptions, fn func(key []byte, size int, meta *ObjectMeta) bool) error {
+	return v.rangeChunks(ctx, opts, false, func(key []byte, h *ChunkHeader, _ []byte, meta *ObjectMeta) bool {
+		return fn(key, int(h.RawLength), meta)
+	})
+}
+
+// rangeChunks is RangeWithOptions, fn gets the chunk header. With values, the whole chunk is read and verified once
+// in place of its header, and fn gets the value too.
+func (v *Vol) rangeChunks(ctx context.Context, opts *RangeOptions, values bool, fn func(key []byte, h *ChunkHeader, value []byte, meta *ObjectMeta) bool) error {
+	if opts == nil {
+		opts = &RangeOptions{}
+	}
+
+	v.layoutMu.RLock()
+	dm := v.Dm
+	var snapshot [][]dirEntry
+	var startSerial uint64
+	if opts.Snapshot {
+		v.writeMu.Lock()
+		startSerial = v.writeSerial
+		v.writeMu.Unlock()
+		snapshot = make([][]dirEntry, dm.SegmentsNum)
+		for i := range snapshot {
+			snapshot[i] = dm.usedDirs(segId(i))
+		}
+	}
+	v.layoutMu.RUnlock()
+
+	for i := segId(0); Offset(i) < dm.SegmentsNum; i++ {
+		var entries []dirEntry
+		if opts.Snapshot {
+			entries = snapshot[i]
+		} else {
+			err := v.rlockLayout(dm)
+			if err != nil {
+				return err
+			}
+			entries = dm.usedDirs(i)
+			v.layoutMu.RUnlock()
+		}
+		// read chunk headers in order of disk offset
+		sort.Slice(entries, func(a, b int) bool {
+			return entries[a].d.offset() < entries[b].d.offset()
+		})
+		for _, e := range entries {
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+			err = v.rlockLayout(dm)
+			if err != nil {
+				return err
+			}
+			h, key, value, ok := v.rangeConfirm(ctx, i, e, opts.Snapshot, startSerial, values)
+			v.layoutMu.RUnlock()
+			if !ok {
+				continue
+			}
+			meta := &ObjectMeta{}
+			err = meta.UnmarshalBinary(h.GetMeta())
+			if err != nil {
+				log.Printf("warn: range: invalid meta of chunk, offset: %d, err: %v", e.d.offset(), err)
+				continue
+			}
+			if !fn(key, h, value, meta) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// rlockLayout takes layoutMu for reading, and fails with ErrVolResized if Resize replaced dm since.
+func (v *Vol) rlockLayout(dm *DirManager) error {
+	v.layoutMu.RLock()
+	if v.Dm != dm {
+		v.layoutMu.RUnlock()
+		return ErrVolResized
+	}
+	return nil
+}
+
+// rangeConfirm reads the chunk header and key of a dir copied from segment seg, and checks the dir is not stale.
+// With values, it reads the whole chunk and returns its value too.
+func (v *Vol) rangeConfirm(ctx context.Context, seg segId, e dirEntry, snapshot bool, startSerial uint64, values bool) (*ChunkHeader, []byte, []byte, bool) {
+	var h *ChunkHeader
+	var key, value []byte
+	r := contextReaderWriterAt{ctx, v.Fp}
+	if values {
+		ck := &Chunk{Keys: v.keys}
+		err := ck.ReadAt(r, int64(e.d.offset()), int64(e.d.approxSize()))
+		if err != nil {
+			return nil, nil, nil, false
+		}
+		h = &ck.Header
+		key, value = ck.GetKeyData()
+	} else {
+		var err error
+		h, key, err = v.readChunkHeader(r, Offset(e.d.offset()))
+		if err != nil {
+			return nil, nil, nil, false
+		}
+	}
+	tag, keySeg, _ := calcDirHashPosition(key, v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+	if keySeg != seg || tag != e.d.tag() {
+		// the chunk is overwritten by another key
+		return nil, nil, nil, false
+	}
+	if name, gen, ok := namespaceOfKey(key); ok && gen != v.namespaceGeneration(name) {
+		return nil, nil, nil, false
+	}
+	if snapshot {
+		return h, key, value, h.Serial <= startSerial
+	}
+	hit, _, d := v.Dm.Get(key)
+	return h, key, value, hit && d.offset() == e.d.offset()
+}
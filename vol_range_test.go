@@ -0,0 +1,89 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestVolRange(t *testing.T) {
+	path := "/tmp/bakemono-test-range.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	defer v.Close()
+
+	for i := 0; i < 50; i++ {
+		err := v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)), &ObjectMeta{Status: 200 + i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		err := v.Delete([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns := v.Namespace("ns")
+	if err := ns.Set([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Invalidate(); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	err := v.Range(context.Background(), func(key []byte, size int, meta *ObjectMeta) bool {
+		var i int
+		fmt.Sscanf(string(key), "key-%d", &i)
+		if size != len(fmt.Sprintf("value-%d", i)) || meta.Status != 200+i {
+			t.Fatalf("range got %s, size: %d, meta: %+v", key, size, meta)
+		}
+		seen[string(key)] = true
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 40 {
+		t.Fatalf("range should see 40 keys, got %d", len(seen))
+	}
+	for i := 10; i < 50; i++ {
+		if !seen[fmt.Sprintf("key-%d", i)] {
+			t.Fatalf("key-%d not seen", i)
+		}
+	}
+
+	// stop early
+	n := 0
+	_ = v.Range(context.Background(), func(key []byte, size int, meta *ObjectMeta) bool {
+		n++
+		return n < 5
+	})
+	if n != 5 {
+		t.Fatal("range should stop when fn returns false", n)
+	}
+
+	// snapshot keeps keys deleted during range, until their chunks are overwritten
+	n = 0
+	err = v.RangeWithOptions(context.Background(), &RangeOptions{Snapshot: true}, func(key []byte, size int, meta *ObjectMeta) bool {
+		if n == 0 {
+			for i := 10; i < 50; i++ {
+				_ = v.Delete([]byte(fmt.Sprintf("key-%d", i)))
+			}
+		}
+		n++
+		return true
+	})
+	if err != nil || n != 40 {
+		t.Fatal("snapshot range should see 40 keys", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = v.Range(ctx, func(key []byte, size int, meta *ObjectMeta) bool { return true })
+	if err != context.Canceled {
+		t.Fatal(err)
+	}
+}
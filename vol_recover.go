@@ -0,0 +1,203 @@
+package bakemono
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+)
+
+// recoverSeekWindow is the size of each read when searching the next chunk magic.
+const recoverSeekWindow = 1 << 20
+
+// RecoverOptions controls rebuilding dirs from the data region.
+type RecoverOptions struct {
+	// Budget limits the scanning time, 0 means no limit.
+	// Dirs rebuilt before the budget runs out are kept.
+	Budget time.Duration
+
+	// Progress is called about every ProgressInterval, and once more when the scan stops.
+	Progress         func(p RecoverProgress)
+	ProgressInterval time.Duration
+
+	// ResetDirs drops all dirs before scanning, so dirs are rebuilt from data only.
+	// Otherwise chunks are linked on top of the dirs in memory.
+	ResetDirs bool
+}
+
+// RecoverProgress is the progress of scanning the data region.
+type RecoverProgress struct {
+	ScannedBytes Offset
+	TotalBytes   Offset
+	Chunks       int // valid chunks found
+	Linked       int // chunks linked to dirs, older chunks of the same key are skipped
+	Elapsed      time.Duration
+	Done         bool // whole data region is scanned
+}
+
+// RecoverFromData rebuilds dirs by scanning chunks in the data region, chunk by chunk.
+// Every chunk carries its key and checksums, so a valid chunk header is enough to link it back.
+// If a key is found more than once, the chunk with the bigger write serial wins.
+// WritePos is restored to the end of the newest chunk.
+//
+// Note: only chunk headers are verified here, data is verified by Get as usual.
+// Delete and PurgeTag write nothing to data, so keys deleted or purged come back while their chunks are in the data region.
+// Keys of invalidated namespaces do not, their generations are moved past the recovered ones.
+// It should be called before serving, usually from Init with VolOptions.Recover.
+func (v *Vol) RecoverFromData(ctx context.Context, opts *RecoverOptions) (p RecoverProgress, err error) {
+	if opts == nil {
+		opts = &RecoverOptions{}
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	if opts.ResetDirs {
+		// every segment is flushed, segments left empty too
+		v.Dm.InitEmptyDirs()
+		v.Dm.markDirty()
+	}
+	interval := opts.ProgressInterval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	start := time.Now()
+	lastReport := start
+	p.TotalBytes = v.Length - v.DataOffset
+	report := func() {
+		p.Elapsed = time.Since(start)
+		if opts.Progress != nil {
+			opts.Progress(p)
+		}
+	}
+	defer report()
+
+	var newestSerial uint64
+	var newestEnd Offset
+	pos := v.DataOffset
+	resync := false
+	for pos < v.Length {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		if opts.Budget > 0 && time.Since(start) > opts.Budget {
+			log.Printf("warn: recover from data: budget %s ran out at %d", opts.Budget, pos)
+			break
+		}
+		if time.Since(lastReport) > interval {
+			lastReport = time.Now()
+			report()
+		}
+
+		if resync {
+			next, found, err := v.seekChunkMagic(pos)
+			if err != nil {
+				return p, err
+			}
+			pos, resync = next, !found
+			p.ScannedBytes = pos - v.DataOffset
+			continue
+		}
+
+		h := &ChunkHeader{}
+		err = h.ReadAt(v.Fp, int64(pos))
+		end := pos + ChunkHeaderSizeFixed + Offset(h.DataLength)
+		if err == ErrChunkVerifyFailed || (err == nil && end > v.Length) {
+			pos, resync = pos+1, true
+			continue
+		}
+		if err != nil {
+			return p, err
+		}
+
+		key, err := h.Decrypt(v.keys)
+		if err != nil {
+			// a valid chunk, of a key not in the keyring
+			pos = end
+			p.ScannedBytes = pos - v.DataOffset
+			continue
+		}
+
+		p.Chunks++
+		linked, err := v.recoverChunk(h, key, pos)
+		if err != nil {
+			return p, err
+		}
+		if linked {
+			p.Linked++
+		}
+		if h.Serial >= newestSerial {
+			newestSerial, newestEnd = h.Serial, end
+		}
+		pos = end
+		p.ScannedBytes = pos - v.DataOffset
+	}
+	if pos >= v.Length {
+		p.ScannedBytes = p.TotalBytes
+		p.Done = true
+	}
+
+	if p.Chunks > 0 {
+		v.writeMu.Lock()
+		v.WritePos = newestEnd
+		if v.WritePos >= v.Length {
+			v.WritePos = v.DataOffset
+		}
+		if newestSerial > v.writeSerial {
+			v.writeSerial = newestSerial
+		}
+		v.writeMu.Unlock()
+	}
+	return p, nil
+}
+
+// recoverChunk links a scanned chunk of key to dirs, unless a newer chunk of the same key is linked already.
+func (v *Vol) recoverChunk(h *ChunkHeader, key []byte, off Offset) (linked bool, err error) {
+	if !v.headerLoaded {
+		v.recoverNamespaceKey(key)
+	}
+	hit, _, d := v.Dm.Get(key)
+	if hit {
+		old, oldKey, err := v.readChunkHeader(v.Fp, Offset(d.offset()))
+		if err == nil && bytes.Equal(oldKey, key) && old.Serial > h.Serial {
+			return false, nil
+		}
+	}
+	_, err = v.Dm.Set(key, off, ChunkHeaderSizeFixed+int(h.DataLength))
+	if err != nil {
+		return false, err
+	}
+	if v.tags != nil {
+		err = v.indexChunkTags(h, key, off)
+		if err != nil {
+			log.Printf("warn: index tags of recovered chunk failed, offset: %d, err: %v", off, err)
+		}
+	}
+	return true, nil
+}
+
+// seekChunkMagic searches chunk magic in a window from off.
+// Returns the offset of the magic if found, otherwise the offset to continue searching from.
+func (v *Vol) seekChunkMagic(off Offset) (next Offset, found bool, err error) {
+	magic := make([]byte, 4)
+	binary.BigEndian.PutUint32(magic, MagicChunk)
+
+	size := Offset(recoverSeekWindow)
+	if off+size > v.Length {
+		size = v.Length - off
+	}
+	buf := make([]byte, size)
+	n, err := v.Fp.ReadAt(buf, int64(off))
+	if err != nil && err != io.EOF {
+		return off, false, err
+	}
+	if i := bytes.Index(buf[:n], magic); i >= 0 {
+		return off + Offset(i), true, nil
+	}
+	if n < len(magic) || off+Offset(n) >= v.Length {
+		return v.Length, false, nil
+	}
+	// keep the tail, magic may be cut by the window
+	return off + Offset(n-len(magic)+1), false, nil
+}
@@ -0,0 +1,224 @@
+package bakemono
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func openRecoverTestingVol(t *testing.T, path string, fileSize, chunkSize uint64, opts *RecoverOptions) (*Vol, bool) {
+	cfg, err := NewDefaultVolOptions(path, fileSize, chunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Recover = opts
+	v := &Vol{}
+	corrupted, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, corrupted
+}
+
+// corruptVolMeta wipes headers A and B of a closed vol file.
+func corruptVolMeta(t *testing.T, v *Vol, path string) {
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	for _, off := range []Offset{v.HeaderAOffset, v.HeaderBOffset} {
+		_, err = fp.WriteAt(make([]byte, HeaderSize), int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVolRecoverFromData(t *testing.T) {
+	path := "/tmp/bakemono-test-recover.vol"
+	defer os.Remove(path)
+	v, _ := openRecoverTestingVol(t, path, 1024*1024*100, 1024*1024, nil)
+
+	for i := 0; i < 100; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rewrite, newer chunk should win
+	err := v.Set([]byte("key-5"), []byte("value-5-new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePos := v.WritePos
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptVolMeta(t, v, path)
+
+	progressCalled := 0
+	v2, corrupted := openRecoverTestingVol(t, path, 1024*1024*100, 1024*1024, &RecoverOptions{
+		Progress: func(p RecoverProgress) { progressCalled++ },
+	})
+	defer v2.Close()
+	if !corrupted {
+		t.Fatal("vol should be corrupted")
+	}
+	if progressCalled == 0 {
+		t.Fatal("progress should be reported")
+	}
+	if v2.WritePos != writePos {
+		t.Fatalf("WritePos should be restored to %d, got %d", writePos, v2.WritePos)
+	}
+	for i := 0; i < 100; i++ {
+		expected := fmt.Sprintf("value-%d", i)
+		if i == 5 {
+			expected = "value-5-new"
+		}
+		hit, data, err := v2.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit && string(data) != expected {
+			t.Fatalf("key-%d should be %s, got %s", i, expected, data)
+		}
+		if !hit && i == 5 {
+			t.Fatal("key-5 should hit")
+		}
+	}
+}
+
+func TestVolRecoverFromDataWrapped(t *testing.T) {
+	path := "/tmp/bakemono-test-recover-wrap.vol"
+	defer os.Remove(path)
+	v, _ := openRecoverTestingVol(t, path, 1024*1024*20, 256*1024, nil)
+
+	r := rand.New(rand.NewSource(42))
+	latest := make(map[string][]byte)
+	for i := 0; i < 600; i++ {
+		key := fmt.Sprintf("key-%d", r.Intn(50))
+		value := bytes.Repeat([]byte{byte(i)}, 1024*(1+r.Intn(100)))
+		err := v.Set([]byte(key), value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest[key] = value
+	}
+	err := v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptVolMeta(t, v, path)
+
+	v2, corrupted := openRecoverTestingVol(t, path, 1024*1024*20, 256*1024, &RecoverOptions{})
+	defer v2.Close()
+	if !corrupted {
+		t.Fatal("vol should be corrupted")
+	}
+	hits := 0
+	for key, value := range latest {
+		hit, data, err := v2.Get([]byte(key))
+		if err != nil || !hit {
+			continue
+		}
+		hits++
+		if !bytes.Equal(data, value) {
+			t.Fatalf("%s should be the latest value", key)
+		}
+	}
+	if hits == 0 {
+		t.Fatal("some keys should hit after recover")
+	}
+	t.Logf("hits after recover: %d/%d", hits, len(latest))
+}
+
+func TestVolRecoverFromDataBudget(t *testing.T) {
+	path := "/tmp/bakemono-test-recover-budget.vol"
+	defer os.Remove(path)
+	v, _ := openRecoverTestingVol(t, path, 1024*1024*100, 1024*1024, nil)
+	defer v.Close()
+
+	p, err := v.RecoverFromData(context.Background(), &RecoverOptions{Budget: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Done {
+		t.Fatal("scan should stop by budget")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = v.RecoverFromData(ctx, nil)
+	if err != context.Canceled {
+		t.Fatalf("scan should be canceled, err: %v", err)
+	}
+}
+
+func TestVolRecoverFromDataResetDirs(t *testing.T) {
+	path := "/tmp/bakemono-test-recover-reset.vol"
+	defer os.Remove(path)
+	v, _ := openRecoverTestingVol(t, path, 1024*1024*100, 512, nil)
+	if v.Dm.SegmentsNum < 2 {
+		t.Fatalf("vol should have more than 1 segment, got %d", v.Dm.SegmentsNum)
+	}
+	for i := 0; i < 100; i++ {
+		err := v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Delete([]byte("key-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, d := v.Dm.Get([]byte("key-2"))
+	_, err = v.Fp.WriteAt([]byte("bit rot"), int64(d.offset()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = v.RecoverFromData(context.Background(), &RecoverOptions{ResetDirs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// segments left empty must be flushed too
+	for i, dirty := range v.Dm.segDirty {
+		if !dirty {
+			t.Fatalf("segment %d should be dirty after reset", i)
+		}
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ = openRecoverTestingVol(t, path, 1024*1024*100, 512, nil)
+	defer v.Close()
+	if hit, _, _ := v.Get([]byte("key-2")); hit {
+		t.Fatal("key of a bad chunk should not be linked")
+	}
+	// a deleted key comes back, nothing of the delete is in data
+	if hit, _, _ := v.Get([]byte("key-1")); !hit {
+		t.Fatal("deleted key should be recovered from its chunk")
+	}
+	for i := 3; i < 100; i++ {
+		hit, data, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil || !hit || string(data) != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("key-%d should hit, hit: %v, err: %v", i, hit, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package bakemono
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// ResizeStats is the result of Resize.
+type ResizeStats struct {
+	Kept    int // chunks left in place
+	Moved   int // chunks moved into the new data region
+	Dropped int // chunks not fitting in the new data region, or overwritten by moved ones
+}
+
+// truncater is implemented by storage able to change its size, like *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+type resizeChunk struct {
+	key    []byte
+	tags   []string
+	off    Offset
+	size   Offset
+	serial uint64
+}
+
+// Resize changes the layout of the vol to cfg, for a grown or shrunk file or another ChunkAvgSize.
+// Dirs are rebuilt for the new layout. Live chunks inside the new data region are kept in place,
+// others are moved to the write position, newest first while they fit.
+// cfg.Fp must be nil or the Fp of the vol. The file is truncated to cfg.FileSize if Fp implements Truncate,
+// otherwise it must be sized by the caller.
+//
+// Other calls on the vol wait until Resize returns, a Range running meanwhile returns ErrVolResized.
+// The new meta is written and synced with its header last, the old header is valid until then.
+// A crash before leaves the old layout: Init with cfg fails with ErrVolLayoutMismatch, Init with the old options,
+// segments of the old meta overwritten by the new one are reset as corrupted.
+func (v *Vol) Resize(cfg *VolOptions) (stats ResizeStats, err error) {
+	if v.readOnly {
+		return stats, ErrVolReadOnly
+	}
+	c := *cfg
+	cfg = &c
+	if cfg.Fp == nil {
+		cfg.Fp = v.Fp
+	}
+	if cfg.Fp != v.Fp {
+		return stats, errors.New("resize: Fp must be the Fp of the vol")
+	}
+	if cfg.ReadOnly {
+		return stats, errors.New("resize: ReadOnly is not allowed")
+	}
+	err = cfg.Check()
+	if err != nil {
+		return stats, err
+	}
+	if cfg.FlushMetaInterval == 0 {
+		cfg.FlushMetaInterval = v.flushInterval
+	}
+	if cfg.Scrub == nil && v.scrub != nil {
+		scrub := v.scrub.opts
+		cfg.Scrub = &scrub
+	}
+
+	v.stopLoops()
+	defer v.startLoops(cfg.FlushMetaInterval, cfg.Scrub)
+	v.layoutMu.Lock()
+	defer v.layoutMu.Unlock()
+
+	// final flush of the old layout, so nothing is lost if resize fails.
+	// It ends in copy B, the new meta goes to A and overwrites the older copy first.
+	err = v.flushMetaToFp()
+	if err == nil && v.metaCopy == 0 {
+		err = v.flushMetaToFp()
+	}
+	if err != nil {
+		return stats, err
+	}
+	chunks, err := v.liveChunks(context.Background())
+	if err != nil {
+		return stats, err
+	}
+	oldLength, oldHeader := v.Length, *v.Header
+	v.writeMu.Lock()
+	oldWritePos := v.WritePos
+	v.writeMu.Unlock()
+
+	t, canTruncate := v.Fp.(truncater)
+	if cfg.FileSize > oldLength && canTruncate {
+		err = t.Truncate(int64(cfg.FileSize))
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	v.initLayout(cfg)
+	v.nsMu.Lock()
+	v.initEmptyMeta()
+	v.Header.CreateUnixTime = oldHeader.CreateUnixTime
+	v.Header.SyncSerial = oldHeader.SyncSerial
+	v.Header.Namespaces = oldHeader.Namespaces
+	v.nsMu.Unlock()
+	v.journal, v.tags = nil, nil
+	if v.JournalSize > 0 {
+		v.journal = newJournal(v.Fp, v.JournalOffset, v.JournalSize)
+		v.journal.reset(uint64(time.Now().UnixNano()), 0)
+	}
+	if v.TagIndexSize > 0 {
+		v.tags = newTagIndex(int(v.tagIndexHalfSize()))
+	}
+
+	writePos := oldWritePos
+	if writePos < v.DataOffset || writePos >= v.Length {
+		writePos = v.DataOffset
+	}
+	placed, writePos, err := v.relocateChunks(chunks, writePos, &stats)
+	if err != nil {
+		return stats, fmt.Errorf("resize: %w", err)
+	}
+
+	sort.Slice(placed, func(a, b int) bool {
+		return placed[a].serial < placed[b].serial
+	})
+	for _, ck := range placed {
+		_, err = v.Dm.Set(ck.key, ck.off, int(ck.size))
+		if err != nil {
+			return stats, fmt.Errorf("resize: %w", err)
+		}
+		if v.tags != nil && len(ck.tags) > 0 {
+			err = v.tags.add(ck.tags, v.tagRefOf(ck.key, ck.off))
+			if err != nil {
+				log.Printf("warn: resize: drop tags of key: %s, err: %v", ck.key, err)
+			}
+		}
+	}
+	v.writeMu.Lock()
+	v.WritePos = writePos
+	v.writeMu.Unlock()
+
+	// point of no return, the header of the new layout is written last
+	err = v.flushMetaToFp()
+	if err != nil {
+		return stats, fmt.Errorf("resize: %w", err)
+	}
+	if cfg.FileSize < oldLength && canTruncate {
+		err = t.Truncate(int64(cfg.FileSize))
+		if err != nil {
+			return stats, err
+		}
+	}
+	v.Dm.journal = v.journal
+	log.Printf("resize done, stats: %+v", stats)
+	return stats, nil
+}
+
+// liveChunks returns confirmed chunks of all dirs. Returns ctx.Err() once ctx is done.
+func (v *Vol) liveChunks(ctx context.Context) ([]resizeChunk, error) {
+	var chunks []resizeChunk
+	for i := segId(0); Offset(i) < v.Dm.SegmentsNum; i++ {
+		for _, e := range v.Dm.usedDirs(i) {
+			h, key, _, ok := v.rangeConfirm(ctx, i, e, false, 0, false)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !ok {
+				continue
+			}
+			meta := &ObjectMeta{}
+			_ = meta.UnmarshalBinary(h.GetMeta())
+			chunks = append(chunks, resizeChunk{
+				key:    key,
+				tags:   meta.Tags,
+				off:    Offset(e.d.offset()),
+				size:   ChunkHeaderSizeFixed + Offset(h.DataLength),
+				serial: h.Serial,
+			})
+		}
+	}
+	return chunks, nil
+}
+
+// relocateChunks keeps chunks inside the data region, and moves the others to writePos.
+// Moved chunks are picked newest first, and written oldest first, so the ring wraps at most once.
+// Kept chunks overwritten by moved ones are dropped.
+// A moved chunk straddling the data region may be overwritten by an earlier move once the ring wraps,
+// so it is read before the first write. Others are out of the region, no move overwrites them.
+func (v *Vol) relocateChunks(chunks []resizeChunk, writePos Offset, stats *ResizeStats) (placed []resizeChunk, end Offset, err error) {
+	var kept, moving []resizeChunk
+	for _, ck := range chunks {
+		if ck.off >= v.DataOffset && ck.off+ck.size <= v.Length {
+			kept = append(kept, ck)
+		} else {
+			moving = append(moving, ck)
+		}
+	}
+
+	// leave room for the gap at the tail when the ring wraps
+	budget := v.Length - v.DataOffset
+	if budget > ChunkHeaderSizeFixed+ChunkDataSize {
+		budget -= ChunkHeaderSizeFixed + ChunkDataSize
+	} else {
+		budget = 0
+	}
+	sort.Slice(moving, func(a, b int) bool {
+		return moving[a].serial > moving[b].serial
+	})
+	var total Offset
+	n := 0
+	for ; n < len(moving) && total+moving[n].size <= budget; n++ {
+		total += moving[n].size
+	}
+	stats.Dropped += len(moving) - n
+	moving = moving[:n]
+
+	read := func(ck resizeChunk) ([]byte, error) {
+		data := make([]byte, ck.size)
+		_, err := v.Fp.ReadAt(data, int64(ck.off))
+		return data, err
+	}
+	straddling := make(map[int][]byte)
+	for i, ck := range moving {
+		if ck.off < v.Length && v.DataOffset < ck.off+ck.size {
+			straddling[i], err = read(ck)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	// written ranges, at most two as the ring wraps once
+	var runs [][2]Offset
+	pos := writePos
+	for i := len(moving) - 1; i >= 0; i-- {
+		ck := moving[i]
+		if pos+ck.size > v.Length {
+			pos = v.DataOffset
+		}
+		data, ok := straddling[i]
+		if !ok {
+			data, err = read(ck)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		_, err = v.Fp.WriteAt(data, int64(pos))
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(runs) == 0 || runs[len(runs)-1][1] != pos {
+			runs = append(runs, [2]Offset{pos, pos})
+		}
+		runs[len(runs)-1][1] = pos + ck.size
+		ck.off = pos
+		placed = append(placed, ck)
+		pos += ck.size
+		stats.Moved++
+	}
+	if len(moving) > 0 {
+		err = v.sync(DurabilityWrite)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	for _, ck := range kept {
+		overwritten := false
+		for _, r := range runs {
+			if ck.off < r[1] && r[0] < ck.off+ck.size {
+				overwritten = true
+				break
+			}
+		}
+		if overwritten {
+			stats.Dropped++
+			continue
+		}
+		placed = append(placed, ck)
+		stats.Kept++
+	}
+	return placed, pos, nil
+}
@@ -0,0 +1,225 @@
+package bakemono
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestVolResize(t *testing.T) {
+	path := "/tmp/bakemono-test-resize.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*64, 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.JournalSize = 1024 * JournalRecordSize
+	cfg.TagIndexSize = 64 * 1024
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("value-%d-%0100000d", i, i))
+	}
+	// about 50MB
+	n := 500
+	for i := 0; i < n; i++ {
+		err := v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), value(i), &ObjectMeta{Tags: []string{"all"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.InvalidateNamespace("ns"); err != nil {
+		t.Fatal(err)
+	}
+
+	// grow, meta region grows over the first chunks, they are moved
+	grow := *cfg
+	grow.FileSize = 1024 * 1024 * 128
+	grow.ChunkAvgSize = 32 * 1024
+	stats, err := v.Resize(&grow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Kept+stats.Moved != n || stats.Moved == 0 {
+		t.Fatalf("all chunks should be kept or moved after grow: %+v", stats)
+	}
+	for i := 0; i < n; i++ {
+		hit, data, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil || !hit || string(data) != string(value(i)) {
+			t.Fatalf("key-%d should hit after grow, hit: %v, err: %v", i, hit, err)
+		}
+	}
+	if v.namespaceGeneration("ns") != 1 {
+		t.Fatal("namespaces should be kept")
+	}
+
+	// shrink, the newest chunks fitting are kept
+	shrink := grow
+	shrink.FileSize = 1024 * 1024 * 32
+	stats, err = v.Resize(&shrink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Dropped == 0 || stats.Kept+stats.Moved+stats.Dropped != n {
+		t.Fatalf("some chunks should be dropped after shrink: %+v", stats)
+	}
+	hits := 0
+	for i := 0; i < n; i++ {
+		hit, data, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit {
+			hits++
+			if string(data) != string(value(i)) {
+				t.Fatalf("key-%d data mismatch", i)
+			}
+		}
+	}
+	if hits != stats.Kept+stats.Moved {
+		t.Fatalf("hits %d, stats: %+v", hits, stats)
+	}
+	hit, _, _ := v.Get([]byte(fmt.Sprintf("key-%d", n-1)))
+	if !hit {
+		t.Fatal("newest key should be kept")
+	}
+	purged, err := v.PurgeTag("all")
+	if err != nil || purged != hits {
+		t.Fatal("tags should be kept", purged, err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := os.Stat(path)
+	if st.Size() != int64(shrink.FileSize) {
+		t.Fatal("file should be truncated", st.Size())
+	}
+
+	// the old layout is refused now
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	old := *cfg
+	old.Fp, old.FileSize = fp, shrink.FileSize
+	_, err = (&Vol{}).Init(&old)
+	if !errors.Is(err, ErrVolLayoutMismatch) {
+		t.Fatal("old layout should be refused", err)
+	}
+}
+
+// TestVolResizeRelocateStraddling moves a chunk straddling the data region after an older one,
+// which wraps the ring onto its source.
+func TestVolResizeRelocateStraddling(t *testing.T) {
+	const dataOffset, length = 1 << 20, 3 << 20
+	v := &Vol{Fp: NewMemStore(length + 64*1024), DataOffset: dataOffset, Length: length}
+	image := make([]byte, length+64*1024)
+	rand.New(rand.NewSource(1)).Read(image)
+	_, err := v.Fp.WriteAt(image, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older := resizeChunk{key: []byte("older"), off: length, size: 64 * 1024, serial: 1}
+	straddling := resizeChunk{key: []byte("straddling"), off: dataOffset - 100, size: 4096, serial: 2}
+	stats := ResizeStats{}
+	placed, _, err := v.relocateChunks([]resizeChunk{straddling, older}, length-1000, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 2 || len(placed) != 2 {
+		t.Fatalf("both chunks should be moved, stats: %+v", stats)
+	}
+	for _, ck := range placed {
+		src := straddling
+		if string(ck.key) == "older" {
+			src = older
+		}
+		data := make([]byte, ck.size)
+		_, err = v.Fp.ReadAt(data, int64(ck.off))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, image[src.off:src.off+src.size]) {
+			t.Fatalf("chunk %s moved to %d should be a copy of its source", ck.key, ck.off)
+		}
+	}
+}
+
+// TestVolResizeConcurrent runs Set and Get during Resize, run it with -race.
+func TestVolResizeConcurrent(t *testing.T) {
+	cfg := NewMemVolOptions(1024*1024*32, 16*1024)
+	v := &Vol{}
+	_, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	value := func(key string) []byte {
+		return bytes.Repeat([]byte(key), 500)
+	}
+
+	stop := make(chan struct{})
+	errCh := make(chan error, 4)
+	wg := sync.WaitGroup{}
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for {
+				select {
+				case <-stop:
+					errCh <- nil
+					return
+				default:
+				}
+				key := fmt.Sprintf("key-%d", r.Intn(200))
+				err := v.Set([]byte(key), value(key))
+				if err != nil {
+					errCh <- fmt.Errorf("set %s: %w", key, err)
+					return
+				}
+				key = fmt.Sprintf("key-%d", r.Intn(200))
+				hit, data, err := v.Get([]byte(key))
+				if err != nil {
+					errCh <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+				if hit && !bytes.Equal(data, value(key)) {
+					errCh <- fmt.Errorf("get %s: value mismatch", key)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for _, size := range []uint64{64, 16, 32} {
+		resize := *cfg
+		resize.FileSize = Offset(size * 1024 * 1024)
+		_, err = v.Resize(&resize)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v.Length != 32*1024*1024 {
+		t.Fatalf("vol should be resized, length: %d", v.Length)
+	}
+}
@@ -1,44 +1,102 @@
 package bakemono
 
-import "log"
+import (
+	"context"
+	"io"
+	"log"
+)
 
 const MaxKeyLength = 4096
 
 func (v *Vol) Set(key, value []byte) (err error) {
+	return v.SetContext(context.Background(), key, value)
+}
+
+// SetContext is Set, returns ctx.Err() once ctx is done while waiting for IO or the segment lock.
+// The value is not visible if it returns an error, an abandoned chunk write may still land on disk.
+func (v *Vol) SetContext(ctx context.Context, key, value []byte) (err error) {
+	return v.setContext(ctx, key, value, nil, nil)
+}
+
+// SetWithMeta is Set, and stores meta in the chunk header next to the value.
+// The encoded meta must fit in ChunkMetaMaxSize. meta.Tags are added to the tag index for PurgeTag.
+func (v *Vol) SetWithMeta(key, value []byte, meta *ObjectMeta) error {
+	raw, err := meta.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return v.setContext(context.Background(), key, value, raw, meta.Tags)
+}
+
+func (v *Vol) setContext(ctx context.Context, key, value, meta []byte, tags []string) (err error) {
 	//log.Printf("DEBUG: set key: %s, value_len: %d", key, len(value))
 	err = v.checkSetRequest(key, value)
 	if err != nil {
 		return err
 	}
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	if len(tags) > 0 && v.tags == nil {
+		return ErrTagIndexDisabled
+	}
 
 	// make data chunk
-	ck := &Chunk{}
+	ck := &Chunk{Compress: v.compress, Keys: v.keys}
 	err = ck.Set(key, value)
 	if err != nil {
 		return err
 	}
+	err = ck.SetMeta(meta)
+	if err != nil {
+		return err
+	}
 
 	// process data write position
 	binLenOnDisk := ck.GetBinaryLength()
+	v.writeMu.Lock()
 	if v.WritePos+binLenOnDisk > v.Length {
 		log.Printf("data write overflowed, start from dataOffset. set: writePos: %d, dataOffset: %d, len(value): %d", v.WritePos, v.DataOffset, len(value))
 		v.WritePos = v.DataOffset
 	}
 	writeOffset := v.WritePos
 	v.WritePos += binLenOnDisk
+	v.writeSerial++
+	ck.SetSerial(v.writeSerial)
+	v.writeMu.Unlock()
 
-	// set dir
-	_, err = v.Dm.Set(key, writeOffset, int(binLenOnDisk))
+	// write to disk first, readers and scrubber never see a dir pointing to an unwritten chunk.
+	err = ck.WriteAt(contextReaderWriterAt{ctx, v.Fp}, int64(writeOffset))
+	if err != nil {
+		return err
+	}
+	err = v.sync(DurabilityWrite)
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		err = v.tags.add(tags, v.tagRefOf(key, writeOffset))
+		if err != nil {
+			return err
+		}
+	}
 
-	// write to disk
-	err = ck.WriteAt(v.Fp, int64(writeOffset))
+	// set dir
+	_, err = v.Dm.SetContext(ctx, key, writeOffset, int(binLenOnDisk))
 	if err != nil {
 		return err
 	}
+	v.writeJournal()
 	return nil
 }
 
 func (v *Vol) checkSetRequest(key, value []byte) (err error) {
+	if v.readOnly {
+		return ErrVolReadOnly
+	}
 	if len(key) > MaxKeyLength {
 		return ErrChunkKeyTooLarge
 	}
@@ -49,13 +107,27 @@ func (v *Vol) checkSetRequest(key, value []byte) (err error) {
 }
 
 func (v *Vol) Get(key []byte) (hit bool, value []byte, err error) {
+	return v.GetContext(context.Background(), key)
+}
+
+// GetContext is Get, returns ctx.Err() once ctx is done while waiting for IO or the segment lock.
+func (v *Vol) GetContext(ctx context.Context, key []byte) (hit bool, value []byte, err error) {
 	//log.Printf("DEBUG: get key: %s", key)
 	err = v.checkGetRequest(key)
 	if err != nil {
 		return false, nil, err
 	}
+	err = ctx.Err()
+	if err != nil {
+		return false, nil, err
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
 
-	hit, _, d := v.Dm.Get(key)
+	hit, _, d, err := v.Dm.GetContext(ctx, key)
+	if err != nil {
+		return false, nil, err
+	}
 
 	if !hit {
 		return false, nil, nil
@@ -65,8 +137,11 @@ func (v *Vol) Get(key []byte) (hit bool, value []byte, err error) {
 	readOffset := d.offset()
 	approxSize := d.approxSize()
 
-	ck := &Chunk{}
-	err = ck.ReadAt(v.Fp, int64(readOffset), int64(approxSize))
+	ck := &Chunk{Keys: v.keys}
+	err = ck.ReadAt(contextReaderWriterAt{ctx, v.Fp}, int64(readOffset), int64(approxSize))
+	if err != nil && ctx.Err() != nil {
+		return false, nil, ctx.Err()
+	}
 	if err != nil {
 		log.Printf("warning: failed to read data chunk. key: %s, offset: %d, approxSize: %d, err: %s", key, readOffset, approxSize, err)
 		return false, nil, err
@@ -80,9 +155,124 @@ func (v *Vol) Get(key []byte) (hit bool, value []byte, err error) {
 	return true, ckData, nil
 }
 
+// GetWithMeta is Get, also returns the meta stored by SetWithMeta.
+func (v *Vol) GetWithMeta(key []byte) (hit bool, value []byte, meta *ObjectMeta, err error) {
+	err = v.checkGetRequest(key)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	hit, _, d := v.Dm.Get(key)
+	if !hit {
+		return false, nil, nil, nil
+	}
+	ck := &Chunk{Keys: v.keys}
+	err = ck.ReadAt(v.Fp, int64(d.offset()), int64(d.approxSize()))
+	if err != nil {
+		log.Printf("warning: failed to read data chunk. key: %s, offset: %d, approxSize: %d, err: %s", key, d.offset(), d.approxSize(), err)
+		return false, nil, nil, err
+	}
+	if ckKey, _ := ck.GetKeyData(); string(ckKey) != string(key) {
+		return false, nil, nil, nil
+	}
+	meta = &ObjectMeta{}
+	err = meta.UnmarshalBinary(ck.Header.GetMeta())
+	if err != nil {
+		return false, nil, nil, err
+	}
+	return true, ck.DataRaw, meta, nil
+}
+
+// Exists reports whether key may be in the vol, answered from dirs in memory without any disk read.
+// It may be a false positive: dirs only keep a 12-bit tag of the key, and the chunk may be overwritten.
+// Use Stat to confirm.
+func (v *Vol) Exists(key []byte) bool {
+	if v.checkGetRequest(key) != nil {
+		return false
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	hit, _, _ := v.Dm.Get(key)
+	return hit
+}
+
+// ObjectInfo is what Stat returns about a key.
+type ObjectInfo struct {
+	Size int // exact length of the value
+	Meta ObjectMeta
+}
+
+// Stat returns the exact size and meta of key.
+// Only the fixed size chunk header is read to confirm the full key, not the value.
+func (v *Vol) Stat(key []byte) (hit bool, info ObjectInfo, err error) {
+	err = v.checkGetRequest(key)
+	if err != nil {
+		return false, info, err
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	hit, _, d := v.Dm.Get(key)
+	if !hit {
+		return false, info, nil
+	}
+	h, ckKey, err := v.readChunkHeader(v.Fp, Offset(d.offset()))
+	if err != nil {
+		log.Printf("warning: failed to read chunk header. key: %s, offset: %d, err: %s", key, d.offset(), err)
+		return false, info, err
+	}
+	if string(ckKey) != string(key) {
+		return false, info, nil
+	}
+	err = info.Meta.UnmarshalBinary(h.GetMeta())
+	if err != nil {
+		return false, info, err
+	}
+	info.Size = int(h.RawLength)
+	return true, info, nil
+}
+
 func (v *Vol) checkGetRequest(key []byte) (err error) {
 	if len(key) > MaxKeyLength {
 		return ErrChunkKeyTooLarge
 	}
 	return nil
 }
+
+// Delete removes the key from the vol. The chunk on disk is left in place and overwritten later.
+func (v *Vol) Delete(key []byte) (err error) {
+	err = v.checkDeleteRequest(key)
+	if err != nil {
+		return err
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	if v.Dm.Delete(key) {
+		v.writeJournal()
+	}
+	return nil
+}
+
+func (v *Vol) checkDeleteRequest(key []byte) (err error) {
+	if v.readOnly {
+		return ErrVolReadOnly
+	}
+	if len(key) > MaxKeyLength {
+		return ErrChunkKeyTooLarge
+	}
+	return nil
+}
+
+// readChunkHeader reads and verifies the chunk header at off, and returns its key, decrypted if the vol is encrypted.
+func (v *Vol) readChunkHeader(r io.ReaderAt, off Offset) (*ChunkHeader, []byte, error) {
+	h := &ChunkHeader{}
+	err := h.ReadAt(r, int64(off))
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := h.Decrypt(v.keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, key, nil
+}
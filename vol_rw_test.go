@@ -1 +1,97 @@
 package bakemono
+
+import (
+	"os"
+	"testing"
+)
+
+func TestVolSetWithMetaStat(t *testing.T) {
+	path := "/tmp/bakemono-test-meta.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+
+	meta := &ObjectMeta{Status: 404, ContentType: "text/plain", Headers: map[string][]string{"X-Test": {"1"}}}
+	err := v.SetWithMeta([]byte("key"), []byte("value"), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Set([]byte("plain"), []byte("value-plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hit, info, err := v.Stat([]byte("key"))
+	if err != nil || !hit {
+		t.Fatal("stat failed", hit, err)
+	}
+	if info.Size != 5 || info.Meta.Status != 404 || info.Meta.ContentType != "text/plain" || info.Meta.Headers["X-Test"][0] != "1" {
+		t.Fatalf("stat info mismatch: %+v", info)
+	}
+	hit, value, m, err := v.GetWithMeta([]byte("key"))
+	if err != nil || !hit || string(value) != "value" || m.Status != 404 {
+		t.Fatal("get with meta failed", hit, err)
+	}
+
+	hit, info, err = v.Stat([]byte("plain"))
+	if err != nil || !hit || info.Size != 11 || info.Meta.Status != 0 {
+		t.Fatal("stat plain failed", hit, info, err)
+	}
+	hit, _, err = v.Stat([]byte("missing"))
+	if err != nil || hit {
+		t.Fatal("stat missing key should miss", err)
+	}
+
+	// meta survives reopen
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _, _ = CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	defer v.Close()
+	hit, info, err = v.Stat([]byte("key"))
+	if err != nil || !hit || info.Meta.Status != 404 {
+		t.Fatal("stat after reopen failed", hit, err)
+	}
+}
+
+func TestVolExistsStatHeaderOnly(t *testing.T) {
+	path := "/tmp/bakemono-test-stat.vol"
+	defer os.Remove(path)
+	v, _, _ := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	defer v.Close()
+
+	if v.Exists([]byte("key")) {
+		t.Fatal("key should not exist")
+	}
+	value := make([]byte, 100000)
+	err := v.Set([]byte("key"), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Exists([]byte("key")) {
+		t.Fatal("key should exist")
+	}
+
+	// corrupt the value, Stat still works as it reads only the header
+	_, _, d := v.Dm.Get([]byte("key"))
+	_, err = v.Fp.WriteAt([]byte("bad"), int64(d.offset())+ChunkHeaderSizeFixed+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit, info, err := v.Stat([]byte("key"))
+	if err != nil || !hit || info.Size != len(value) {
+		t.Fatal("stat failed", hit, info.Size, err)
+	}
+	_, _, err = v.Get([]byte("key"))
+	if err == nil {
+		t.Fatal("get should fail on a corrupted value")
+	}
+
+	err = v.Delete([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Exists([]byte("key")) {
+		t.Fatal("deleted key should not exist")
+	}
+}
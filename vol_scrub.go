@@ -0,0 +1,143 @@
+package bakemono
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const DefaultScrubBytesPerSecond = 4 << 20 // 4MB/s
+
+// ScrubOptions enables a background scrubber, which reads chunks of used dirs
+// and drops dirs whose chunks are corrupted or belong to other keys.
+type ScrubOptions struct {
+	// BytesPerSecond limits the read rate of scrubber, 0 means DefaultScrubBytesPerSecond.
+	BytesPerSecond int64
+	// PassInterval is the pause between two passes over all used dirs.
+	PassInterval time.Duration
+}
+
+// ScrubStats is the progress of the background scrubber.
+type ScrubStats struct {
+	Passes         uint64  // finished passes
+	PassProgress   float64 // progress of current pass, 0-1
+	CheckedChunks  uint64
+	CheckedBytes   uint64
+	BadChunks      uint64 // chunks failed to verify, or key not matching the dir
+	ReadErrors     uint64 // chunks failed to read, their dirs are kept
+	DroppedDirs    uint64
+	LastPassFinish time.Time
+}
+
+// scrubber holds state of the background scrubber.
+type scrubber struct {
+	opts   ScrubOptions
+	doneCh chan struct{}
+
+	mu    sync.Mutex
+	stats ScrubStats
+}
+
+// ScrubStats returns the progress of background scrubber.
+// Zero value is returned if scrubber is disabled.
+func (v *Vol) ScrubStats() ScrubStats {
+	if v.scrub == nil {
+		return ScrubStats{}
+	}
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+	return v.scrub.stats
+}
+
+// ScrubLoop scrubs used dirs pass by pass, until the vol is closed.
+func (v *Vol) ScrubLoop() {
+	defer close(v.scrub.doneCh)
+	for {
+		if !v.scrubPass() {
+			return
+		}
+		select {
+		case <-v.closeCh:
+			return
+		case <-time.After(v.scrub.opts.PassInterval):
+		}
+	}
+}
+
+// scrubPass scrubs all used dirs once. Returns false if the vol is closed.
+func (v *Vol) scrubPass() bool {
+	rate := v.scrub.opts.BytesPerSecond
+	if rate <= 0 {
+		rate = DefaultScrubBytesPerSecond
+	}
+	for seg := segId(0); Offset(seg) < v.Dm.SegmentsNum; seg++ {
+		for _, e := range v.Dm.usedDirs(seg) {
+			size := v.scrubDir(seg, e)
+
+			// throttle, scrubber is low priority
+			select {
+			case <-v.closeCh:
+				return false
+			case <-time.After(time.Duration(size) * time.Second / time.Duration(rate)):
+			}
+		}
+		v.scrub.mu.Lock()
+		v.scrub.stats.PassProgress = float64(seg+1) / float64(v.Dm.SegmentsNum)
+		v.scrub.mu.Unlock()
+	}
+
+	v.scrub.mu.Lock()
+	v.scrub.stats.Passes++
+	v.scrub.stats.PassProgress = 0
+	v.scrub.stats.LastPassFinish = time.Now()
+	v.scrub.mu.Unlock()
+	return true
+}
+
+// scrubDir reads and verifies the chunk of a used dir. The dir is dropped only if the chunk fails to verify,
+// on a bad magic or checksum, or belongs to another key. On an IO error, or a cancelled read, it is kept for the next pass.
+// Returns bytes read.
+func (v *Vol) scrubDir(segmentId segId, e dirEntry) int64 {
+	size := int64(e.d.approxSize())
+	ck := &Chunk{Keys: v.keys}
+	readErr := false
+	err := ck.ReadAt(v.Fp, int64(e.d.offset()), size)
+	if err == nil {
+		key, _ := ck.GetKeyData()
+		tag, seg, _ := calcDirHashPosition(key, v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+		if tag != e.d.tag() || seg != segmentId {
+			err = ErrChunkVerifyFailed
+		}
+	} else if !errors.Is(err, ErrChunkVerifyFailed) {
+		readErr = true
+	}
+
+	dropped := false
+	if err != nil && !readErr {
+		dropped = v.Dm.invalidateDir(segmentId, e)
+		if dropped {
+			v.writeJournal()
+			log.Printf("warn: scrubber dropped dir, segment: %d, dir: %d, offset: %d, err: %v", segmentId, e.offset, e.d.offset(), err)
+		}
+	}
+	if readErr {
+		log.Printf("warn: scrubber failed to read chunk, keep the dir, segment: %d, dir: %d, offset: %d, err: %v", segmentId, e.offset, e.d.offset(), err)
+	}
+
+	v.scrub.mu.Lock()
+	defer v.scrub.mu.Unlock()
+	v.scrub.stats.CheckedChunks++
+	v.scrub.stats.CheckedBytes += uint64(size)
+	if err != nil {
+		if readErr {
+			v.scrub.stats.ReadErrors++
+		} else {
+			v.scrub.stats.BadChunks++
+		}
+	}
+	if dropped {
+		v.scrub.stats.DroppedDirs++
+	}
+	return size
+}
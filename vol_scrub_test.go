@@ -0,0 +1,110 @@
+package bakemono
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVolScrub(t *testing.T) {
+	path := "/tmp/bakemono-test-scrub.vol"
+	defer os.Remove(path)
+	cfg, err := NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Scrub = &ScrubOptions{BytesPerSecond: 1 << 30, PassInterval: 10 * time.Millisecond}
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		err = v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, _, d := v.Dm.Get([]byte("key-3"))
+	_, err = v.Fp.WriteAt([]byte("bit rot"), int64(d.offset())+ChunkHeaderSizeFixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for a whole pass after corruption
+	passes := v.ScrubStats().Passes
+	deadline := time.Now().Add(5 * time.Second)
+	for v.ScrubStats().Passes < passes+2 {
+		if time.Now().After(deadline) {
+			t.Fatal("scrubber should finish passes in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	st := v.ScrubStats()
+	t.Logf("scrub stats: %+v", st)
+	if st.BadChunks != 1 || st.DroppedDirs != 1 {
+		t.Fatalf("scrubber should drop 1 bad chunk, stats: %+v", st)
+	}
+	if hit, _, _ := v.Dm.Get([]byte("key-3")); hit {
+		t.Fatal("dir of key-3 should be dropped")
+	}
+	hit, data, err := v.Get([]byte("key-4"))
+	if err != nil || !hit || string(data) != "value-4" {
+		t.Fatalf("key-4 should hit, hit: %v, err: %v", hit, err)
+	}
+
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVolScrubReadError(t *testing.T) {
+	store := NewFaultStore(NewMemStore(1024*1024*16), 1)
+	cfg := NewMemVolOptions(1024*1024*16, 64*1024)
+	cfg.Fp = store
+	cfg.Scrub = &ScrubOptions{BytesPerSecond: 1 << 30, PassInterval: 10 * time.Millisecond}
+	v := &Vol{}
+	_, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	for i := 0; i < 20; i++ {
+		err = v.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reads of key-3 fail, and cancelled reads of key-4
+	for key, readErr := range map[string]error{"key-3": nil, "key-4": context.Canceled} {
+		_, _, d := v.Dm.Get([]byte(key))
+		store.Inject(Fault{Op: FaultRead, Kind: FaultFail, Offset: int64(d.offset()), Length: 1, Err: readErr})
+	}
+
+	passes := v.ScrubStats().Passes
+	deadline := time.Now().Add(5 * time.Second)
+	for v.ScrubStats().Passes < passes+2 {
+		if time.Now().After(deadline) {
+			t.Fatal("scrubber should finish passes in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := v.ScrubStats()
+	if st.ReadErrors < 2 || st.BadChunks != 0 || st.DroppedDirs != 0 {
+		t.Fatalf("scrubber should keep dirs of chunks failing to read, stats: %+v", st)
+	}
+
+	store.Clear()
+	for _, key := range []string{"key-3", "key-4"} {
+		hit, _, err := v.Get([]byte(key))
+		if err != nil || !hit {
+			t.Fatalf("%s should hit once reads work again, hit: %v, err: %v", key, hit, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package bakemono
+
+import (
+	"hash/crc32"
+	"log"
+)
+
+// PurgeTag deletes every key set with the surrogate tag in ObjectMeta.Tags.
+// Dirs are found through the tag index in memory, no chunk is read.
+// Returns the number of keys deleted.
+func (v *Vol) PurgeTag(tag string) (purged int, err error) {
+	if v.readOnly {
+		return 0, ErrVolReadOnly
+	}
+	v.layoutMu.RLock()
+	defer v.layoutMu.RUnlock()
+	if v.tags == nil {
+		return 0, ErrTagIndexDisabled
+	}
+	for _, r := range v.tags.take(tag) {
+		if v.Dm.deleteDir(segId(r.Segment), Offset(r.Bucket), r.Tag, r.Offset) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		v.writeJournal()
+	}
+	return purged, nil
+}
+
+// tagRefOf returns the ref of the dir of key pointing to chunk off.
+func (v *Vol) tagRefOf(key []byte, off Offset) tagRef {
+	tag, seg, bucket := calcDirHashPosition(key, v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+	return tagRef{Segment: uint32(seg), Bucket: uint32(bucket), Tag: tag, Offset: uint64(off)}
+}
+
+// indexChunkTags adds the tags in meta of a chunk header of key at off to the tag index.
+func (v *Vol) indexChunkTags(h *ChunkHeader, key []byte, off Offset) error {
+	meta := &ObjectMeta{}
+	err := meta.UnmarshalBinary(h.GetMeta())
+	if err != nil || len(meta.Tags) == 0 {
+		return err
+	}
+	return v.tags.add(meta.Tags, v.tagRefOf(key, off))
+}
+
+// tagIndexHalfSize is the capacity of the tag index, the region keeps two copies.
+func (v *Vol) tagIndexHalfSize() Offset {
+	return v.TagIndexSize / 2
+}
+
+// loadTagIndex reads the tag index copy pointed by the header.
+func (v *Vol) loadTagIndex() error {
+	h := v.Header
+	v.tagIndexHalf = h.TagIndexPos
+	if h.TagIndexSize != v.TagIndexSize || h.TagIndexLength == 0 {
+		v.tags.markDirty()
+		return nil
+	}
+	if h.TagIndexPos > 1 || Offset(h.TagIndexLength) > v.tagIndexHalfSize() {
+		return ErrTagIndexInvalid
+	}
+	data := make([]byte, h.TagIndexLength)
+	_, err := v.Fp.ReadAt(data, int64(v.TagIndexOffset+Offset(h.TagIndexPos)*v.tagIndexHalfSize()))
+	if err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(data) != h.TagIndexChecksum {
+		return ErrTagIndexInvalid
+	}
+	return v.tags.unmarshalBinary(data)
+}
+
+// indexJournalSets rebuilds tags of chunks set by replayed journal records, they may be newer than the tag index flushed.
+func (v *Vol) indexJournalSets(sets []journalRecord) {
+	for _, r := range sets {
+		if !v.Dm.hasDir(segId(r.Segment), Offset(r.Bucket), r.Tag, r.Offset) {
+			continue
+		}
+		h, key, err := v.readChunkHeader(v.Fp, Offset(r.Offset))
+		if err != nil {
+			continue
+		}
+		err = v.indexChunkTags(h, key, Offset(r.Offset))
+		if err != nil {
+			log.Printf("warn: index tags of journaled chunk failed, offset: %d, err: %v", r.Offset, err)
+		}
+	}
+}
+
+// flushTagIndex writes the tag index to the copy not pointed by the header on disk, and points the header to it.
+// Stale refs are pruned first.
+func (v *Vol) flushTagIndex() error {
+	v.tags.prune(func(r tagRef) bool {
+		return v.Dm.hasDir(segId(r.Segment), Offset(r.Bucket), r.Tag, r.Offset)
+	})
+	data, dirty := v.tags.snapshot()
+	if !dirty {
+		return nil
+	}
+	half := 1 - v.tagIndexHalf
+	_, err := v.Fp.WriteAt(data, int64(v.TagIndexOffset+Offset(half)*v.tagIndexHalfSize()))
+	if err != nil {
+		v.tags.markDirty()
+		return err
+	}
+	v.Header.TagIndexPos = half
+	v.Header.TagIndexLength = uint64(len(data))
+	v.Header.TagIndexChecksum = crc32.ChecksumIEEE(data)
+	return nil
+}
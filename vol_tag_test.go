@@ -0,0 +1,152 @@
+package bakemono
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func createTagTestingVol(t *testing.T, path string, tagIndexSize Offset, readOnly bool) *Vol {
+	var cfg *VolOptions
+	var err error
+	if readOnly {
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = &VolOptions{Fp: fp, FileSize: 1024 * 1024 * 100, ChunkAvgSize: 1024 * 1024, ReadOnly: true}
+	} else {
+		cfg, err = NewDefaultVolOptions(path, 1024*1024*100, 1024*1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.JournalSize = 1024 * JournalRecordSize
+	cfg.TagIndexSize = tagIndexSize
+	v := &Vol{}
+	_, err = v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func setTagged(t *testing.T, v *Vol, from, to int, tags func(i int) []string) {
+	for i := from; i < to; i++ {
+		err := v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)), &ObjectMeta{Tags: tags(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVolPurgeTag(t *testing.T) {
+	path := "/tmp/bakemono-test-tag.vol"
+	defer os.Remove(path)
+	v := createTagTestingVol(t, path, 64*1024, false)
+
+	// even keys are in product-0, odd keys in product-1, all in site
+	setTagged(t, v, 0, 20, func(i int) []string {
+		return []string{fmt.Sprintf("product-%d", i%2), "site"}
+	})
+	// key-0 is overwritten without tags, not purged any more
+	err := v.Set([]byte("key-0"), []byte("untagged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := v.PurgeTag("product-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 9 {
+		t.Fatalf("purged should be 9, got %d", purged)
+	}
+	for i := 0; i < 20; i++ {
+		hit, _, err := v.Get([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != (i%2 == 1 || i == 0) {
+			t.Fatalf("key-%d hit: %v", i, hit)
+		}
+	}
+	purged, _ = v.PurgeTag("product-0")
+	if purged != 0 {
+		t.Fatal("purged tag should be gone")
+	}
+
+	// tag index survives restart
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = createTagTestingVol(t, path, 64*1024, false)
+	defer v.Close()
+	purged, err = v.PurgeTag("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 10 {
+		t.Fatalf("purged should be 10, got %d", purged)
+	}
+	hit, _, _ := v.Get([]byte("key-0"))
+	if !hit {
+		t.Fatal("untagged key-0 should hit")
+	}
+}
+
+func TestVolPurgeTagAfterCrash(t *testing.T) {
+	path := "/tmp/bakemono-test-tag-crash.vol"
+	defer os.Remove(path)
+	v := createTagTestingVol(t, path, 64*1024, false)
+	defer v.Close()
+
+	setTagged(t, v, 0, 5, func(i int) []string { return []string{"flushed"} })
+	err := v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTagged(t, v, 5, 10, func(i int) []string { return []string{"journaled"} })
+
+	// open the file as it is after a crash, tags after the flush are rebuilt from the journal
+	v2 := createTagTestingVol(t, path, 64*1024, true)
+	defer v2.Close()
+	if len(v2.tags.refs["flushed"]) != 5 || len(v2.tags.refs["journaled"]) != 5 {
+		t.Fatalf("tags should be restored, got %d, %d", len(v2.tags.refs["flushed"]), len(v2.tags.refs["journaled"]))
+	}
+}
+
+func TestVolTagIndexFull(t *testing.T) {
+	path := "/tmp/bakemono-test-tag-full.vol"
+	defer os.Remove(path)
+	v := createTagTestingVol(t, path, 2*BlockSize, false)
+	defer v.Close()
+
+	var err error
+	for i := 0; err == nil; i++ {
+		if i > BlockSize/tagRefSize {
+			t.Fatal("tag index should be full")
+		}
+		err = v.SetWithMeta([]byte(fmt.Sprintf("key-%d", i)), []byte("value"), &ObjectMeta{Tags: []string{"tag"}})
+	}
+	if err != ErrTagIndexFull {
+		t.Fatal(err)
+	}
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2 := createTagTestingVol(t, "/tmp/bakemono-test-tag-disabled.vol", 0, false)
+	defer os.Remove("/tmp/bakemono-test-tag-disabled.vol")
+	defer v2.Close()
+	err = v2.SetWithMeta([]byte("key"), []byte("value"), &ObjectMeta{Tags: []string{"tag"}})
+	if err != ErrTagIndexDisabled {
+		t.Fatal(err)
+	}
+	_, err = v2.PurgeTag("tag")
+	if err != ErrTagIndexDisabled {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package bakemono
 
 import (
+	"fmt"
 	"os"
 	"testing"
 )
@@ -159,3 +160,269 @@ func TestVolBadRead(t *testing.T) {
 		t.Fatal("vol should be corrupted")
 	}
 }
+
+func TestVolDeleteAndReadOnly(t *testing.T) {
+	path := "/tmp/bakemono-test-ro.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"key1", "key2"} {
+		err = v.Set([]byte(k), []byte("value-"+k))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = v.Delete([]byte("key1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit, _, err := v.Get([]byte("key1"))
+	if err != nil || hit {
+		t.Fatalf("key1 should miss after delete, err: %v", err)
+	}
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := &Vol{}
+	corrupted, err := v2.Init(&VolOptions{Fp: fp, FileSize: 1024 * 1024 * 100, ChunkAvgSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupted {
+		t.Fatal("vol should not be corrupted")
+	}
+	hit, data, err := v2.Get([]byte("key2"))
+	if err != nil || !hit || string(data) != "value-key2" {
+		t.Fatalf("key2 should hit after reopen, hit: %v, err: %v", hit, err)
+	}
+	if err = v2.Set([]byte("key3"), []byte("value")); err != ErrVolReadOnly {
+		t.Fatalf("set on read-only vol should fail, err: %v", err)
+	}
+	if err = v2.Delete([]byte("key2")); err != ErrVolReadOnly {
+		t.Fatalf("delete on read-only vol should fail, err: %v", err)
+	}
+	err = v2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVolFlushDirtySegments(t *testing.T) {
+	path := "/tmp/bakemono-test-seg.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Dm.SegmentsNum < 2 {
+		t.Fatalf("vol should have more than 1 segment, got %d", v.Dm.SegmentsNum)
+	}
+
+	keys := make(map[segId][]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, seg, _ := calcDirHashPosition([]byte(key), v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+		keys[seg] = append(keys[seg], key)
+		err = v.Set([]byte(key), []byte("value-"+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dirty := range v.Dm.segDirty {
+		if dirty {
+			t.Fatalf("segment %d should be clean after flush", i)
+		}
+	}
+
+	key := keys[1][0]
+	err = v.Set([]byte(key), []byte("value-"+key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dirty := range v.Dm.segDirty {
+		if dirty != (i == 1) {
+			t.Fatalf("only segment 1 should be dirty, segment %d dirty: %v", i, dirty)
+		}
+	}
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt dirs of segment 0 only, in the copy of meta flushed last
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte("bit rot"), int64(v.metaOffsets(v.metaCopy).dirs+8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	v2, corrupted, err := CreateTestingVol(path, 1024*1024*100, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	if !corrupted {
+		t.Fatal("vol should be corrupted")
+	}
+	for seg, ks := range keys {
+		for _, k := range ks {
+			hit, data, err := v2.Get([]byte(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seg == 0 && hit {
+				t.Fatalf("key %s in corrupted segment should miss", k)
+			}
+			if seg != 0 && (!hit || string(data) != "value-"+k) {
+				t.Fatalf("key %s in segment %d should hit", k, seg)
+			}
+		}
+	}
+}
+
+func TestVolMetaAlternate(t *testing.T) {
+	mem := NewMemStore(1024 * 1024 * 100)
+	store := NewFaultStore(mem, 1)
+	cfg := NewMemVolOptions(1024*1024*100, 512)
+	cfg.Fp = store
+	v := &Vol{}
+	_, err := v.Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Dm.SegmentsNum < 2 {
+		t.Fatalf("vol should have more than 1 segment, got %d", v.Dm.SegmentsNum)
+	}
+	// set keys of segment 0 only, or of every segment
+	var keys []string
+	set := func(prefix string, n int, onlySeg0 bool) {
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("%s-%d", prefix, i)
+			_, seg, _ := calcDirHashPosition([]byte(key), v.Dm.SegmentsNum, v.Dm.BucketsNumPerSegment)
+			if onlySeg0 && seg != 0 {
+				continue
+			}
+			err := v.Set([]byte(key), []byte("value-"+key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	// segments flushed by the first flush only must be brought to the other copy by the second
+	set("a", 100, false)
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := v.metaCopy
+	set("b", 100, true)
+	err = v.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.metaCopy == first {
+		t.Fatal("flushes should alternate meta copies")
+	}
+	flushed := keys
+
+	// tear the header of the next flush, the copy of the second flush is intact
+	store.Inject(Fault{Op: FaultWrite, Kind: FaultTear, Offset: int64(v.metaOffsets(first).header), Length: int64(HeaderSize)})
+	set("c", 100, false)
+	err = v.Flush()
+	if err == nil {
+		t.Fatal("flush should fail with a torn header")
+	}
+
+	cfg = NewMemVolOptions(1024*1024*100, 512)
+	cfg.Fp = NewMemStoreFrom(mem.Bytes())
+	v2 := &Vol{}
+	corrupted, err := v2.Init(cfg)
+	if err != nil || corrupted {
+		t.Fatalf("vol should open from the other copy, corrupted: %v, err: %v", corrupted, err)
+	}
+	defer v2.Close()
+	if v2.metaCopy == first {
+		t.Fatal("meta should be loaded from the copy of the second flush")
+	}
+	for _, key := range flushed {
+		hit, data, err := v2.Get([]byte(key))
+		if err != nil || !hit || string(data) != "value-"+key {
+			t.Fatalf("key %s should hit, hit: %v, err: %v", key, hit, err)
+		}
+	}
+}
+
+func TestVolCleanShutdown(t *testing.T) {
+	path := "/tmp/bakemono-test-clean.vol"
+	defer os.Remove(path)
+	v, _, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.CleanShutdown() {
+		t.Fatal("new vol should not be clean shutdown")
+	}
+	err = v.Set([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no flush, Close flushes
+	err = v.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v2, corrupted, err := CreateTestingVol(path, 1024*1024*100, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if corrupted || !v2.CleanShutdown() {
+		t.Fatalf("vol should be clean shutdown, corrupted: %v", corrupted)
+	}
+	hit, data, err := v2.Get([]byte("key"))
+	if err != nil || !hit || string(data) != "value" {
+		t.Fatalf("key should hit after clean shutdown, hit: %v, err: %v", hit, err)
+	}
+
+	// v2 is still open, a crash now is not clean
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3 := &Vol{}
+	_, err = v3.Init(&VolOptions{Fp: fp, FileSize: 1024 * 1024 * 100, ChunkAvgSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v3.CleanShutdown() {
+		t.Fatal("flag should be cleared once opened for writing")
+	}
+	_ = v3.Close()
+	_ = v2.Close()
+}